@@ -0,0 +1,71 @@
+// Command crmfake is a local stand-in for the CRMs the lead sync talks to. It
+// logs every request and answers like the real API:
+//
+//	crmfake -addr :8089
+//	CRM_PROVIDER=webhook  CRM_BASE_URL=http://localhost:8089/webhook
+//	CRM_PROVIDER=amocrm   CRM_BASE_URL=http://localhost:8089
+//	CRM_PROVIDER=bitrix24 CRM_BASE_URL=http://localhost:8089/rest/1/fake
+//
+// -fail N makes every Nth request fail with 500 to exercise retries.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type fake struct {
+	mu     sync.Mutex
+	nextID int64
+	calls  int
+	failN  int
+}
+
+func main() {
+	addr := flag.String("addr", ":8089", "listen address")
+	failN := flag.Int("fail", 0, "fail every Nth request with 500, 0 never")
+	flag.Parse()
+
+	f := &fake{nextID: 1000, failN: *failN}
+	log.Printf("crmfake: listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, f))
+}
+
+func (f *fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	f.mu.Lock()
+	f.calls++
+	fail := f.failN > 0 && f.calls%f.failN == 0
+	f.nextID++
+	id := f.nextID
+	f.mu.Unlock()
+
+	log.Printf("crmfake: %s %s signature=%q auth=%t\n%s", r.Method, r.URL.Path, r.Header.Get("X-Signature"), r.Header.Get("Authorization") != "", body)
+	if fail {
+		http.Error(w, "injected failure", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	path := r.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/crm.lead.add.json"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": id})
+	case strings.HasSuffix(path, "/crm.lead.update.json"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": true})
+	case path == "/api/v4/leads/complex" && r.Method == http.MethodPost:
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": id, "contact_id": id + 1}})
+	case strings.HasPrefix(path, "/api/v4/leads/") && r.Method == http.MethodPatch:
+		json.NewEncoder(w).Encode(map[string]string{"id": strings.TrimPrefix(path, "/api/v4/leads/")})
+	case r.Method == http.MethodPost:
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": fmt.Sprintf("wh-%d", id)})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,94 @@
+// Command tgadmin manages the Telegram webhook registration.
+//
+//	tgadmin set -url https://api.example.com/v1/telegram/webhook
+//	tgadmin info
+//	tgadmin delete
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"iq-home/go_beckend/internal/app/channel"
+	"iq-home/go_beckend/internal/app/config"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cfg := config.LoadTelegram()
+	tg := channel.NewTelegram(cfg, &http.Client{Timeout: 15 * time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	switch os.Args[1] {
+	case "set":
+		fs := flag.NewFlagSet("set", flag.ExitOnError)
+		url := fs.String("url", os.Getenv("TELEGRAM_WEBHOOK_URL"), "public HTTPS URL of /v1/telegram/webhook")
+		allowed := fs.String("allowed-updates", strings.Join(channel.DefaultAllowedUpdates, ","), "comma-separated update types")
+		maxConn := fs.Int("max-connections", 40, "max simultaneous webhook connections (1-100)")
+		drop := fs.Bool("drop-pending", false, "drop updates queued while the webhook was down")
+		_ = fs.Parse(os.Args[2:])
+
+		err := tg.SetWebhook(ctx, channel.WebhookOptions{
+			URL:                *url,
+			AllowedUpdates:     splitList(*allowed),
+			MaxConnections:     *maxConn,
+			DropPendingUpdates: *drop,
+		})
+		if err != nil {
+			log.Fatalf("setWebhook: %v", err)
+		}
+		fmt.Println("webhook set")
+		printInfo(ctx, tg)
+	case "info":
+		printInfo(ctx, tg)
+	case "delete":
+		fs := flag.NewFlagSet("delete", flag.ExitOnError)
+		drop := fs.Bool("drop-pending", false, "drop pending updates")
+		_ = fs.Parse(os.Args[2:])
+		if err := tg.DeleteWebhook(ctx, *drop); err != nil {
+			log.Fatalf("deleteWebhook: %v", err)
+		}
+		fmt.Println("webhook deleted")
+	default:
+		usage()
+	}
+}
+
+func printInfo(ctx context.Context, tg *channel.Telegram) {
+	info, err := tg.GetWebhookInfo(ctx)
+	if err != nil {
+		log.Fatalf("getWebhookInfo: %v", err)
+	}
+	fmt.Printf("url:             %s\n", info.URL)
+	fmt.Printf("pending updates: %d\n", info.PendingUpdateCount)
+	fmt.Printf("max connections: %d\n", info.MaxConnections)
+	fmt.Printf("allowed updates: %s\n", strings.Join(info.AllowedUpdates, ","))
+	if info.LastErrorMessage != "" {
+		fmt.Printf("last error:      %s (%s)\n", info.LastErrorMessage, time.Unix(info.LastErrorDate, 0).Format(time.RFC3339))
+		os.Exit(1)
+	}
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: tgadmin set|info|delete [flags]")
+	os.Exit(2)
+}
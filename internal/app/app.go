@@ -1,12 +1,18 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"iq-home/go_beckend/internal/app/config"
 	apphttp "iq-home/go_beckend/internal/app/http"
+	"iq-home/go_beckend/internal/app/http/handlers"
 	"iq-home/go_beckend/internal/infra/db/postgres"
 )
 
@@ -19,7 +25,13 @@ func Run() {
 	}
 	defer db.Close()
 
-	router := apphttp.NewRouter(cfg, db)
+	// ctx ends on SIGINT/SIGTERM and stops the background workers and the
+	// Telegram poller before the queues are drained.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	h := handlers.New(ctx, db, cfg)
+	router := apphttp.NewRouter(cfg, h)
 
 	srv := &http.Server{
 		Addr:              cfg.HTTPAddr,
@@ -27,6 +39,23 @@ func Run() {
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
-	log.Printf("listening on %s", cfg.HTTPAddr)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		log.Printf("listening on %s", cfg.HTTPAddr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stopSignals()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	log.Printf("shutting down")
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := h.Close(shutdownCtx); err != nil {
+		log.Printf("drain: %v", err)
+	}
 }
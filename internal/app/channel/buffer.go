@@ -0,0 +1,161 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+// Batch is what the buffer hands to the chat pipeline once a session goes quiet:
+// all texts typed in a row plus at most one file.
+type Batch struct {
+	SessionID string
+	UserID    string
+	Texts     []string
+	File      *File
+}
+
+type sessionBuffer struct {
+	pending Batch
+	timer   *time.Timer
+	started time.Time
+	onFlush func(Batch)
+}
+
+// Buffer debounces bursts of messages per session so that "розетки", "белые",
+// "10 штук" sent one after another are answered as a single request. onFlush is
+// always called from a timer goroutine (or from FlushAll), never from inside
+// AddText or AddFile, so it may block.
+//
+// After Close nothing is debounced any more: AddText and AddFile return the
+// session's batch, pending texts included, for the caller to process at once.
+type Buffer struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionBuffer
+	closed   bool
+}
+
+const (
+	idleWindow = 6 * time.Second
+	maxWait    = 30 * time.Second
+)
+
+func NewBuffer() *Buffer {
+	return &Buffer{sessions: make(map[string]*sessionBuffer)}
+}
+
+// AddText buffers text and returns nil, or after Close returns the batches to
+// process right away.
+func (b *Buffer) AddText(sessionID, userID, text string, onFlush func(Batch)) []Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf := b.sessionLocked(sessionID, userID)
+	buf.pending.Texts = append(buf.pending.Texts, text)
+	if b.closed {
+		return []Batch{b.detachLocked(sessionID)}
+	}
+	b.resetTimerLocked(sessionID, buf, onFlush)
+	return nil
+}
+
+// AddFile buffers file like AddText. A batch holds one file, so an earlier
+// pending file is flushed first.
+func (b *Buffer) AddFile(sessionID, userID string, file File, onFlush func(Batch)) []Batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []Batch
+	if buf := b.sessions[sessionID]; buf != nil && buf.pending.File != nil {
+		pending := b.detachLocked(sessionID)
+		if b.closed {
+			out = append(out, pending)
+		} else {
+			time.AfterFunc(0, func() { onFlush(pending) })
+		}
+	}
+	buf := b.sessionLocked(sessionID, userID)
+	buf.pending.File = &file
+	if b.closed {
+		return append(out, b.detachLocked(sessionID))
+	}
+	b.resetTimerLocked(sessionID, buf, onFlush)
+	return nil
+}
+
+// Close turns debouncing off. Batches already pending stay until their timer
+// fires, the session's next update or FlushAll.
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+}
+
+// FlushAll hands every pending batch to its callback right away. It is used
+// when the server shuts down.
+func (b *Buffer) FlushAll() {
+	b.mu.Lock()
+	var flushes []func()
+	for sessionID, buf := range b.sessions {
+		pending, onFlush := b.detachLocked(sessionID), buf.onFlush
+		if onFlush != nil {
+			flushes = append(flushes, func() { onFlush(pending) })
+		}
+	}
+	b.mu.Unlock()
+	for _, f := range flushes {
+		f()
+	}
+}
+
+func (b *Buffer) sessionLocked(sessionID, userID string) *sessionBuffer {
+	buf := b.sessions[sessionID]
+	if buf == nil {
+		buf = &sessionBuffer{
+			pending: Batch{SessionID: sessionID, UserID: userID},
+			started: time.Now(),
+		}
+		b.sessions[sessionID] = buf
+	}
+	if buf.pending.UserID == "" {
+		buf.pending.UserID = userID
+	}
+	return buf
+}
+
+// resetTimerLocked waits for idleWindow of silence, but never past maxWait
+// since the first message of the batch.
+func (b *Buffer) resetTimerLocked(sessionID string, buf *sessionBuffer, onFlush func(Batch)) {
+	if buf.timer != nil {
+		buf.timer.Stop()
+	}
+	buf.onFlush = onFlush
+	wait := idleWindow
+	if left := maxWait - time.Since(buf.started); left < wait {
+		wait = left
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	buf.timer = time.AfterFunc(wait, func() {
+		b.flush(sessionID, onFlush)
+	})
+}
+
+func (b *Buffer) flush(sessionID string, onFlush func(Batch)) {
+	b.mu.Lock()
+	pending := b.detachLocked(sessionID)
+	b.mu.Unlock()
+	if pending.SessionID != "" {
+		onFlush(pending)
+	}
+}
+
+func (b *Buffer) detachLocked(sessionID string) Batch {
+	buf := b.sessions[sessionID]
+	if buf == nil {
+		return Batch{}
+	}
+	delete(b.sessions, sessionID)
+	if buf.timer != nil {
+		buf.timer.Stop()
+	}
+	return buf.pending
+}
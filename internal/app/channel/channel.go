@@ -0,0 +1,83 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ErrUnauthorized is returned by ReceiveUpdates when the request fails the
+// channel's signature or secret check.
+var ErrUnauthorized = errors.New("channel: unauthorized update")
+
+// Update is an inbound messenger event normalised across channels.
+type Update struct {
+	ID         string
+	SessionID  string
+	UserID     string
+	Text       string
+	Media      *Media
+	Action     string // payload of a pressed button, see chat.ChatAction
+	CallbackID string
+	UserName   string
+	ReplyText  string // text of the message this one replies to
+	Contact    *Contact
+}
+
+// Contact is a phone number the user shared with the messenger's button.
+type Contact struct {
+	Phone string
+	Name  string
+	// Own is set when the messenger vouches that the number is the sender's,
+	// not a contact card of someone else.
+	Own bool
+}
+
+// Media references a file that still has to be downloaded from the channel.
+type Media struct {
+	Kind     string
+	FileID   string
+	FileName string
+	MimeType string
+}
+
+// File is downloaded media ready to be passed to chat.Service.
+type File struct {
+	Kind        string
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+type Button struct {
+	Text string
+	Data string
+}
+
+// Card is a product shown as a photo with a caption and its own buttons.
+// ImageURL may be empty, the card then goes out as a plain message.
+type Card struct {
+	ImageURL string
+	Caption  string
+	Buttons  [][]Button
+}
+
+// Adapter is implemented by every messenger the bot is reachable through.
+type Adapter interface {
+	Name() string
+	Owns(sessionID string) bool
+	ReceiveUpdates(r *http.Request) ([]Update, error)
+	DownloadMedia(ctx context.Context, m Media) (File, error)
+	SendText(ctx context.Context, sessionID, text string) error
+	SendDocument(ctx context.Context, sessionID, filename string, data []byte) error
+	SendTyping(ctx context.Context, u Update) error
+	SendButtons(ctx context.Context, sessionID, text string, rows [][]Button) error
+	SendCards(ctx context.Context, sessionID string, cards []Card) error
+	AckAction(ctx context.Context, u Update) error
+}
+
+// ContactRequester is implemented by adapters that can offer a share-contact
+// button, see chat.ChatResponse.RequestContact.
+type ContactRequester interface {
+	SendContactRequest(ctx context.Context, sessionID, text string) error
+}
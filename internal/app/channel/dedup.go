@@ -0,0 +1,184 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+// DuplicateUpdates counts redelivered updates per channel. It is published
+// through expvar, see /v1/debug/vars.
+var DuplicateUpdates = expvar.NewMap("channel_duplicate_updates")
+
+// updateTTL is how long an update id is remembered. Telegram stops redelivering
+// an update after 24 hours, WhatsApp much sooner.
+const updateTTL = 24 * time.Hour
+
+// Dedup remembers processed update ids in the messenger_updates table, so a
+// webhook retry is acknowledged without being answered twice, also across
+// restarts. A small in-memory map answers repeats without a round trip. The
+// table comes from migrations/0005_messenger_updates.sql.
+type Dedup struct {
+	Cfg  config.Config
+	HTTP *http.Client
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func NewDedup(cfg config.Config, httpClient *http.Client) *Dedup {
+	return &Dedup{Cfg: cfg, HTTP: httpClient, seen: map[string]time.Time{}}
+}
+
+// Seen records the update and reports whether it had been recorded before.
+// Storage errors are logged and the update is treated as new: answering twice
+// is better than not answering.
+func (d *Dedup) Seen(ctx context.Context, channelName, updateID string) bool {
+	if updateID == "" {
+		return false
+	}
+	key := channelName + ":" + updateID
+	now := time.Now()
+
+	d.mu.Lock()
+	if at, ok := d.seen[key]; ok && now.Sub(at) < updateTTL {
+		d.mu.Unlock()
+		DuplicateUpdates.Add(channelName, 1)
+		return true
+	}
+	d.seen[key] = now
+	d.mu.Unlock()
+
+	inserted, err := d.insert(ctx, channelName, updateID, now)
+	if err != nil {
+		log.Printf("%s: dedup insert failed update_id=%s err=%v", channelName, updateID, err)
+		return false
+	}
+	if !inserted {
+		DuplicateUpdates.Add(channelName, 1)
+		return true
+	}
+	return false
+}
+
+// Forget drops an update id again, for updates the webhook rejected and the
+// messenger will redeliver.
+func (d *Dedup) Forget(ctx context.Context, channelName, updateID string) error {
+	if updateID == "" {
+		return nil
+	}
+	d.mu.Lock()
+	delete(d.seen, channelName+":"+updateID)
+	d.mu.Unlock()
+
+	values := url.Values{}
+	values.Set("channel", "eq."+channelName)
+	values.Set("update_id", "eq."+updateID)
+	return d.delete(ctx, values)
+}
+
+// insert relies on the (channel, update_id) primary key: with
+// ignore-duplicates PostgREST returns an empty array for a known id.
+func (d *Dedup) insert(ctx context.Context, channelName, updateID string, at time.Time) (bool, error) {
+	row := map[string]interface{}{
+		"channel":     channelName,
+		"update_id":   updateID,
+		"received_at": at.UTC().Format(time.RFC3339),
+	}
+	body, _ := json.Marshal([]interface{}{row})
+
+	values := url.Values{}
+	values.Set("on_conflict", "channel,update_id")
+	urlStr := strings.TrimRight(d.Cfg.SupabaseURL, "/") + "/rest/v1/messenger_updates?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("apikey", d.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+d.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "resolution=ignore-duplicates,return=representation")
+
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var rows []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+// Prune drops ids older than the TTL from memory and from the table.
+func (d *Dedup) Prune(ctx context.Context) error {
+	cutoff := time.Now().Add(-updateTTL)
+
+	d.mu.Lock()
+	for key, at := range d.seen {
+		if at.Before(cutoff) {
+			delete(d.seen, key)
+		}
+	}
+	d.mu.Unlock()
+
+	values := url.Values{}
+	values.Set("received_at", "lt."+cutoff.UTC().Format(time.RFC3339))
+	return d.delete(ctx, values)
+}
+
+func (d *Dedup) delete(ctx context.Context, values url.Values) error {
+	urlStr := strings.TrimRight(d.Cfg.SupabaseURL, "/") + "/rest/v1/messenger_updates?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, urlStr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", d.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+d.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// RunPrune calls Prune every hour until ctx is cancelled.
+func (d *Dedup) RunPrune(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.Prune(ctx); err != nil {
+				log.Printf("dedup: prune failed: %v", err)
+			}
+		}
+	}
+}
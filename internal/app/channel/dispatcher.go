@@ -0,0 +1,251 @@
+package channel
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
+)
+
+// Dispatcher feeds updates from any Adapter through the debounce buffer into
+// chat.Service and sends the result back over the same adapter. All work runs
+// on the worker pool, webhook handlers only queue it.
+type Dispatcher struct {
+	Chat   *chat.Service
+	Buffer *Buffer
+	Pool   *Pool
+}
+
+func NewDispatcher(svc *chat.Service) *Dispatcher {
+	return &Dispatcher{Chat: svc, Buffer: NewBuffer(), Pool: NewPool(poolWorkers, poolQueueSize)}
+}
+
+// Receive queues the update on its session's worker and returns as soon as it
+// is queued. It returns ErrBusy when the queue stayed full until ctx was done;
+// webhook callers should then ask the messenger to redeliver.
+func (d *Dispatcher) Receive(ctx context.Context, a Adapter, u Update) error {
+	if err := d.Pool.Submit(ctx, u.SessionID, func() { d.handle(a, u) }); err != nil {
+		return err
+	}
+	go func() {
+		if err := a.SendTyping(context.Background(), u); err != nil {
+			log.Printf("%s: typing failed session_id=%s err=%v", a.Name(), u.SessionID, err)
+		}
+	}()
+	return nil
+}
+
+// Close answers every update already accepted. Intake stops first; the queued
+// updates are then handled without debouncing, each taking its session's
+// pending texts along; the batches left in the buffer are flushed last and the
+// pool drains once more.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.Pool.StopIntake()
+	d.Buffer.Close()
+	if err := d.Pool.Drain(ctx); err != nil {
+		return err
+	}
+	d.Buffer.FlushAll()
+	return d.Pool.Close(ctx)
+}
+
+func (d *Dispatcher) handle(a Adapter, u Update) {
+	ctx := context.Background()
+	onFlush := func(b Batch) { d.enqueue(a, b) }
+	switch {
+	case u.Action != "":
+		log.Printf("%s: action received session_id=%s action=%s", a.Name(), u.SessionID, u.Action)
+		if err := a.AckAction(ctx, u); err != nil {
+			log.Printf("%s: action ack failed session_id=%s err=%v", a.Name(), u.SessionID, err)
+		}
+		d.processAction(a, u)
+	case u.Contact != nil:
+		log.Printf("%s: contact received session_id=%s", a.Name(), u.SessionID)
+		d.processContact(a, u)
+	case strings.TrimSpace(u.Text) != "" && u.Media == nil:
+		log.Printf("%s: text received session_id=%s len=%d", a.Name(), u.SessionID, len(u.Text))
+		d.processNow(a, d.Buffer.AddText(u.SessionID, u.UserID, u.Text, onFlush))
+	case u.Media != nil:
+		log.Printf("%s: %s received session_id=%s file_id=%s name=%s mime=%s", a.Name(), u.Media.Kind, u.SessionID, u.Media.FileID, u.Media.FileName, u.Media.MimeType)
+		file, err := a.DownloadMedia(ctx, *u.Media)
+		if err != nil {
+			log.Printf("%s: download failed session_id=%s type=%s file_id=%s err=%v", a.Name(), u.SessionID, u.Media.Kind, u.Media.FileID, err)
+			d.sendText(ctx, a, u.SessionID, "Не удалось загрузить файл.")
+			return
+		}
+		now := d.Buffer.AddFile(u.SessionID, u.UserID, file, onFlush)
+		if caption := strings.TrimSpace(u.Text); caption != "" {
+			if len(now) > 0 {
+				last := &now[len(now)-1]
+				last.Texts = append(last.Texts, caption)
+			} else {
+				now = d.Buffer.AddText(u.SessionID, u.UserID, caption, onFlush)
+			}
+		}
+		d.processNow(a, now)
+	default:
+		log.Printf("%s: update ignored session_id=%s", a.Name(), u.SessionID)
+	}
+}
+
+// processNow handles the batches the buffer returns once it is closed; the
+// caller already runs on the session's worker.
+func (d *Dispatcher) processNow(a Adapter, batches []Batch) {
+	for _, b := range batches {
+		d.process(a, b)
+	}
+}
+
+// enqueue puts a flushed batch back on the pool, behind any update of the same
+// session that is still being handled.
+func (d *Dispatcher) enqueue(a Adapter, b Batch) {
+	err := d.Pool.Requeue(context.Background(), b.SessionID, func() { d.process(a, b) })
+	if err != nil {
+		log.Printf("%s: batch dropped session_id=%s err=%v", a.Name(), b.SessionID, err)
+	}
+}
+
+func (d *Dispatcher) process(a Adapter, b Batch) {
+	ctx := context.Background()
+	text := strings.TrimSpace(strings.Join(b.Texts, "\n"))
+	if b.File != nil {
+		res, err := d.Chat.ReplyMedia(ctx, chat.MediaRequest{
+			MessageType: b.File.Kind,
+			SessionID:   b.SessionID,
+			UserID:      b.UserID,
+			Filename:    b.File.Name,
+			ContentType: b.File.ContentType,
+			Data:        b.File.Data,
+			ExtraText:   text,
+		})
+		d.Deliver(ctx, a, b.SessionID, "result.pdf", res, err)
+		return
+	}
+	if text == "" {
+		return
+	}
+	res, err := d.Chat.Reply(ctx, chat.ChatRequest{
+		Message:   text,
+		SessionID: b.SessionID,
+		UserID:    optionalString(b.UserID),
+	})
+	d.Deliver(ctx, a, b.SessionID, "KP.pdf", res, err)
+}
+
+func (d *Dispatcher) processAction(a Adapter, u Update) {
+	ctx := context.Background()
+	res, err := d.Chat.Reply(ctx, chat.ChatRequest{
+		SessionID: u.SessionID,
+		UserID:    optionalString(u.UserID),
+		Action:    u.Action,
+	})
+	d.Deliver(ctx, a, u.SessionID, "KP.pdf", res, err)
+}
+
+// processContact passes a shared contact to chat.Service both as text, so the
+// callback and КП flows find the number, and as shared_contact meta; "own"
+// marks the sender's own number.
+func (d *Dispatcher) processContact(a Adapter, u Update) {
+	ctx := context.Background()
+	res, err := d.Chat.Reply(ctx, chat.ChatRequest{
+		Message:   strings.TrimSpace("Мой контакт: " + u.Contact.Name + " " + u.Contact.Phone),
+		SessionID: u.SessionID,
+		UserID:    optionalString(u.UserID),
+		UserMeta: map[string]interface{}{
+			"shared_contact": map[string]interface{}{"name": u.Contact.Name, "phone": u.Contact.Phone, "own": u.Contact.Own},
+		},
+	})
+	d.Deliver(ctx, a, u.SessionID, "KP.pdf", res, err)
+}
+
+// Deliver sends a chat result to the user: the PDF when there is one (with its
+// follow-up buttons), product cards followed by the text answer otherwise, or
+// a short apology when the pipeline failed.
+func (d *Dispatcher) Deliver(ctx context.Context, a Adapter, sessionID, pdfName string, res *chat.Result, err error) {
+	if err != nil {
+		log.Printf("%s: chat failed session_id=%s err=%v", a.Name(), sessionID, err)
+		d.sendText(ctx, a, sessionID, "Ошибка обработки запроса.")
+		return
+	}
+	if res.PDF != nil {
+		if pdfName == "" {
+			pdfName = res.PDFName
+		}
+		log.Printf("%s: sending pdf session_id=%s bytes=%d", a.Name(), sessionID, len(res.PDF))
+		if err := a.SendDocument(ctx, sessionID, pdfName, res.PDF); err != nil {
+			log.Printf("%s: send document failed session_id=%s err=%v", a.Name(), sessionID, err)
+			return
+		}
+		// Follow-up buttons, such as "Оформить заказ", go out under the document.
+		if answer := strings.TrimSpace(res.Response.Answer); answer != "" && len(res.Response.Actions) > 0 {
+			if err := a.SendButtons(ctx, sessionID, answer, buttonRows(res.Response.Actions)); err != nil {
+				log.Printf("%s: send buttons failed session_id=%s err=%v", a.Name(), sessionID, err)
+			}
+		}
+		return
+	}
+	if len(res.Cards) > 0 {
+		if err := a.SendCards(ctx, sessionID, productCards(res.Cards)); err != nil {
+			log.Printf("%s: send cards failed session_id=%s err=%v", a.Name(), sessionID, err)
+		}
+	}
+	answer := strings.TrimSpace(res.Response.Answer)
+	if answer == "" {
+		return
+	}
+	if res.Response.RequestContact {
+		if cr, ok := a.(ContactRequester); ok {
+			err := cr.SendContactRequest(ctx, sessionID, answer)
+			if err == nil {
+				return
+			}
+			log.Printf("%s: contact request failed session_id=%s err=%v", a.Name(), sessionID, err)
+		}
+	}
+	if len(res.Response.Actions) > 0 {
+		if err := a.SendButtons(ctx, sessionID, answer, buttonRows(res.Response.Actions)); err != nil {
+			log.Printf("%s: send buttons failed session_id=%s err=%v", a.Name(), sessionID, err)
+			d.sendText(ctx, a, sessionID, answer)
+		}
+		return
+	}
+	d.sendText(ctx, a, sessionID, answer)
+}
+
+func buttonRows(actions [][]chat.ChatAction) [][]Button {
+	rows := make([][]Button, 0, len(actions))
+	for _, row := range actions {
+		line := make([]Button, 0, len(row))
+		for _, act := range row {
+			line = append(line, Button{Text: act.Label, Data: act.Data})
+		}
+		rows = append(rows, line)
+	}
+	return rows
+}
+
+func productCards(cards []chat.ProductCard) []Card {
+	out := make([]Card, 0, len(cards))
+	for _, c := range cards {
+		out = append(out, Card{
+			ImageURL: c.ImageURL,
+			Caption:  c.Caption,
+			Buttons:  [][]Button{{{Text: "В КП", Data: chat.ActionQuoteAdd(c.ProductID)}}},
+		})
+	}
+	return out
+}
+
+func (d *Dispatcher) sendText(ctx context.Context, a Adapter, sessionID, text string) {
+	if err := a.SendText(ctx, sessionID, text); err != nil {
+		log.Printf("%s: send text failed session_id=%s err=%v", a.Name(), sessionID, err)
+	}
+}
+
+func optionalString(v string) *string {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	return &v
+}
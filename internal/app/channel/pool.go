@@ -0,0 +1,165 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"hash/fnv"
+	"sync"
+)
+
+var (
+	// ErrBusy is returned by Pool.Submit when the session's queue stayed full
+	// until the context was done.
+	ErrBusy = errors.New("channel: worker queue is full")
+	// ErrClosed is returned by Pool.Submit after Close.
+	ErrClosed = errors.New("channel: worker pool is closed")
+)
+
+// PoolStats exposes queue rejections through expvar.
+var PoolStats = expvar.NewMap("channel_pool")
+
+const (
+	poolWorkers   = 8
+	poolQueueSize = 64
+)
+
+// Pool runs jobs on a fixed set of workers. Jobs of one session always land on
+// the same worker, so a session's updates are handled in arrival order while
+// different sessions run in parallel.
+//
+// Shutdown has two steps: StopIntake rejects new updates while follow-up jobs
+// (debounced batches) are still accepted through Requeue, and Close stops
+// everything once the queues are drained.
+type Pool struct {
+	queues   []chan func()
+	quit     chan struct{}
+	quitOnce sync.Once
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool // no new updates
+	closed  bool // no jobs at all
+	pending int
+	idle    chan struct{} // closed while pending == 0
+}
+
+func NewPool(workers, queueSize int) *Pool {
+	p := &Pool{queues: make([]chan func(), workers), quit: make(chan struct{}), idle: make(chan struct{})}
+	close(p.idle)
+	for i := range p.queues {
+		q := make(chan func(), queueSize)
+		p.queues[i] = q
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for {
+				select {
+				case job := <-q:
+					job()
+					p.finish()
+				case <-p.quit:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// Submit queues job behind the earlier jobs of sessionID. It blocks while the
+// queue is full, which is the backpressure: callers that cannot wait pass a
+// context with a deadline and get ErrBusy. After StopIntake it returns
+// ErrClosed.
+func (p *Pool) Submit(ctx context.Context, sessionID string, job func()) error {
+	return p.submit(ctx, sessionID, job, false)
+}
+
+// Requeue is Submit for follow-up work of updates already accepted; it keeps
+// working after StopIntake until Close.
+func (p *Pool) Requeue(ctx context.Context, sessionID string, job func()) error {
+	return p.submit(ctx, sessionID, job, true)
+}
+
+// submit counts the job as pending before it waits for queue space, and waits
+// without holding the lock, so a full queue cannot stall StopIntake or Close.
+func (p *Pool) submit(ctx context.Context, sessionID string, job func(), followUp bool) error {
+	p.mu.Lock()
+	if p.closed || (p.stopped && !followUp) {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	if p.pending == 0 {
+		p.idle = make(chan struct{})
+	}
+	p.pending++
+	p.mu.Unlock()
+
+	select {
+	case p.queue(sessionID) <- job:
+		return nil
+	case <-ctx.Done():
+		p.finish()
+		PoolStats.Add("busy", 1)
+		return ErrBusy
+	case <-p.quit:
+		p.finish()
+		return ErrClosed
+	}
+}
+
+func (p *Pool) finish() {
+	p.mu.Lock()
+	p.pending--
+	if p.pending == 0 {
+		close(p.idle)
+	}
+	p.mu.Unlock()
+}
+
+// StopIntake makes Submit fail with ErrClosed; queued jobs keep running.
+func (p *Pool) StopIntake() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+}
+
+// Drain waits until no job is queued or running, or ctx expires. Jobs may
+// still arrive through Requeue afterwards.
+func (p *Pool) Drain(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		idle, pending := p.idle, p.pending
+		p.mu.Unlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Close stops accepting jobs, waits until the queued ones are done or ctx
+// expires, and stops the workers.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	p.stopped, p.closed = true, true
+	p.mu.Unlock()
+
+	err := p.Drain(ctx)
+	p.quitOnce.Do(func() { close(p.quit) })
+	if err != nil {
+		return err
+	}
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Pool) queue(sessionID string) chan func() {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return p.queues[h.Sum32()%uint32(len(p.queues))]
+}
@@ -0,0 +1,104 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolStopIntakeKeepsFollowUps(t *testing.T) {
+	p := NewPool(2, 4)
+	var ran atomic.Int32
+	release := make(chan struct{})
+	if err := p.Submit(context.Background(), "tg:1", func() {
+		<-release
+		// A follow-up queued by a running job after intake stopped.
+		if err := p.Requeue(context.Background(), "tg:1", func() { ran.Add(1) }); err != nil {
+			t.Errorf("Requeue during drain: %v", err)
+		}
+		ran.Add(1)
+	}); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+
+	p.StopIntake()
+	if err := p.Submit(context.Background(), "tg:2", func() {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Submit after StopIntake = %v, want ErrClosed", err)
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Drain(ctx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	if err := p.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if ran.Load() != 2 {
+		t.Fatalf("ran %d jobs, want 2", ran.Load())
+	}
+	if err := p.Requeue(context.Background(), "tg:1", func() {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Requeue after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestPoolBlockedSubmitDoesNotStallClose(t *testing.T) {
+	p := NewPool(1, 1)
+	release := make(chan struct{})
+	_ = p.Submit(context.Background(), "s", func() { <-release })
+	_ = p.Submit(context.Background(), "s", func() {}) // fills the queue
+
+	blocked := make(chan error, 1)
+	go func() { blocked <- p.Submit(context.Background(), "s", func() {}) }()
+	time.Sleep(20 * time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		p.StopIntake()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("StopIntake waited for a blocked Submit")
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := <-blocked; err != nil && !errors.Is(err, ErrClosed) {
+		t.Fatalf("blocked Submit = %v", err)
+	}
+}
+
+func TestBufferClosedReturnsPendingBatch(t *testing.T) {
+	b := NewBuffer()
+	flushed := make(chan Batch, 1)
+	onFlush := func(batch Batch) { flushed <- batch }
+
+	if now := b.AddText("tg:1", "1", "розетки", onFlush); now != nil {
+		t.Fatalf("AddText before Close returned %v", now)
+	}
+	b.Close()
+	now := b.AddText("tg:1", "1", "белые", onFlush)
+	if len(now) != 1 || len(now[0].Texts) != 2 || now[0].Texts[0] != "розетки" || now[0].Texts[1] != "белые" {
+		t.Fatalf("AddText after Close = %+v, want the pending text and the new one", now)
+	}
+
+	now = b.AddFile("tg:2", "2", File{Name: "a.pdf"}, onFlush)
+	if len(now) != 1 || now[0].File == nil || now[0].File.Name != "a.pdf" {
+		t.Fatalf("AddFile after Close = %+v", now)
+	}
+
+	select {
+	case batch := <-flushed:
+		t.Fatalf("onFlush called with %+v after Close", batch)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,465 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+type telegramUpdate struct {
+	UpdateID      int64                  `json:"update_id"`
+	Message       *telegramMessage       `json:"message,omitempty"`
+	CallbackQuery *telegramCallbackQuery `json:"callback_query,omitempty"`
+}
+
+type telegramCallbackQuery struct {
+	ID      string           `json:"id"`
+	From    telegramUser     `json:"from"`
+	Message *telegramMessage `json:"message,omitempty"`
+	Data    string           `json:"data,omitempty"`
+}
+
+type telegramMessage struct {
+	MessageID       int64             `json:"message_id"`
+	MessageThreadID int64             `json:"message_thread_id,omitempty"`
+	IsTopicMessage  bool              `json:"is_topic_message,omitempty"`
+	From            *telegramUser     `json:"from,omitempty"`
+	Chat            telegramChat      `json:"chat"`
+	ReplyToMessage  *telegramMessage  `json:"reply_to_message,omitempty"`
+	Text            string            `json:"text,omitempty"`
+	Entities        []telegramEntity  `json:"entities,omitempty"`
+	Caption         string            `json:"caption,omitempty"`
+	CaptionEntities []telegramEntity  `json:"caption_entities,omitempty"`
+	Voice           *telegramVoice    `json:"voice,omitempty"`
+	Photo           []telegramPhoto   `json:"photo,omitempty"`
+	Document        *telegramDocument `json:"document,omitempty"`
+	Contact         *telegramContact  `json:"contact,omitempty"`
+}
+
+type telegramUser struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
+type telegramChat struct {
+	ID      int64  `json:"id"`
+	Type    string `json:"type,omitempty"`
+	IsForum bool   `json:"is_forum,omitempty"`
+}
+
+type telegramEntity struct {
+	Type   string        `json:"type"`
+	Offset int           `json:"offset"`
+	Length int           `json:"length"`
+	User   *telegramUser `json:"user,omitempty"`
+}
+
+type telegramVoice struct {
+	FileID   string `json:"file_id"`
+	Duration int    `json:"duration,omitempty"`
+}
+
+type telegramPhoto struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+type telegramDocument struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+}
+
+type telegramContact struct {
+	PhoneNumber string `json:"phone_number"`
+	FirstName   string `json:"first_name,omitempty"`
+	LastName    string `json:"last_name,omitempty"`
+	UserID      int64  `json:"user_id,omitempty"`
+}
+
+type telegramGetFileResponse struct {
+	OK     bool `json:"ok"`
+	Result struct {
+		FilePath string `json:"file_path"`
+	} `json:"result"`
+}
+
+const telegramSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// Telegram talks to the Bot API. Sessions are "tg:<chat_id>", see
+// telegramSessionID for groups.
+type Telegram struct {
+	Cfg  config.Config
+	HTTP *http.Client
+
+	mu sync.Mutex
+	me *telegramUser
+}
+
+func NewTelegram(cfg config.Config, httpClient *http.Client) *Telegram {
+	return &Telegram{Cfg: cfg, HTTP: httpClient}
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+func (t *Telegram) Owns(sessionID string) bool { return strings.HasPrefix(sessionID, "tg:") }
+
+func (t *Telegram) ReceiveUpdates(r *http.Request) ([]Update, error) {
+	if !t.validSecret(r.Header.Get(telegramSecretHeader)) {
+		return nil, ErrUnauthorized
+	}
+	var upd telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+		return nil, err
+	}
+	if u, ok := t.convert(r.Context(), upd); ok {
+		return []Update{u}, nil
+	}
+	return nil, nil
+}
+
+// validSecret compares the header Telegram sends with every webhook call to the
+// secret_token registered via setWebhook. Without a configured secret every
+// update is rejected.
+func (t *Telegram) validSecret(got string) bool {
+	if t.Cfg.TelegramWebhookSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(t.Cfg.TelegramWebhookSecret)) == 1
+}
+
+// convert maps a Bot API update to an Update. In groups only messages that
+// mention the bot or reply to it are taken, everything else is team chatter.
+func (t *Telegram) convert(ctx context.Context, upd telegramUpdate) (Update, bool) {
+	if cb := upd.CallbackQuery; cb != nil {
+		if cb.Message == nil || cb.Data == "" {
+			return Update{}, false
+		}
+		sessionID := fmt.Sprintf("tg:%d", cb.Message.Chat.ID)
+		if isGroupChat(cb.Message.Chat) {
+			sessionID = t.groupSessionID(cb.Message, &cb.From)
+		}
+		return Update{
+			ID:         fmt.Sprintf("%d", upd.UpdateID),
+			SessionID:  sessionID,
+			UserID:     fmt.Sprintf("%d", cb.From.ID),
+			Action:     cb.Data,
+			CallbackID: cb.ID,
+			UserName:   cb.From.displayName(),
+		}, true
+	}
+	msg := upd.Message
+	if msg == nil {
+		return Update{}, false
+	}
+	u := Update{
+		ID:        fmt.Sprintf("%d", upd.UpdateID),
+		SessionID: fmt.Sprintf("tg:%d", msg.Chat.ID),
+		Text:      msg.Text,
+	}
+	if isGroupChat(msg.Chat) {
+		text, ok := t.addressed(ctx, msg)
+		if !ok {
+			return Update{}, false
+		}
+		u.SessionID = t.groupSessionID(msg, msg.From)
+		if msg.Text != "" {
+			u.Text = text
+		} else {
+			msg.Caption = text
+		}
+	}
+	if msg.From != nil {
+		u.UserID = fmt.Sprintf("%d", msg.From.ID)
+		u.UserName = msg.From.displayName()
+	}
+	if reply := msg.ReplyToMessage; reply != nil {
+		u.ReplyText = reply.Text
+		if u.ReplyText == "" {
+			u.ReplyText = reply.Caption
+		}
+	}
+	if c := msg.Contact; c != nil {
+		u.Contact = &Contact{
+			Phone: c.PhoneNumber,
+			Name:  strings.TrimSpace(c.FirstName + " " + c.LastName),
+			Own:   msg.From != nil && c.UserID != 0 && c.UserID == msg.From.ID,
+		}
+	}
+	switch {
+	case msg.Voice != nil:
+		u.Media = &Media{Kind: "voice", FileID: msg.Voice.FileID, FileName: "voice.ogg"}
+	case msg.Document != nil:
+		u.Media = &Media{Kind: "document", FileID: msg.Document.FileID, FileName: msg.Document.FileName, MimeType: msg.Document.MimeType}
+	case len(msg.Photo) > 0:
+		photo := msg.Photo[len(msg.Photo)-1]
+		u.Media = &Media{Kind: "photo", FileID: photo.FileID, FileName: "photo.jpg", MimeType: "image/jpeg"}
+	}
+	if u.Media != nil && u.Text == "" {
+		u.Text = msg.Caption
+	}
+	return u, true
+}
+
+func (t *Telegram) DownloadMedia(ctx context.Context, m Media) (File, error) {
+	base := strings.TrimRight(t.Cfg.TelegramBaseURL, "/")
+	getFileURL := fmt.Sprintf("%s/bot%s/getFile?file_id=%s", base, t.Cfg.TelegramBotToken, m.FileID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getFileURL, nil)
+	if err != nil {
+		return File{}, err
+	}
+	resp, err := t.HTTP.Do(req)
+	if err != nil {
+		return File{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return File{}, fmt.Errorf("telegram status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var out telegramGetFileResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return File{}, err
+	}
+	if !out.OK || out.Result.FilePath == "" {
+		return File{}, fmt.Errorf("telegram getFile empty")
+	}
+
+	fileURL := fmt.Sprintf("%s/file/bot%s/%s", base, t.Cfg.TelegramBotToken, out.Result.FilePath)
+	fileReq, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return File{}, err
+	}
+	fileResp, err := t.HTTP.Do(fileReq)
+	if err != nil {
+		return File{}, err
+	}
+	defer fileResp.Body.Close()
+
+	if fileResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(fileResp.Body, 2048))
+		return File{}, fmt.Errorf("telegram file status %d: %s", fileResp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	data, err := io.ReadAll(fileResp.Body)
+	if err != nil {
+		return File{}, err
+	}
+	name := m.FileName
+	if name == "" {
+		name = filepath.Base(out.Result.FilePath)
+	}
+	ct := m.MimeType
+	if ct == "" {
+		ct = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+	return File{Kind: m.Kind, Name: name, ContentType: ct, Data: data}, nil
+}
+
+func (t *Telegram) SendText(ctx context.Context, sessionID, text string) error {
+	if text == "" {
+		return nil
+	}
+	payload := target(sessionID)
+	payload["text"] = text
+	return t.call(ctx, "sendMessage", payload)
+}
+
+func (t *Telegram) SendButtons(ctx context.Context, sessionID, text string, rows [][]Button) error {
+	payload := target(sessionID)
+	payload["text"] = text
+	payload["reply_markup"] = inlineKeyboard(rows)
+	return t.call(ctx, "sendMessage", payload)
+}
+
+// SendContactRequest sends text with a one-time reply keyboard whose button
+// shares the user's phone number. Telegram allows it in private chats only.
+func (t *Telegram) SendContactRequest(ctx context.Context, sessionID, text string) error {
+	chatID, _ := parseTelegramSession(sessionID)
+	if strings.HasPrefix(chatID, "-") {
+		return errors.New("telegram: contact button is not available in groups")
+	}
+	payload := target(sessionID)
+	payload["text"] = text
+	payload["reply_markup"] = map[string]interface{}{
+		"keyboard":          [][]map[string]interface{}{{{"text": "Поделиться контактом", "request_contact": true}}},
+		"one_time_keyboard": true,
+		"resize_keyboard":   true,
+	}
+	return t.call(ctx, "sendMessage", payload)
+}
+
+// telegramCaptionLimit is the Bot API limit for photo captions.
+const telegramCaptionLimit = 1024
+
+// SendCards sends one sendPhoto per card. sendMediaGroup cannot carry inline
+// keyboards, and every card has its own "В КП" button, so albums are not used.
+// A card whose photo Telegram rejects is sent again as text.
+func (t *Telegram) SendCards(ctx context.Context, sessionID string, cards []Card) error {
+	for _, c := range cards {
+		if c.ImageURL != "" {
+			caption := c.Caption
+			if runes := []rune(caption); len(runes) > telegramCaptionLimit {
+				caption = string(runes[:telegramCaptionLimit-1]) + "…"
+			}
+			payload := target(sessionID)
+			payload["photo"] = c.ImageURL
+			payload["caption"] = caption
+			if len(c.Buttons) > 0 {
+				payload["reply_markup"] = inlineKeyboard(c.Buttons)
+			}
+			err := t.call(ctx, "sendPhoto", payload)
+			if err == nil {
+				continue
+			}
+			log.Printf("telegram: sendPhoto failed session_id=%s url=%s err=%v", sessionID, c.ImageURL, err)
+		}
+		var err error
+		if len(c.Buttons) > 0 {
+			err = t.SendButtons(ctx, sessionID, c.Caption, c.Buttons)
+		} else {
+			err = t.SendText(ctx, sessionID, c.Caption)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inlineKeyboard(rows [][]Button) map[string]interface{} {
+	keyboard := make([][]map[string]string, 0, len(rows))
+	for _, row := range rows {
+		line := make([]map[string]string, 0, len(row))
+		for _, b := range row {
+			line = append(line, map[string]string{"text": b.Text, "callback_data": b.Data})
+		}
+		keyboard = append(keyboard, line)
+	}
+	return map[string]interface{}{"inline_keyboard": keyboard}
+}
+
+// AckAction answers the callback query so the client stops showing the
+// loading spinner on the pressed button.
+func (t *Telegram) AckAction(ctx context.Context, u Update) error {
+	if u.CallbackID == "" {
+		return nil
+	}
+	return t.call(ctx, "answerCallbackQuery", map[string]interface{}{
+		"callback_query_id": u.CallbackID,
+	})
+}
+
+func (t *Telegram) SendTyping(ctx context.Context, u Update) error {
+	payload := target(u.SessionID)
+	payload["action"] = "typing"
+	return t.call(ctx, "sendChatAction", payload)
+}
+
+func (t *Telegram) SendDocument(ctx context.Context, sessionID, filename string, data []byte) error {
+	base := strings.TrimRight(t.Cfg.TelegramBaseURL, "/")
+	urlStr := fmt.Sprintf("%s/bot%s/sendDocument", base, t.Cfg.TelegramBotToken)
+	chatID, threadID := parseTelegramSession(sessionID)
+	body, contentType := buildTelegramDocumentMultipart(chatID, threadID, filename, "application/pdf", data)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := t.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("telegram sendDocument status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (t *Telegram) call(ctx context.Context, method string, payload map[string]interface{}) error {
+	return t.callResult(ctx, method, payload, nil)
+}
+
+// callResult posts a Bot API method and decodes its "result" into out when out
+// is not nil.
+func (t *Telegram) callResult(ctx context.Context, method string, payload map[string]interface{}, out interface{}) error {
+	base := strings.TrimRight(t.Cfg.TelegramBaseURL, "/")
+	urlStr := fmt.Sprintf("%s/bot%s/%s", base, t.Cfg.TelegramBotToken, method)
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("telegram %s status %d: %s", method, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return err
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+func buildTelegramDocumentMultipart(chatID string, threadID int64, filename, contentType string, data []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if chatID != "" {
+		_ = writer.WriteField("chat_id", chatID)
+	}
+	if threadID != 0 {
+		_ = writer.WriteField("message_thread_id", strconv.FormatInt(threadID, 10))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="document"; filename="%s"`, filename))
+	header.Set("Content-Type", contentType)
+	part, _ := writer.CreatePart(header)
+	_, _ = part.Write(data)
+	_ = writer.Close()
+	return body, writer.FormDataContentType()
+}
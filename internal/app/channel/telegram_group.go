@@ -0,0 +1,156 @@
+package channel
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Group sessions are "tg:<chat_id>:t<thread_id>" for forum topics and get a
+// ":u<user_id>" suffix when TELEGRAM_GROUP_SESSION=user, so that every member
+// of a team chat has a conversation of their own. Private chats stay
+// "tg:<chat_id>".
+func telegramSessionID(chatID, threadID, userID int64) string {
+	sid := "tg:" + strconv.FormatInt(chatID, 10)
+	if threadID != 0 {
+		sid += ":t" + strconv.FormatInt(threadID, 10)
+	}
+	if userID != 0 {
+		sid += ":u" + strconv.FormatInt(userID, 10)
+	}
+	return sid
+}
+
+// parseTelegramSession returns the chat and forum topic a session replies to.
+func parseTelegramSession(sessionID string) (chatID string, threadID int64) {
+	parts := strings.Split(strings.TrimPrefix(sessionID, "tg:"), ":")
+	chatID = parts[0]
+	for _, p := range parts[1:] {
+		if strings.HasPrefix(p, "t") {
+			threadID, _ = strconv.ParseInt(p[1:], 10, 64)
+		}
+	}
+	return chatID, threadID
+}
+
+// TelegramChat returns the chat id of a Telegram session.
+func TelegramChat(sessionID string) string {
+	chatID, _ := parseTelegramSession(sessionID)
+	return chatID
+}
+
+func (u telegramUser) displayName() string {
+	if u.Username != "" {
+		return "@" + u.Username
+	}
+	return u.FirstName
+}
+
+// target is the start of every outgoing payload: the chat plus the topic the
+// conversation lives in.
+func target(sessionID string) map[string]interface{} {
+	chatID, threadID := parseTelegramSession(sessionID)
+	payload := map[string]interface{}{"chat_id": chatID}
+	if threadID != 0 {
+		payload["message_thread_id"] = threadID
+	}
+	return payload
+}
+
+func isGroupChat(c telegramChat) bool {
+	return c.Type == "group" || c.Type == "supergroup"
+}
+
+// groupSessionID keys a group conversation by chat and topic, and by member
+// when configured.
+func (t *Telegram) groupSessionID(msg *telegramMessage, from *telegramUser) string {
+	var threadID, userID int64
+	if msg.IsTopicMessage {
+		threadID = msg.MessageThreadID
+	}
+	if t.Cfg.TelegramGroupSession == "user" && from != nil {
+		userID = from.ID
+	}
+	return telegramSessionID(msg.Chat.ID, threadID, userID)
+}
+
+// addressed reports whether a group message is meant for the bot: it mentions
+// the bot, replies to one of its messages or is a command. The mention is cut
+// from the text.
+func (t *Telegram) addressed(ctx context.Context, msg *telegramMessage) (string, bool) {
+	me, err := t.botUser(ctx)
+	if err != nil {
+		log.Printf("telegram: getMe failed, group message dropped chat_id=%d message_id=%d err=%v", msg.Chat.ID, msg.MessageID, err)
+		return "", false
+	}
+	text, entities := msg.Text, msg.Entities
+	if text == "" {
+		text, entities = msg.Caption, msg.CaptionEntities
+	}
+	if reply := msg.ReplyToMessage; reply != nil && reply.From != nil && reply.From.ID == me.ID {
+		return text, true
+	}
+	// Entity offsets count UTF-16 code units.
+	units := utf16.Encode([]rune(text))
+	for _, e := range entities {
+		if e.Offset < 0 || e.Offset+e.Length > len(units) {
+			continue
+		}
+		mention := string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+		switch {
+		case e.Type == "bot_command":
+			cmd, at, found := strings.Cut(mention, "@")
+			if found && !strings.EqualFold(at, me.Username) {
+				continue
+			}
+			rest := string(utf16.Decode(units[:e.Offset])) + cmd + string(utf16.Decode(units[e.Offset+e.Length:]))
+			return strings.TrimSpace(rest), true
+		case e.Type == "mention" && strings.EqualFold(mention, "@"+me.Username):
+		case e.Type == "text_mention" && e.User != nil && e.User.ID == me.ID:
+		default:
+			continue
+		}
+		rest := string(utf16.Decode(units[:e.Offset])) + string(utf16.Decode(units[e.Offset+e.Length:]))
+		return strings.TrimSpace(rest), true
+	}
+	return "", false
+}
+
+const getMeAttempts = 3
+
+// getMeRetryDelay grows linearly between getMe attempts.
+var getMeRetryDelay = 500 * time.Millisecond
+
+// botUser returns the bot's own account. Only a successful getMe is kept: a
+// failed one is retried here, and again by the next group message.
+func (t *Telegram) botUser(ctx context.Context) (telegramUser, error) {
+	t.mu.Lock()
+	if t.me != nil {
+		me := *t.me
+		t.mu.Unlock()
+		return me, nil
+	}
+	t.mu.Unlock()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var me telegramUser
+		if err = t.callResult(ctx, "getMe", map[string]interface{}{}, &me); err == nil {
+			t.mu.Lock()
+			t.me = &me
+			t.mu.Unlock()
+			return me, nil
+		}
+		if attempt == getMeAttempts {
+			return telegramUser{}, err
+		}
+		select {
+		case <-ctx.Done():
+			return telegramUser{}, err
+		case <-time.After(time.Duration(attempt) * getMeRetryDelay):
+		}
+	}
+}
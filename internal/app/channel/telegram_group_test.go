@@ -0,0 +1,55 @@
+package channel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+func TestAddressedRetriesGetMe(t *testing.T) {
+	defer func(d time.Duration) { getMeRetryDelay = d }(getMeRetryDelay)
+	getMeRetryDelay = time.Millisecond
+
+	var calls, failures atomic.Int32
+	failures.Store(getMeAttempts + 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failures.Add(-1) >= 0 {
+			http.Error(w, `{"ok":false,"description":"Bad Gateway"}`, http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"id":99,"username":"iqhome_bot"}}`))
+	}))
+	defer srv.Close()
+	tg := NewTelegram(config.Config{TelegramBotToken: "test-token", TelegramBaseURL: srv.URL}, srv.Client())
+
+	msg := &telegramMessage{
+		MessageID: 1,
+		Chat:      telegramChat{ID: -100, Type: "supergroup"},
+		Text:      "@iqhome_bot есть рамки FD?",
+		Entities:  []telegramEntity{{Type: "mention", Offset: 0, Length: 11}},
+	}
+	if _, ok := tg.addressed(context.Background(), msg); ok {
+		t.Fatal("message addressed while getMe fails")
+	}
+	if got := calls.Load(); got != getMeAttempts {
+		t.Fatalf("getMe called %d times, want %d", got, getMeAttempts)
+	}
+
+	// The failure is not cached: the next message retries and gets through.
+	text, ok := tg.addressed(context.Background(), msg)
+	if !ok || text != "есть рамки FD?" {
+		t.Fatalf("addressed = %q, %t; want the text without the mention", text, ok)
+	}
+	if _, ok := tg.addressed(context.Background(), msg); !ok {
+		t.Fatal("second message not addressed")
+	}
+	if got := calls.Load(); got != getMeAttempts+2 {
+		t.Errorf("getMe called %d times, want the success cached", got)
+	}
+}
@@ -0,0 +1,106 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OffsetStore keeps the next getUpdates offset between restarts.
+type OffsetStore interface {
+	Load() (int64, error)
+	Save(offset int64) error
+}
+
+// FileOffsetStore persists the offset as a plain number in a local file, which
+// is all a development machine needs.
+type FileOffsetStore struct {
+	Path string
+}
+
+func (s FileOffsetStore) Load() (int64, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s FileOffsetStore) Save(offset int64) error {
+	tmp := s.Path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+const telegramPollTimeout = 30 * time.Second
+
+// Poll runs getUpdates long polling until ctx is cancelled and passes every
+// update to handle, the same way the webhook does. Any registered webhook is
+// removed first because Telegram refuses getUpdates while one is set. On
+// cancellation the rest of a batch is left unconfirmed, so the next start
+// receives it again.
+func (t *Telegram) Poll(ctx context.Context, store OffsetStore, handle func(Update)) error {
+	if err := t.DeleteWebhook(ctx, false); err != nil {
+		log.Printf("telegram poll: deleteWebhook failed: %v", err)
+	}
+	offset, err := store.Load()
+	if err != nil {
+		log.Printf("telegram poll: offset load failed: %v", err)
+	}
+	poller := &Telegram{Cfg: t.Cfg, HTTP: &http.Client{Timeout: telegramPollTimeout + 10*time.Second}}
+	if t.HTTP != nil {
+		poller.HTTP.Transport = t.HTTP.Transport
+	}
+	log.Printf("telegram poll: started offset=%d", offset)
+
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var updates []telegramUpdate
+		err := poller.callResult(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         int(telegramPollTimeout / time.Second),
+			"allowed_updates": DefaultAllowedUpdates,
+		}, &updates)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("telegram poll: getUpdates failed: %v", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(3 * time.Second):
+			}
+			continue
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		for _, upd := range updates {
+			if ctx.Err() != nil {
+				break
+			}
+			if u, ok := t.convert(ctx, upd); ok {
+				handle(u)
+			}
+			if upd.UpdateID >= offset {
+				offset = upd.UpdateID + 1
+			}
+		}
+		if err := store.Save(offset); err != nil {
+			log.Printf("telegram poll: offset save failed offset=%d err=%v", offset, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+func TestFileOffsetStore(t *testing.T) {
+	store := FileOffsetStore{Path: filepath.Join(t.TempDir(), "offset")}
+	offset, err := store.Load()
+	if err != nil || offset != 0 {
+		t.Fatalf("Load of a missing file = %d, %v; want 0, nil", offset, err)
+	}
+	if err := store.Save(42); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := store.Save(43); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	offset, err = store.Load()
+	if err != nil || offset != 43 {
+		t.Fatalf("Load = %d, %v; want 43, nil", offset, err)
+	}
+}
+
+// fakeBotAPI serves getUpdates from a fixed backlog: every call returns the
+// updates at or after the requested offset, like Telegram does for confirmed
+// offsets.
+type fakeBotAPI struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	backlog []telegramUpdate
+	offsets []int64
+}
+
+func newFakeBotAPI(t *testing.T, backlog []telegramUpdate) *fakeBotAPI {
+	f := &fakeBotAPI{backlog: backlog}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bottest-token/deleteWebhook", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	})
+	mux.HandleFunc("/bottest-token/getUpdates", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Offset int64 `json:"offset"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		f.mu.Lock()
+		f.offsets = append(f.offsets, req.Offset)
+		var out []telegramUpdate
+		for _, u := range f.backlog {
+			if u.UpdateID >= req.Offset {
+				out = append(out, u)
+			}
+		}
+		f.mu.Unlock()
+		if len(out) == 0 {
+			// Long poll with nothing new: hold the request briefly.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": out})
+	})
+	f.srv = httptest.NewServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeBotAPI) telegram() *Telegram {
+	return NewTelegram(config.Config{TelegramBotToken: "test-token", TelegramBaseURL: f.srv.URL}, f.srv.Client())
+}
+
+func (f *fakeBotAPI) firstOffset() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.offsets) == 0 {
+		return -1
+	}
+	return f.offsets[0]
+}
+
+func privateText(id int64, text string) telegramUpdate {
+	return telegramUpdate{UpdateID: id, Message: &telegramMessage{
+		MessageID: id,
+		From:      &telegramUser{ID: 7, FirstName: "Айгуль"},
+		Chat:      telegramChat{ID: 7, Type: "private"},
+		Text:      text,
+	}}
+}
+
+// pollUntil runs Poll until want updates were handled and returns them.
+func pollUntil(t *testing.T, tg *Telegram, store OffsetStore, want int) []Update {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got []Update
+	done := make(chan error, 1)
+	go func() {
+		done <- tg.Poll(ctx, store, func(u Update) {
+			got = append(got, u)
+			if len(got) == want {
+				cancel()
+			}
+		})
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Poll returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Poll did not stop after cancel")
+	}
+	return got
+}
+
+func TestPollPersistsOffset(t *testing.T) {
+	store := FileOffsetStore{Path: filepath.Join(t.TempDir(), "offset")}
+	api := newFakeBotAPI(t, []telegramUpdate{privateText(10, "привет"), privateText(11, "нужна розетка")})
+
+	got := pollUntil(t, api.telegram(), store, 2)
+	if len(got) != 2 || got[0].ID != "10" || got[1].Text != "нужна розетка" || got[1].SessionID != "tg:7" {
+		t.Fatalf("handled updates = %+v", got)
+	}
+	offset, err := store.Load()
+	if err != nil || offset != 12 {
+		t.Fatalf("stored offset = %d, %v; want 12", offset, err)
+	}
+
+	// A restart resumes after the confirmed updates.
+	restarted := newFakeBotAPI(t, []telegramUpdate{privateText(11, "нужна розетка"), privateText(12, "ещё вопрос")})
+	got = pollUntil(t, restarted.telegram(), store, 1)
+	if restarted.firstOffset() != 12 {
+		t.Fatalf("first getUpdates offset after restart = %d, want 12", restarted.firstOffset())
+	}
+	if len(got) != 1 || got[0].ID != "12" {
+		t.Fatalf("handled after restart = %+v", got)
+	}
+}
+
+func TestPollLeavesRestOfBatchOnCancel(t *testing.T) {
+	store := FileOffsetStore{Path: filepath.Join(t.TempDir(), "offset")}
+	api := newFakeBotAPI(t, []telegramUpdate{privateText(20, "a"), privateText(21, "b"), privateText(22, "c")})
+
+	got := pollUntil(t, api.telegram(), store, 1)
+	if len(got) != 1 {
+		t.Fatalf("handled %d updates after cancel, want 1", len(got))
+	}
+	offset, err := store.Load()
+	if err != nil || offset != 21 {
+		t.Fatalf("stored offset = %d, %v; want 21 so 21 and 22 are redelivered", offset, err)
+	}
+}
+
+func TestConvertMarksOwnContact(t *testing.T) {
+	tg := NewTelegram(config.Config{TelegramBotToken: "test-token"}, http.DefaultClient)
+	tests := []struct {
+		name    string
+		contact telegramContact
+		own     bool
+	}{
+		{"contact button", telegramContact{PhoneNumber: "+77011234567", UserID: 7}, true},
+		{"someone else's card", telegramContact{PhoneNumber: "+77017654321", UserID: 8}, false},
+		{"card without user", telegramContact{PhoneNumber: "+77017654321"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upd := privateText(30, "")
+			c := tt.contact
+			upd.Message.Contact = &c
+			u, ok := tg.convert(context.Background(), upd)
+			if !ok || u.Contact == nil {
+				t.Fatalf("convert = %+v, %v", u, ok)
+			}
+			if u.Contact.Own != tt.own || u.Contact.Phone != tt.contact.PhoneNumber {
+				t.Fatalf("contact = %+v, want own=%v", u.Contact, tt.own)
+			}
+		})
+	}
+}
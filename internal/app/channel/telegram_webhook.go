@@ -0,0 +1,66 @@
+package channel
+
+import (
+	"context"
+	"fmt"
+)
+
+// WebhookOptions are the setWebhook parameters we manage from code.
+type WebhookOptions struct {
+	URL                string
+	AllowedUpdates     []string
+	MaxConnections     int
+	DropPendingUpdates bool
+}
+
+type WebhookInfo struct {
+	URL                  string   `json:"url"`
+	HasCustomCertificate bool     `json:"has_custom_certificate"`
+	PendingUpdateCount   int      `json:"pending_update_count"`
+	IPAddress            string   `json:"ip_address,omitempty"`
+	LastErrorDate        int64    `json:"last_error_date,omitempty"`
+	LastErrorMessage     string   `json:"last_error_message,omitempty"`
+	LastSyncErrorDate    int64    `json:"last_synchronization_error_date,omitempty"`
+	MaxConnections       int      `json:"max_connections,omitempty"`
+	AllowedUpdates       []string `json:"allowed_updates,omitempty"`
+}
+
+// DefaultAllowedUpdates lists the update types the bot handles.
+var DefaultAllowedUpdates = []string{"message", "callback_query"}
+
+// SetWebhook registers the webhook URL together with the configured secret so
+// that Telegram sends X-Telegram-Bot-Api-Secret-Token on every call.
+func (t *Telegram) SetWebhook(ctx context.Context, opts WebhookOptions) error {
+	if opts.URL == "" {
+		return fmt.Errorf("telegram setWebhook: url is required")
+	}
+	if t.Cfg.TelegramWebhookSecret == "" {
+		return fmt.Errorf("telegram setWebhook: TELEGRAM_WEBHOOK_SECRET is not set")
+	}
+	allowed := opts.AllowedUpdates
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedUpdates
+	}
+	payload := map[string]interface{}{
+		"url":                  opts.URL,
+		"secret_token":         t.Cfg.TelegramWebhookSecret,
+		"allowed_updates":      allowed,
+		"drop_pending_updates": opts.DropPendingUpdates,
+	}
+	if opts.MaxConnections > 0 {
+		payload["max_connections"] = opts.MaxConnections
+	}
+	var ok bool
+	return t.callResult(ctx, "setWebhook", payload, &ok)
+}
+
+func (t *Telegram) DeleteWebhook(ctx context.Context, dropPending bool) error {
+	var ok bool
+	return t.callResult(ctx, "deleteWebhook", map[string]interface{}{"drop_pending_updates": dropPending}, &ok)
+}
+
+func (t *Telegram) GetWebhookInfo(ctx context.Context) (WebhookInfo, error) {
+	var info WebhookInfo
+	err := t.callResult(ctx, "getWebhookInfo", map[string]interface{}{}, &info)
+	return info, err
+}
@@ -0,0 +1,426 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+type whatsappWebhook struct {
+	Object string          `json:"object"`
+	Entry  []whatsappEntry `json:"entry"`
+}
+
+type whatsappEntry struct {
+	ID      string           `json:"id"`
+	Changes []whatsappChange `json:"changes"`
+}
+
+type whatsappChange struct {
+	Field string        `json:"field"`
+	Value whatsappValue `json:"value"`
+}
+
+type whatsappValue struct {
+	MessagingProduct string            `json:"messaging_product"`
+	Messages         []whatsappMessage `json:"messages,omitempty"`
+}
+
+type whatsappMessage struct {
+	ID          string               `json:"id"`
+	From        string               `json:"from"`
+	Timestamp   string               `json:"timestamp"`
+	Type        string               `json:"type"`
+	Text        *whatsappText        `json:"text,omitempty"`
+	Audio       *whatsappMedia       `json:"audio,omitempty"`
+	Image       *whatsappMedia       `json:"image,omitempty"`
+	Document    *whatsappMedia       `json:"document,omitempty"`
+	Interactive *whatsappInteractive `json:"interactive,omitempty"`
+}
+
+type whatsappInteractive struct {
+	Type        string `json:"type"`
+	ButtonReply *struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"button_reply,omitempty"`
+}
+
+type whatsappText struct {
+	Body string `json:"body"`
+}
+
+type whatsappMedia struct {
+	ID       string `json:"id"`
+	MimeType string `json:"mime_type,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+	Voice    bool   `json:"voice,omitempty"`
+}
+
+type whatsappMediaInfo struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+}
+
+// WhatsApp talks to the Cloud API. Sessions are "wa:<wa_id>".
+type WhatsApp struct {
+	Cfg  config.Config
+	HTTP *http.Client
+}
+
+func NewWhatsApp(cfg config.Config, httpClient *http.Client) *WhatsApp {
+	return &WhatsApp{Cfg: cfg, HTTP: httpClient}
+}
+
+func (a *WhatsApp) Name() string { return "whatsapp" }
+
+func (a *WhatsApp) Owns(sessionID string) bool { return strings.HasPrefix(sessionID, "wa:") }
+
+// Verify answers the subscription handshake Meta performs when the webhook URL
+// is configured.
+func (a *WhatsApp) Verify(r *http.Request) (string, bool) {
+	q := r.URL.Query()
+	if q.Get("hub.mode") != "subscribe" || a.Cfg.WhatsAppVerifyToken == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(q.Get("hub.verify_token")), []byte(a.Cfg.WhatsAppVerifyToken)) {
+		return "", false
+	}
+	return q.Get("hub.challenge"), true
+}
+
+func (a *WhatsApp) ReceiveUpdates(r *http.Request) ([]Update, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if !validWhatsAppSignature(a.Cfg.WhatsAppAppSecret, r.Header.Get("X-Hub-Signature-256"), body) {
+		return nil, ErrUnauthorized
+	}
+
+	var payload whatsappWebhook
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	var out []Update
+	for _, entry := range payload.Entry {
+		for _, change := range entry.Changes {
+			for _, msg := range change.Value.Messages {
+				if msg.From == "" {
+					continue
+				}
+				out = append(out, convertWhatsAppMessage(msg))
+			}
+		}
+	}
+	return out, nil
+}
+
+func convertWhatsAppMessage(msg whatsappMessage) Update {
+	u := Update{
+		ID:        msg.ID,
+		SessionID: "wa:" + msg.From,
+		UserID:    msg.From,
+	}
+	if msg.Text != nil {
+		u.Text = msg.Text.Body
+	}
+	if msg.Interactive != nil && msg.Interactive.ButtonReply != nil {
+		u.Action = msg.Interactive.ButtonReply.ID
+		return u
+	}
+	var m *whatsappMedia
+	switch {
+	case msg.Audio != nil:
+		m = msg.Audio
+		u.Media = &Media{Kind: "voice", FileName: "voice.ogg"}
+	case msg.Document != nil:
+		m = msg.Document
+		u.Media = &Media{Kind: "document", FileName: msg.Document.Filename}
+	case msg.Image != nil:
+		m = msg.Image
+		u.Media = &Media{Kind: "photo", FileName: "photo.jpg"}
+	}
+	if m != nil {
+		u.Media.FileID = m.ID
+		u.Media.MimeType = m.MimeType
+		u.Text = m.Caption
+	}
+	return u
+}
+
+// validWhatsAppSignature checks X-Hub-Signature-256, the HMAC of the body
+// keyed with the app secret. Without a configured secret every update is
+// rejected.
+func validWhatsAppSignature(secret, header string, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	sig := strings.TrimPrefix(strings.TrimSpace(header), "sha256=")
+	got, err := hex.DecodeString(sig)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func (a *WhatsApp) DownloadMedia(ctx context.Context, m Media) (File, error) {
+	base := strings.TrimRight(a.Cfg.WhatsAppBaseURL, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/"+m.FileID, nil)
+	if err != nil {
+		return File{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Cfg.WhatsAppToken)
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return File{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return File{}, fmt.Errorf("whatsapp status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var info whatsappMediaInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return File{}, err
+	}
+	if info.URL == "" {
+		return File{}, fmt.Errorf("whatsapp media url empty")
+	}
+
+	fileReq, err := http.NewRequestWithContext(ctx, http.MethodGet, info.URL, nil)
+	if err != nil {
+		return File{}, err
+	}
+	fileReq.Header.Set("Authorization", "Bearer "+a.Cfg.WhatsAppToken)
+	fileResp, err := a.HTTP.Do(fileReq)
+	if err != nil {
+		return File{}, err
+	}
+	defer fileResp.Body.Close()
+
+	if fileResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(fileResp.Body, 2048))
+		return File{}, fmt.Errorf("whatsapp file status %d: %s", fileResp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	data, err := io.ReadAll(fileResp.Body)
+	if err != nil {
+		return File{}, err
+	}
+	ct := m.MimeType
+	if ct == "" {
+		ct = info.MimeType
+	}
+	name := m.FileName
+	if name == "" {
+		name = "file"
+		if exts, _ := mime.ExtensionsByType(ct); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	if ct == "" {
+		ct = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+	}
+	if ct == "" {
+		ct = http.DetectContentType(data)
+	}
+	return File{Kind: m.Kind, Name: name, ContentType: ct, Data: data}, nil
+}
+
+func (a *WhatsApp) SendText(ctx context.Context, sessionID, text string) error {
+	if text == "" {
+		return nil
+	}
+	return a.postMessage(ctx, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                whatsappRecipient(sessionID),
+		"type":              "text",
+		"text":              map[string]interface{}{"body": text},
+	})
+}
+
+// SendButtons uses interactive reply buttons. The Cloud API allows at most
+// three buttons with 20-character titles, so extra buttons are dropped.
+func (a *WhatsApp) SendButtons(ctx context.Context, sessionID, text string, rows [][]Button) error {
+	var buttons []map[string]interface{}
+	for _, row := range rows {
+		for _, b := range row {
+			if len(buttons) == 3 {
+				break
+			}
+			title := []rune(b.Text)
+			if len(title) > 20 {
+				title = title[:20]
+			}
+			buttons = append(buttons, map[string]interface{}{
+				"type":  "reply",
+				"reply": map[string]string{"id": b.Data, "title": string(title)},
+			})
+		}
+	}
+	if len(buttons) == 0 {
+		return a.SendText(ctx, sessionID, text)
+	}
+	return a.postMessage(ctx, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                whatsappRecipient(sessionID),
+		"type":              "interactive",
+		"interactive": map[string]interface{}{
+			"type":   "button",
+			"body":   map[string]string{"text": text},
+			"action": map[string]interface{}{"buttons": buttons},
+		},
+	})
+}
+
+// SendCards sends an image message per card. Image captions cannot carry reply
+// buttons, so the card buttons are sent as a short interactive message after
+// the photo.
+func (a *WhatsApp) SendCards(ctx context.Context, sessionID string, cards []Card) error {
+	for _, c := range cards {
+		if c.ImageURL == "" {
+			if err := a.SendButtons(ctx, sessionID, c.Caption, c.Buttons); err != nil {
+				return err
+			}
+			continue
+		}
+		err := a.postMessage(ctx, map[string]interface{}{
+			"messaging_product": "whatsapp",
+			"to":                whatsappRecipient(sessionID),
+			"type":              "image",
+			"image":             map[string]interface{}{"link": c.ImageURL, "caption": c.Caption},
+		})
+		if err != nil {
+			return err
+		}
+		if len(c.Buttons) > 0 {
+			if err := a.SendButtons(ctx, sessionID, firstLine(c.Caption), c.Buttons); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// AckAction is a no-op: reply buttons need no acknowledgement in the Cloud API.
+func (a *WhatsApp) AckAction(ctx context.Context, u Update) error { return nil }
+
+// SendTyping marks the inbound message as read and shows the typing indicator.
+func (a *WhatsApp) SendTyping(ctx context.Context, u Update) error {
+	if u.ID == "" {
+		return nil
+	}
+	return a.postMessage(ctx, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"status":            "read",
+		"message_id":        u.ID,
+		"typing_indicator":  map[string]interface{}{"type": "text"},
+	})
+}
+
+func (a *WhatsApp) SendDocument(ctx context.Context, sessionID, filename string, data []byte) error {
+	mediaID, err := a.uploadMedia(ctx, filename, "application/pdf", data)
+	if err != nil {
+		return err
+	}
+	return a.postMessage(ctx, map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                whatsappRecipient(sessionID),
+		"type":              "document",
+		"document":          map[string]interface{}{"id": mediaID, "filename": filename},
+	})
+}
+
+func (a *WhatsApp) postMessage(ctx context.Context, payload map[string]interface{}) error {
+	base := strings.TrimRight(a.Cfg.WhatsAppBaseURL, "/")
+	urlStr := fmt.Sprintf("%s/%s/messages", base, a.Cfg.WhatsAppPhoneNumberID)
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.Cfg.WhatsAppToken)
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("whatsapp messages status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (a *WhatsApp) uploadMedia(ctx context.Context, filename, contentType string, data []byte) (string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("messaging_product", "whatsapp")
+	_ = writer.WriteField("type", contentType)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+	header.Set("Content-Type", contentType)
+	part, _ := writer.CreatePart(header)
+	_, _ = part.Write(data)
+	_ = writer.Close()
+
+	base := strings.TrimRight(a.Cfg.WhatsAppBaseURL, "/")
+	urlStr := fmt.Sprintf("%s/%s/media", base, a.Cfg.WhatsAppPhoneNumberID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+a.Cfg.WhatsAppToken)
+	resp, err := a.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return "", fmt.Errorf("whatsapp media status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if out.ID == "" {
+		return "", fmt.Errorf("whatsapp media id empty")
+	}
+	return out.ID, nil
+}
+
+func whatsappRecipient(sessionID string) string {
+	return strings.TrimPrefix(sessionID, "wa:")
+}
@@ -0,0 +1,267 @@
+package channel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"iq-home/go_beckend/internal/app/config"
+)
+
+const (
+	testAppSecret = "app-secret"
+	testToken     = "graph-token"
+	testPhoneID   = "100200300"
+)
+
+// fakeGraph is a local stand-in for the Cloud API: media lookups, media
+// downloads, uploads and the messages endpoint.
+type fakeGraph struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	messages []map[string]interface{}
+	uploads  []string
+}
+
+func newFakeGraph(t *testing.T) *fakeGraph {
+	g := &fakeGraph{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/media-1", func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(w, r) {
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"url": g.srv.URL + "/files/media-1", "mime_type": "audio/ogg"})
+	})
+	mux.HandleFunc("/files/media-1", func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(w, r) {
+			return
+		}
+		_, _ = w.Write([]byte("OggS-voice"))
+	})
+	mux.HandleFunc("/"+testPhoneID+"/media", func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(w, r) {
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		g.mu.Lock()
+		g.uploads = append(g.uploads, header.Filename)
+		g.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"id": "uploaded-1"})
+	})
+	mux.HandleFunc("/"+testPhoneID+"/messages", func(w http.ResponseWriter, r *http.Request) {
+		if !g.authorized(w, r) {
+			return
+		}
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		g.mu.Lock()
+		g.messages = append(g.messages, payload)
+		g.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"messages": []map[string]string{{"id": "wamid.out"}}})
+	})
+	g.srv = httptest.NewServer(mux)
+	t.Cleanup(g.srv.Close)
+	return g
+}
+
+func (g *fakeGraph) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (g *fakeGraph) adapter() *WhatsApp {
+	return NewWhatsApp(config.Config{
+		WhatsAppToken:         testToken,
+		WhatsAppPhoneNumberID: testPhoneID,
+		WhatsAppAppSecret:     testAppSecret,
+		WhatsAppVerifyToken:   "verify-me",
+		WhatsAppBaseURL:       g.srv.URL,
+	}, g.srv.Client())
+}
+
+func signWhatsApp(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookRequest(body, signature string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/whatsapp/webhook", strings.NewReader(body))
+	if signature != "" {
+		r.Header.Set("X-Hub-Signature-256", signature)
+	}
+	return r
+}
+
+func TestWhatsAppVerify(t *testing.T) {
+	a := newFakeGraph(t).adapter()
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"valid", "hub.mode=subscribe&hub.verify_token=verify-me&hub.challenge=42", true},
+		{"wrong token", "hub.mode=subscribe&hub.verify_token=nope&hub.challenge=42", false},
+		{"wrong mode", "hub.mode=unsubscribe&hub.verify_token=verify-me&hub.challenge=42", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/whatsapp/webhook?"+tt.query, nil)
+			challenge, ok := a.Verify(r)
+			if ok != tt.ok {
+				t.Fatalf("Verify ok = %v, want %v", ok, tt.ok)
+			}
+			if ok && challenge != "42" {
+				t.Fatalf("challenge = %q, want 42", challenge)
+			}
+		})
+	}
+}
+
+func TestWhatsAppSignature(t *testing.T) {
+	body := `{"object":"whatsapp_business_account","entry":[]}`
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		wantErr   error
+	}{
+		{"valid", testAppSecret, signWhatsApp(testAppSecret, []byte(body)), nil},
+		{"missing header", testAppSecret, "", ErrUnauthorized},
+		{"wrong key", testAppSecret, signWhatsApp("other", []byte(body)), ErrUnauthorized},
+		{"not hex", testAppSecret, "sha256=zz", ErrUnauthorized},
+		{"no secret configured", "", signWhatsApp("", []byte(body)), ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewWhatsApp(config.Config{WhatsAppAppSecret: tt.secret}, http.DefaultClient)
+			_, err := a.ReceiveUpdates(webhookRequest(body, tt.signature))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReceiveUpdates err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWhatsAppReceiveUpdates(t *testing.T) {
+	body := `{"object":"whatsapp_business_account","entry":[{"id":"1","changes":[{"field":"messages","value":{
+		"messaging_product":"whatsapp",
+		"messages":[
+			{"id":"m1","from":"77010000001","type":"text","text":{"body":"нужна розетка"}},
+			{"id":"m2","from":"77010000001","type":"audio","audio":{"id":"media-1","mime_type":"audio/ogg","voice":true}},
+			{"id":"m3","from":"77010000001","type":"image","image":{"id":"media-2","mime_type":"image/jpeg","caption":"такую"}},
+			{"id":"m4","from":"77010000001","type":"document","document":{"id":"media-3","mime_type":"application/pdf","filename":"kp.pdf"}},
+			{"id":"m5","from":"77010000001","type":"interactive","interactive":{"type":"button_reply","button_reply":{"id":"kp","title":"Собрать КП"}}},
+			{"id":"m6","from":"","type":"text","text":{"body":"no sender"}}
+		]}}]}]}`
+	a := newFakeGraph(t).adapter()
+	updates, err := a.ReceiveUpdates(webhookRequest(body, signWhatsApp(testAppSecret, []byte(body))))
+	if err != nil {
+		t.Fatalf("ReceiveUpdates: %v", err)
+	}
+	if len(updates) != 5 {
+		t.Fatalf("got %d updates, want 5", len(updates))
+	}
+	for _, u := range updates {
+		if u.SessionID != "wa:77010000001" || u.UserID != "77010000001" {
+			t.Fatalf("update %s session=%q user=%q", u.ID, u.SessionID, u.UserID)
+		}
+	}
+	if updates[0].Text != "нужна розетка" || updates[0].Media != nil {
+		t.Errorf("text update = %+v", updates[0])
+	}
+	if m := updates[1].Media; m == nil || m.Kind != "voice" || m.FileID != "media-1" || m.MimeType != "audio/ogg" {
+		t.Errorf("voice update media = %+v", m)
+	}
+	if m := updates[2].Media; m == nil || m.Kind != "photo" || m.FileID != "media-2" || updates[2].Text != "такую" {
+		t.Errorf("image update = %+v media=%+v", updates[2], m)
+	}
+	if m := updates[3].Media; m == nil || m.Kind != "document" || m.FileName != "kp.pdf" {
+		t.Errorf("document update media = %+v", m)
+	}
+	if updates[4].Action != "kp" || updates[4].Media != nil {
+		t.Errorf("button update = %+v", updates[4])
+	}
+}
+
+func TestWhatsAppDownloadMedia(t *testing.T) {
+	a := newFakeGraph(t).adapter()
+	f, err := a.DownloadMedia(context.Background(), Media{Kind: "voice", FileID: "media-1", FileName: "voice.ogg"})
+	if err != nil {
+		t.Fatalf("DownloadMedia: %v", err)
+	}
+	if string(f.Data) != "OggS-voice" || f.Kind != "voice" || f.Name != "voice.ogg" || f.ContentType != "audio/ogg" {
+		t.Fatalf("file = %+v data=%q", f, f.Data)
+	}
+
+	if _, err := a.DownloadMedia(context.Background(), Media{FileID: "missing"}); err == nil {
+		t.Fatal("DownloadMedia of an unknown id succeeded")
+	}
+}
+
+func TestWhatsAppSend(t *testing.T) {
+	g := newFakeGraph(t)
+	a := g.adapter()
+	ctx := context.Background()
+	if err := a.SendText(ctx, "wa:77010000001", "Здравствуйте"); err != nil {
+		t.Fatalf("SendText: %v", err)
+	}
+	rows := [][]Button{{{Text: "Собрать КП", Data: "kp"}, {Text: "Позвать менеджера", Data: "manager"}}, {{Text: "Ещё", Data: "more"}, {Text: "Лишняя", Data: "extra"}}}
+	if err := a.SendButtons(ctx, "wa:77010000001", "Выберите", rows); err != nil {
+		t.Fatalf("SendButtons: %v", err)
+	}
+	if err := a.SendDocument(ctx, "wa:77010000001", "KP.pdf", []byte("%PDF-1.4")); err != nil {
+		t.Fatalf("SendDocument: %v", err)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(g.messages))
+	}
+	text := g.messages[0]
+	if text["to"] != "77010000001" || text["type"] != "text" || text["text"].(map[string]interface{})["body"] != "Здравствуйте" {
+		t.Errorf("text message = %v", text)
+	}
+	buttons := g.messages[1]["interactive"].(map[string]interface{})["action"].(map[string]interface{})["buttons"].([]interface{})
+	if len(buttons) != 3 {
+		t.Errorf("sent %d buttons, want the Cloud API limit of 3", len(buttons))
+	}
+	doc := g.messages[2]
+	if doc["type"] != "document" || doc["document"].(map[string]interface{})["id"] != "uploaded-1" {
+		t.Errorf("document message = %v", doc)
+	}
+	if len(g.uploads) != 1 || g.uploads[0] != "KP.pdf" {
+		t.Errorf("uploads = %v", g.uploads)
+	}
+}
+
+func TestWhatsAppSendError(t *testing.T) {
+	g := newFakeGraph(t)
+	a := g.adapter()
+	a.Cfg.WhatsAppToken = "revoked"
+	err := a.SendText(context.Background(), "wa:77010000001", "hi")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("SendText with a bad token err = %v, want status 401", err)
+	}
+}
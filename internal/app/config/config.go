@@ -18,12 +18,27 @@ type Config struct {
 	OpenAIModel            string
 	OpenAIVisionModel      string
 	OpenAITranscribeModel  string
+	OpenAIClassifierModel  string
+	TurnScoring            string
 	TikaURL                string
 	TelegramBotToken       string
 	TelegramWebhookSecret  string
 	TelegramBaseURL        string
+	TelegramMode           string
+	TelegramOffsetFile     string
+	TelegramGroupSession   string
+	WhatsAppToken          string
+	WhatsAppPhoneNumberID  string
+	WhatsAppAppSecret      string
+	WhatsAppVerifyToken    string
+	WhatsAppBaseURL        string
 	ManagerChatID          string
 	DirectorChatID         string
+	ManagerAssignment      string
+	CRMProvider            string
+	CRMBaseURL             string
+	CRMToken               string
+	CRMWebhookSecret       string
 	CORSAllowOrigin        string
 }
 
@@ -41,16 +56,41 @@ func MustLoad() Config {
 		OpenAIModel:            env("OPENAI_MODEL", "gpt-4o-mini"),
 		OpenAIVisionModel:      env("OPENAI_VISION_MODEL", "gpt-4o-mini"),
 		OpenAITranscribeModel:  env("OPENAI_TRANSCRIBE_MODEL", "gpt-4o-mini-transcribe"),
+		OpenAIClassifierModel:  env("OPENAI_CLASSIFIER_MODEL", "gpt-4o-mini"),
+		TurnScoring:            env("TURN_SCORING", "rules"),
 		TikaURL:                env("TIKA_URL", ""),
 		TelegramBotToken:       env("TELEGRAM_BOT_TOKEN", ""),
 		TelegramWebhookSecret:  env("TELEGRAM_WEBHOOK_SECRET", ""),
 		TelegramBaseURL:        env("TELEGRAM_BASE_URL", "https://api.telegram.org"),
+		TelegramMode:           env("TELEGRAM_MODE", "webhook"),
+		TelegramOffsetFile:     env("TELEGRAM_OFFSET_FILE", ".telegram_offset"),
+		TelegramGroupSession:   env("TELEGRAM_GROUP_SESSION", "chat"),
+		WhatsAppToken:          env("WHATSAPP_TOKEN", ""),
+		WhatsAppPhoneNumberID:  env("WHATSAPP_PHONE_NUMBER_ID", ""),
+		WhatsAppAppSecret:      env("WHATSAPP_APP_SECRET", ""),
+		WhatsAppVerifyToken:    env("WHATSAPP_VERIFY_TOKEN", ""),
+		WhatsAppBaseURL:        env("WHATSAPP_BASE_URL", "https://graph.facebook.com/v20.0"),
 		ManagerChatID:          env("MANAGER_CHAT_ID", ""),
 		DirectorChatID:         env("DIRECTOR_CHAT_ID", ""),
+		ManagerAssignment:      env("MANAGER_ASSIGNMENT", "round_robin"),
+		CRMProvider:            env("CRM_PROVIDER", ""),
+		CRMBaseURL:             env("CRM_BASE_URL", ""),
+		CRMToken:               env("CRM_TOKEN", ""),
+		CRMWebhookSecret:       env("CRM_WEBHOOK_SECRET", ""),
 		CORSAllowOrigin:        env("CORS_ALLOW_ORIGIN", "*"),
 	}
 }
 
+// LoadTelegram reads only the Telegram settings, for tools that talk to the Bot
+// API without the rest of the backend.
+func LoadTelegram() Config {
+	return Config{
+		TelegramBotToken:      mustEnv("TELEGRAM_BOT_TOKEN"),
+		TelegramWebhookSecret: env("TELEGRAM_WEBHOOK_SECRET", ""),
+		TelegramBaseURL:       env("TELEGRAM_BASE_URL", "https://api.telegram.org"),
+	}
+}
+
 func env(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
@@ -0,0 +1,131 @@
+package crm
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// AmoCRM writes leads with the v4 API: a new lead is created together with its
+// contact through /api/v4/leads/complex, later changes PATCH the lead and its
+// main contact. Status,
+// channel and city go to tags, since pipeline stages differ per account.
+type AmoCRM struct {
+	BaseURL string // https://<subdomain>.amocrm.ru
+	Token   string // long-lived access token
+	HTTP    *http.Client
+}
+
+type amoTag struct {
+	Name string `json:"name"`
+}
+
+func (a *AmoCRM) Name() string { return "amocrm" }
+
+func (a *AmoCRM) Push(ctx context.Context, l lead.Lead) (string, error) {
+	base := strings.TrimRight(a.BaseURL, "/")
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+a.Token)
+
+	tags := []amoTag{{Name: "чат-бот"}, {Name: l.Channel}, {Name: string(l.Status)}}
+	if l.City != "" {
+		tags = append(tags, amoTag{Name: l.City})
+	}
+	fields := map[string]interface{}{
+		"name":      l.Title(),
+		"price":     l.QuoteTotal,
+		"_embedded": map[string]interface{}{"tags": tags},
+	}
+
+	if l.CRMID != "" {
+		if err := doJSON(ctx, a.HTTP, http.MethodPatch, base+"/api/v4/leads/"+l.CRMID, header, fields, nil); err != nil {
+			return "", err
+		}
+		return l.CRMID, a.updateContact(ctx, base, header, l)
+	}
+
+	contact := map[string]interface{}{"first_name": l.Name, "custom_fields_values": amoContactFields(l.Phone, l.Email)}
+	fields["_embedded"] = map[string]interface{}{"tags": tags, "contacts": []interface{}{contact}}
+	var out []struct {
+		ID int64 `json:"id"`
+	}
+	if err := doJSON(ctx, a.HTTP, http.MethodPost, base+"/api/v4/leads/complex", header, []interface{}{fields}, &out); err != nil {
+		return "", err
+	}
+	if len(out) == 0 || out[0].ID == 0 {
+		return "", errors.New("amocrm: no lead id in response")
+	}
+	return strconv.FormatInt(out[0].ID, 10), nil
+}
+
+type amoEntities struct {
+	Embedded struct {
+		Contacts []struct {
+			ID     int64 `json:"id"`
+			IsMain bool  `json:"is_main"`
+		} `json:"contacts"`
+	} `json:"_embedded"`
+}
+
+// updateContact writes the lead's contact details to its main contact, or
+// creates and links a contact when the lead has none. A PATCH of the lead
+// leaves the embedded contact as it was.
+func (a *AmoCRM) updateContact(ctx context.Context, base string, header http.Header, l lead.Lead) error {
+	contact := map[string]interface{}{}
+	if l.Name != "" {
+		contact["first_name"] = l.Name
+	}
+	if cf := amoContactFields(l.Phone, l.Email); len(cf) > 0 {
+		contact["custom_fields_values"] = cf
+	}
+	if len(contact) == 0 {
+		return nil
+	}
+
+	var linked amoEntities
+	if err := doJSON(ctx, a.HTTP, http.MethodGet, base+"/api/v4/leads/"+l.CRMID+"?with=contacts", header, nil, &linked); err != nil {
+		return err
+	}
+	var contactID int64
+	for _, c := range linked.Embedded.Contacts {
+		if contactID == 0 || c.IsMain {
+			contactID = c.ID
+		}
+	}
+	if contactID != 0 {
+		return doJSON(ctx, a.HTTP, http.MethodPatch, base+"/api/v4/contacts/"+strconv.FormatInt(contactID, 10), header, contact, nil)
+	}
+
+	var created amoEntities
+	if err := doJSON(ctx, a.HTTP, http.MethodPost, base+"/api/v4/contacts", header, []interface{}{contact}, &created); err != nil {
+		return err
+	}
+	if len(created.Embedded.Contacts) == 0 || created.Embedded.Contacts[0].ID == 0 {
+		return errors.New("amocrm: no contact id in response")
+	}
+	link := []interface{}{map[string]interface{}{"to_entity_id": created.Embedded.Contacts[0].ID, "to_entity_type": "contacts"}}
+	return doJSON(ctx, a.HTTP, http.MethodPost, base+"/api/v4/leads/"+l.CRMID+"/link", header, link, nil)
+}
+
+// amoContactFields returns the PHONE and EMAIL custom fields for the non-empty
+// values.
+func amoContactFields(phone, email string) []interface{} {
+	var fields []interface{}
+	if phone != "" {
+		fields = append(fields, map[string]interface{}{
+			"field_code": "PHONE",
+			"values":     []interface{}{map[string]string{"value": phone, "enum_code": "WORK"}},
+		})
+	}
+	if email != "" {
+		fields = append(fields, map[string]interface{}{
+			"field_code": "EMAIL",
+			"values":     []interface{}{map[string]string{"value": email, "enum_code": "WORK"}},
+		})
+	}
+	return fields
+}
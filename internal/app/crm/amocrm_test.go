@@ -0,0 +1,102 @@
+package crm
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAmoCRMCreate(t *testing.T) {
+	rec := newRecorder(t, map[string]string{"POST /api/v4/leads/complex": `[{"id": 3301, "contact_id": 55}]`})
+	a := &AmoCRM{BaseURL: rec.srv.URL, Token: "amo-token", HTTP: rec.srv.Client()}
+
+	id, err := a.Push(context.Background(), testLead())
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "3301" {
+		t.Fatalf("id = %q, want 3301", id)
+	}
+	calls := rec.calls()
+	if len(calls) != 1 || calls[0].Header.Get("Authorization") != "Bearer amo-token" {
+		t.Fatalf("requests = %+v", calls)
+	}
+	leadBody := decode(t, calls[0].Body).([]interface{})[0].(map[string]interface{})
+	if leadBody["name"] != "Чат-бот: Айгерим" || leadBody["price"] != float64(125000) {
+		t.Errorf("lead = %v", leadBody)
+	}
+	contacts := leadBody["_embedded"].(map[string]interface{})["contacts"].([]interface{})
+	if len(contacts) != 1 || contacts[0].(map[string]interface{})["first_name"] != "Айгерим" {
+		t.Errorf("contacts = %v", contacts)
+	}
+}
+
+func TestAmoCRMUpdatesMainContact(t *testing.T) {
+	rec := newRecorder(t, map[string]string{
+		"PATCH /api/v4/leads/3301":             `{"id": 3301}`,
+		"GET /api/v4/leads/3301?with=contacts": `{"id": 3301, "_embedded": {"contacts": [{"id": 54, "is_main": false}, {"id": 55, "is_main": true}]}}`,
+		"PATCH /api/v4/contacts/55":            `{"id": 55}`,
+		"POST /api/v4/contacts":                `{"_embedded": {"contacts": [{"id": 99}]}}`,
+		"POST /api/v4/leads/3301/link":         `{}`,
+	})
+	a := &AmoCRM{BaseURL: rec.srv.URL, Token: "amo-token", HTTP: rec.srv.Client()}
+	l := testLead()
+	l.CRMID = "3301"
+	l.Phone = "+77017654321"
+
+	id, err := a.Push(context.Background(), l)
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "3301" {
+		t.Fatalf("id = %q, want 3301", id)
+	}
+	calls := rec.calls()
+	if len(calls) != 3 {
+		t.Fatalf("got %d requests, want lead PATCH, lead GET and contact PATCH: %+v", len(calls), calls)
+	}
+	if calls[1].Method != http.MethodGet || len(calls[1].Body) != 0 {
+		t.Errorf("contacts lookup = %s with body %q", calls[1].Method, calls[1].Body)
+	}
+	if calls[2].Path != "/api/v4/contacts/55" {
+		t.Fatalf("contact update went to %s, want the main contact 55", calls[2].Path)
+	}
+	contact := decode(t, calls[2].Body).(map[string]interface{})
+	phone := contact["custom_fields_values"].([]interface{})[0].(map[string]interface{})
+	value := phone["values"].([]interface{})[0].(map[string]interface{})["value"]
+	if phone["field_code"] != "PHONE" || value != "+77017654321" || contact["first_name"] != "Айгерим" {
+		t.Errorf("contact update = %v", contact)
+	}
+}
+
+func TestAmoCRMUpdateLinksNewContact(t *testing.T) {
+	rec := newRecorder(t, map[string]string{
+		"PATCH /api/v4/leads/3301":             `{"id": 3301}`,
+		"GET /api/v4/leads/3301?with=contacts": `{"id": 3301, "_embedded": {"contacts": []}}`,
+		"POST /api/v4/contacts":                `{"_embedded": {"contacts": [{"id": 99}]}}`,
+		"POST /api/v4/leads/3301/link":         `{}`,
+	})
+	a := &AmoCRM{BaseURL: rec.srv.URL, Token: "amo-token", HTTP: rec.srv.Client()}
+	l := testLead()
+	l.CRMID = "3301"
+
+	if _, err := a.Push(context.Background(), l); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	calls := rec.calls()
+	if len(calls) != 4 || calls[3].Path != "/api/v4/leads/3301/link" {
+		t.Fatalf("requests = %+v", calls)
+	}
+	link := decode(t, calls[3].Body).([]interface{})[0].(map[string]interface{})
+	if link["to_entity_id"] != float64(99) || link["to_entity_type"] != "contacts" {
+		t.Errorf("link = %v", link)
+	}
+}
+
+func TestAmoCRMError(t *testing.T) {
+	rec := newRecorder(t, nil)
+	a := &AmoCRM{BaseURL: rec.srv.URL, Token: "amo-token", HTTP: rec.srv.Client()}
+	if _, err := a.Push(context.Background(), testLead()); err == nil {
+		t.Fatal("Push to a failing API succeeded")
+	}
+}
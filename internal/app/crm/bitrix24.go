@@ -0,0 +1,141 @@
+package crm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// Bitrix24 writes leads through an inbound REST webhook
+// (https://<portal>.bitrix24.kz/rest/<user>/<code>) with crm.lead.add and
+// crm.lead.update; updates read the lead first to address its PHONE and EMAIL
+// entries by ID.
+type Bitrix24 struct {
+	WebhookURL string
+	HTTP       *http.Client
+}
+
+var bitrixStatuses = map[lead.Status]string{
+	lead.StatusNew:       "NEW",
+	lead.StatusQualified: "IN_PROCESS",
+	lead.StatusWon:       "CONVERTED",
+	lead.StatusLost:      "JUNK",
+}
+
+type bitrixResponse struct {
+	Result           json.RawMessage `json:"result"`
+	Error            string          `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+}
+
+func (b *Bitrix24) Name() string { return "bitrix24" }
+
+func (b *Bitrix24) Push(ctx context.Context, l lead.Lead) (string, error) {
+	base := strings.TrimRight(b.WebhookURL, "/")
+	fields := map[string]interface{}{
+		"TITLE":              l.Title(),
+		"NAME":               l.Name,
+		"ADDRESS_CITY":       l.City,
+		"STATUS_ID":          bitrixStatuses[l.Status],
+		"SOURCE_ID":          "WEB",
+		"SOURCE_DESCRIPTION": "Чат-бот, " + l.Channel,
+		"OPPORTUNITY":        l.QuoteTotal,
+		"CURRENCY_ID":        "KZT",
+		"COMMENTS":           strings.Join(l.Intents, ", "),
+	}
+
+	if l.CRMID == "" {
+		fields["PHONE"] = []bitrixMultiField{{Value: l.Phone, ValueType: "WORK"}}
+		if l.Email != "" {
+			fields["EMAIL"] = []bitrixMultiField{{Value: l.Email, ValueType: "WORK"}}
+		}
+		var id string
+		if err := b.call(ctx, base, "crm.lead.add", map[string]interface{}{"fields": fields}, &id); err != nil {
+			return "", err
+		}
+		if id == "" {
+			return "", errors.New("bitrix24: no lead id in response")
+		}
+		return id, nil
+	}
+
+	// Multi-fields without an ID are added next to the stored values, so an
+	// update rewrites the stored entry by its ID, or leaves it alone when the
+	// value did not change.
+	var current struct {
+		Phone []bitrixMultiField `json:"PHONE"`
+		Email []bitrixMultiField `json:"EMAIL"`
+	}
+	if err := b.call(ctx, base, "crm.lead.get", map[string]interface{}{"id": l.CRMID}, &current); err != nil {
+		return "", err
+	}
+	if f := updateMultiField(current.Phone, l.Phone, samePhone); f != nil {
+		fields["PHONE"] = f
+	}
+	if f := updateMultiField(current.Email, l.Email, strings.EqualFold); f != nil {
+		fields["EMAIL"] = f
+	}
+	if err := b.call(ctx, base, "crm.lead.update", map[string]interface{}{"id": l.CRMID, "fields": fields}, nil); err != nil {
+		return "", err
+	}
+	return l.CRMID, nil
+}
+
+// bitrixMultiField is an entry of PHONE or EMAIL. ID is set on stored entries.
+type bitrixMultiField struct {
+	ID        string `json:"ID,omitempty"`
+	Value     string `json:"VALUE"`
+	ValueType string `json:"VALUE_TYPE"`
+}
+
+// updateMultiField returns the multi-field to send for value, nil when there is
+// nothing to change.
+func updateMultiField(stored []bitrixMultiField, value string, same func(a, b string) bool) []bitrixMultiField {
+	if value == "" {
+		return nil
+	}
+	for _, f := range stored {
+		if same(f.Value, value) {
+			return nil
+		}
+	}
+	if len(stored) == 0 {
+		return []bitrixMultiField{{Value: value, ValueType: "WORK"}}
+	}
+	valueType := stored[0].ValueType
+	if valueType == "" {
+		valueType = "WORK"
+	}
+	return []bitrixMultiField{{ID: stored[0].ID, Value: value, ValueType: valueType}}
+}
+
+func samePhone(a, b string) bool {
+	return lead.NormalizePhone(a) != "" && lead.NormalizePhone(a) == lead.NormalizePhone(b)
+}
+
+// call runs a REST method and decodes its result into out, when given. A
+// string out receives ids that come as numbers too.
+func (b *Bitrix24) call(ctx context.Context, base, method string, body, out interface{}) error {
+	var resp bitrixResponse
+	if err := doJSON(ctx, b.HTTP, http.MethodPost, base+"/"+method+".json", nil, body, &resp); err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("bitrix24 %s: %s %s", method, resp.Error, resp.ErrorDescription)
+	}
+	switch out := out.(type) {
+	case nil:
+	case *string:
+		*out = rawID(resp.Result)
+	default:
+		if err := json.Unmarshal(resp.Result, out); err != nil {
+			return fmt.Errorf("bitrix24 %s: %w", method, err)
+		}
+	}
+	return nil
+}
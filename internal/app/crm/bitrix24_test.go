@@ -0,0 +1,73 @@
+package crm
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBitrix24Add(t *testing.T) {
+	rec := newRecorder(t, map[string]string{"POST /rest/1/code/crm.lead.add.json": `{"result": 512}`})
+	b := &Bitrix24{WebhookURL: rec.srv.URL + "/rest/1/code/", HTTP: rec.srv.Client()}
+
+	id, err := b.Push(context.Background(), testLead())
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "512" {
+		t.Fatalf("id = %q, want 512", id)
+	}
+	fields := decode(t, rec.calls()[0].Body).(map[string]interface{})["fields"].(map[string]interface{})
+	phone := fields["PHONE"].([]interface{})[0].(map[string]interface{})
+	if phone["VALUE"] != "+77011234567" || phone["ID"] != nil {
+		t.Errorf("PHONE = %v", phone)
+	}
+	if fields["STATUS_ID"] != "IN_PROCESS" || fields["OPPORTUNITY"] != float64(125000) {
+		t.Errorf("fields = %v", fields)
+	}
+}
+
+func TestBitrix24UpdateAddressesStoredValues(t *testing.T) {
+	rec := newRecorder(t, map[string]string{
+		"POST /rest/1/code/crm.lead.get.json": `{"result": {"ID": "512",
+			"PHONE": [{"ID": "31", "VALUE": "8 (701) 123-45-67", "VALUE_TYPE": "MOBILE"}],
+			"EMAIL": [{"ID": "32", "VALUE": "old@example.kz", "VALUE_TYPE": "WORK"}]}}`,
+		"POST /rest/1/code/crm.lead.update.json": `{"result": true}`,
+	})
+	b := &Bitrix24{WebhookURL: rec.srv.URL + "/rest/1/code", HTTP: rec.srv.Client()}
+	l := testLead()
+	l.CRMID = "512"
+
+	id, err := b.Push(context.Background(), l)
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "512" {
+		t.Fatalf("id = %q, want 512", id)
+	}
+	calls := rec.calls()
+	if len(calls) != 2 || !strings.HasSuffix(calls[1].Path, "crm.lead.update.json") {
+		t.Fatalf("requests = %+v", calls)
+	}
+	body := decode(t, calls[1].Body).(map[string]interface{})
+	fields := body["fields"].(map[string]interface{})
+	if body["id"] != "512" {
+		t.Errorf("id = %v", body["id"])
+	}
+	if _, ok := fields["PHONE"]; ok {
+		t.Errorf("unchanged phone sent again: %v", fields["PHONE"])
+	}
+	email := fields["EMAIL"].([]interface{})
+	if len(email) != 1 || email[0].(map[string]interface{})["ID"] != "32" || email[0].(map[string]interface{})["VALUE"] != "a@example.kz" {
+		t.Errorf("EMAIL = %v, want the stored entry 32 rewritten", email)
+	}
+}
+
+func TestBitrix24Error(t *testing.T) {
+	rec := newRecorder(t, map[string]string{"POST /rest/crm.lead.add.json": `{"error": "ACCESS_DENIED", "error_description": "no rights"}`})
+	b := &Bitrix24{WebhookURL: rec.srv.URL + "/rest", HTTP: rec.srv.Client()}
+	_, err := b.Push(context.Background(), testLead())
+	if err == nil || !strings.Contains(err.Error(), "ACCESS_DENIED") {
+		t.Fatalf("Push err = %v, want the portal's error", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Package crm pushes leads captured in chats to an external CRM.
+package crm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"iq-home/go_beckend/internal/app/config"
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// Sink is a CRM the lead sync writes to.
+type Sink interface {
+	Name() string
+	// Push creates the lead, or updates it when l.CRMID is set, and returns the
+	// CRM's id for it.
+	Push(ctx context.Context, l lead.Lead) (string, error)
+}
+
+// New returns the sink selected by CRM_PROVIDER: webhook, amocrm or bitrix24.
+// It returns nil without a provider.
+func New(cfg config.Config, httpClient *http.Client) (Sink, error) {
+	provider := strings.ToLower(strings.TrimSpace(cfg.CRMProvider))
+	if provider == "" {
+		return nil, nil
+	}
+	if strings.TrimSpace(cfg.CRMBaseURL) == "" {
+		return nil, fmt.Errorf("crm: CRM_BASE_URL is required for %s", provider)
+	}
+	switch provider {
+	case "webhook":
+		return &Webhook{URL: cfg.CRMBaseURL, Secret: cfg.CRMWebhookSecret, Token: cfg.CRMToken, HTTP: httpClient}, nil
+	case "amocrm":
+		return &AmoCRM{BaseURL: cfg.CRMBaseURL, Token: cfg.CRMToken, HTTP: httpClient}, nil
+	case "bitrix24":
+		return &Bitrix24{WebhookURL: cfg.CRMBaseURL, HTTP: httpClient}, nil
+	}
+	return nil, fmt.Errorf("crm: unknown CRM_PROVIDER %q", cfg.CRMProvider)
+}
+
+// maxBackoff caps the delay between push attempts.
+const maxBackoff = time.Hour
+
+// Backoff returns how long to wait after the given failed attempt: 1, 4, 9...
+// minutes, capped at an hour.
+func Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	if attempt >= 8 {
+		return maxBackoff
+	}
+	return time.Duration(attempt*attempt) * time.Minute
+}
+
+// doJSON sends body as JSON, or no body when it is nil, and decodes a 2xx
+// response into out, when given.
+func doJSON(ctx context.Context, client *http.Client, method, url string, header http.Header, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("crm status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,98 @@
+package crm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// recorder is a fake CRM endpoint: it stores every request and answers with
+// the handler registered for its method and path.
+type recorder struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	requests []recorded
+}
+
+type recorded struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+func newRecorder(t *testing.T, routes map[string]string) *recorder {
+	rec := &recorder{}
+	rec.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, recorded{Method: r.Method, Path: r.URL.RequestURI(), Header: r.Header.Clone(), Body: body})
+		rec.mu.Unlock()
+		resp, ok := routes[r.Method+" "+r.URL.RequestURI()]
+		if !ok {
+			http.Error(w, "unexpected request", http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(resp))
+	}))
+	t.Cleanup(rec.srv.Close)
+	return rec
+}
+
+func (r *recorder) calls() []recorded {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]recorded(nil), r.requests...)
+}
+
+// decode unmarshals a recorded body into a generic value.
+func decode(t *testing.T, body []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("request body %q: %v", body, err)
+	}
+	return v
+}
+
+func testLead() lead.Lead {
+	return lead.Lead{
+		ID:         7,
+		Name:       "Айгерим",
+		Phone:      "+77011234567",
+		Email:      "a@example.kz",
+		City:       "Алматы",
+		Status:     lead.StatusQualified,
+		Channel:    "telegram",
+		SessionID:  "tg:1",
+		Intents:    []string{lead.IntentOrder},
+		QuoteTotal: 125000,
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 4 * time.Minute},
+		{3, 9 * time.Minute},
+		{7, 49 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package crm
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// Webhook posts {"event": "lead", "lead": {...}} to a URL. With a secret the
+// body is signed in X-Signature as "sha256=<hex hmac>". The receiver may answer
+// {"id": "..."} to give the lead its own id.
+type Webhook struct {
+	URL    string
+	Secret string
+	Token  string
+	HTTP   *http.Client
+}
+
+func (w *Webhook) Name() string { return "webhook" }
+
+func (w *Webhook) Push(ctx context.Context, l lead.Lead) (string, error) {
+	body := map[string]interface{}{"event": "lead", "lead": l}
+	header := http.Header{}
+	if w.Secret != "" {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(raw)
+		header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	if w.Token != "" {
+		header.Set("Authorization", "Bearer "+w.Token)
+	}
+	var out struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := doJSON(ctx, w.HTTP, http.MethodPost, w.URL, header, body, &out); err != nil {
+		return "", err
+	}
+	if id := rawID(out.ID); id != "" {
+		return id, nil
+	}
+	if l.CRMID != "" {
+		return l.CRMID, nil
+	}
+	return strconv.FormatInt(l.ID, 10), nil
+}
+
+// rawID reads an id that may come as a JSON number or string.
+func rawID(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
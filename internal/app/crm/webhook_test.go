@@ -0,0 +1,63 @@
+package crm
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestWebhookSignsBody(t *testing.T) {
+	rec := newRecorder(t, map[string]string{"POST /leads": `{"id": 901}`})
+	w := &Webhook{URL: rec.srv.URL + "/leads", Secret: "s3cret", Token: "tok", HTTP: rec.srv.Client()}
+
+	id, err := w.Push(context.Background(), testLead())
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "901" {
+		t.Fatalf("id = %q, want the receiver's 901", id)
+	}
+	calls := rec.calls()
+	if len(calls) != 1 {
+		t.Fatalf("got %d requests, want 1", len(calls))
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(calls[0].Body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); calls[0].Header.Get("X-Signature") != want {
+		t.Fatalf("X-Signature = %q, want %q for the sent body", calls[0].Header.Get("X-Signature"), want)
+	}
+	if calls[0].Header.Get("Authorization") != "Bearer tok" {
+		t.Errorf("Authorization = %q", calls[0].Header.Get("Authorization"))
+	}
+	body := decode(t, calls[0].Body).(map[string]interface{})
+	if body["event"] != "lead" || body["lead"].(map[string]interface{})["phone"] != "+77011234567" {
+		t.Errorf("body = %v", body)
+	}
+}
+
+func TestWebhookWithoutSecretOrID(t *testing.T) {
+	rec := newRecorder(t, map[string]string{"POST /leads": ``})
+	w := &Webhook{URL: rec.srv.URL + "/leads", HTTP: rec.srv.Client()}
+
+	id, err := w.Push(context.Background(), testLead())
+	if err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	if id != "7" {
+		t.Fatalf("id = %q, want the lead's own id 7", id)
+	}
+	if sig := rec.calls()[0].Header.Get("X-Signature"); sig != "" {
+		t.Errorf("X-Signature = %q without a secret", sig)
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	rec := newRecorder(t, nil)
+	w := &Webhook{URL: rec.srv.URL + "/leads", HTTP: http.DefaultClient}
+	if _, err := w.Push(context.Background(), testLead()); err == nil {
+		t.Fatal("Push to a failing receiver succeeded")
+	}
+}
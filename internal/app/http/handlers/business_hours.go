@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
+)
+
+// BusinessHours returns the business calendar escalations follow.
+func (h *Handlers) BusinessHours(w http.ResponseWriter, r *http.Request) {
+	b, err := h.chat.BusinessCalendar(r.Context())
+	if err != nil {
+		writeChatError(w, err, "calendar lookup failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// UpdateBusinessHours replaces the business calendar: timezone, working days,
+// hours and holidays.
+func (h *Handlers) UpdateBusinessHours(w http.ResponseWriter, r *http.Request) {
+	var b chat.BusinessHours
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	saved, err := h.chat.SaveBusinessCalendar(r.Context(), b)
+	if err != nil {
+		writeChatError(w, err, "calendar save failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
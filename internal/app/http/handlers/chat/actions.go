@@ -0,0 +1,402 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"iq-home/go_beckend/internal/domain/ai/messenger"
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// Button payloads understood by handleAction. Telegram limits callback data to
+// 64 bytes, so they stay short.
+const (
+	ActionQuoteYes      = "kp:yes"
+	ActionQuoteNo       = "kp:no"
+	ActionMore          = "more"
+	ActionManager       = "manager"
+	actionProductPrefix = "product:"
+	actionAddPrefix     = "add:"
+)
+
+func ActionProduct(id int64) string {
+	return actionProductPrefix + strconv.FormatInt(id, 10)
+}
+
+// ActionQuoteAdd puts a product into the session's КП list.
+func ActionQuoteAdd(id int64) string {
+	return actionAddPrefix + strconv.FormatInt(id, 10)
+}
+
+func actionLabel(action string) string {
+	switch {
+	case action == ActionQuoteYes:
+		return "Собрать КП"
+	case action == ActionQuoteNo:
+		return "КП не нужно"
+	case action == ActionMore:
+		return "Показать ещё"
+	case action == ActionManager:
+		return "Позвать менеджера"
+	case action == ActionOrder:
+		return "Оформить заказ"
+	case action == ActionOrderPickup:
+		return "Самовывоз"
+	case action == ActionOrderDelivery:
+		return "Доставка"
+	case action == ActionOrderConfirm:
+		return "Подтвердить заказ"
+	case action == ActionOrderCancel:
+		return "Отменить заказ"
+	case strings.HasPrefix(action, actionProductPrefix):
+		return "Выбран товар " + strings.TrimPrefix(action, actionProductPrefix)
+	case strings.HasPrefix(action, actionAddPrefix):
+		return "Добавить в КП товар " + strings.TrimPrefix(action, actionAddPrefix)
+	}
+	return action
+}
+
+// handleAction answers a pressed button. Buttons carry the intent explicitly,
+// so nothing here goes through detectKpIntent or the product-search decision.
+func (s *Service) handleAction(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, fromDBRelay bool) (*Result, error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	log.Printf("chat req=%s action=%s", reqID, req.Action)
+
+	switch {
+	case req.Action == ActionQuoteYes:
+		var products []SupabaseMatch
+		var err error
+		if ids := latestQuoteIDs(history); len(ids) > 0 {
+			products, err = s.fetchProductsByIDs(ctx, ids)
+		} else {
+			products, err = s.loadProductsFromHistory(ctx, history)
+		}
+		if err != nil {
+			log.Printf("chat req=%s action products load failed: %v", reqID, err)
+			return nil, newError(http.StatusBadGateway, "products lookup failed")
+		}
+		if len(products) == 0 {
+			answer := "Пока не из чего собрать КП — напишите, какие товары нужны."
+			s.persistActionTurn(ctx, reqID, req, nil, answer, nil, fromDBRelay)
+			return &Result{Response: ChatResponse{Answer: answer}}, nil
+		}
+		if err := s.attachAvailability(ctx, products); err != nil {
+			log.Printf("chat req=%s stock lookup failed: %v", reqID, err)
+		}
+		return s.replyQuote(ctx, reqID, req, history, products, nil, fromDBRelay)
+
+	case req.Action == ActionQuoteNo:
+		answer := "Хорошо, без КП. Если понадобится — нажмите «Собрать КП» или просто напишите."
+		s.persistActionTurn(ctx, reqID, req, nil, answer, nil, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer}}, nil
+
+	case req.Action == ActionMore:
+		return s.replyMoreProducts(ctx, reqID, req, history, fromDBRelay)
+
+	case req.Action == ActionOrder || strings.HasPrefix(req.Action, ActionOrder+":"):
+		return s.replyOrder(ctx, reqID, req, history, latestOrderDraft(history), fromDBRelay)
+
+	case req.Action == ActionManager:
+		answer := "Передал ваш запрос менеджеру, он подключится к диалогу."
+		var assistantMeta map[string]interface{}
+		if sessionID != "" {
+			rules, err := s.activeEscalationRules(ctx)
+			if err != nil {
+				log.Printf("chat req=%s escalation rules load failed: %v", reqID, err)
+			}
+			// Pressing the button again does not page anyone again.
+			state, queued := s.currentEscalation(ctx, sessionID, history)
+			switch {
+			case queued:
+				answer = "Ваш запрос уже передан, менеджер подключится к диалогу в рабочее время."
+				assistantMeta = map[string]interface{}{"escalation": state}
+			case state.ManagerNotifiedAt != "":
+				answer = "Менеджер уже получил ваш запрос и скоро подключится к диалогу."
+				assistantMeta = map[string]interface{}{"escalation": state}
+			case s.escalate(ctx, sessionID, lastUserMessage(history), "user_request", userRequestRule(rules, sessionID), state):
+				assistantMeta = map[string]interface{}{"escalation": state}
+				if state.notice != "" {
+					answer = state.notice
+					assistantMeta["awaiting_callback_phone"] = true
+				}
+			default:
+				log.Printf("chat req=%s manager request not delivered session_id=%s", reqID, sessionID)
+				answer = "Не получилось связаться с менеджером, попробуйте ещё раз чуть позже."
+			}
+		}
+		s.persistActionTurn(ctx, reqID, req, nil, answer, assistantMeta, fromDBRelay)
+		contact, changed := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+		s.captureLead(ctx, reqID, sessionID, contact, changed, []string{lead.IntentManager}, 0)
+		return &Result{Response: ChatResponse{Answer: answer}}, nil
+
+	case strings.HasPrefix(req.Action, actionAddPrefix):
+		id, err := strconv.ParseInt(strings.TrimPrefix(req.Action, actionAddPrefix), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, newError(http.StatusBadRequest, "invalid product action")
+		}
+		cart := latestQuoteIDs(history)
+		added := true
+		for _, existing := range cart {
+			if existing == id {
+				added = false
+				break
+			}
+		}
+		if added {
+			cart = append(cart, id)
+		}
+		products, err := s.fetchProductsByIDs(ctx, []int64{id})
+		if err != nil {
+			log.Printf("chat req=%s action product load failed: %v", reqID, err)
+			return nil, newError(http.StatusBadGateway, "products lookup failed")
+		}
+		name := "товар"
+		if len(products) > 0 {
+			name = extractProductName(products[0])
+		}
+		answer := fmt.Sprintf("Добавил в КП: %s. Позиций в КП: %d.", name, len(cart))
+		if !added {
+			answer = fmt.Sprintf("%s уже есть в КП. Позиций в КП: %d.", name, len(cart))
+		}
+		assistantMeta := map[string]interface{}{
+			"kp_offer":  true,
+			"quote_ids": cart,
+		}
+		s.persistActionTurn(ctx, reqID, req, nil, answer, assistantMeta, fromDBRelay)
+		return &Result{Response: ChatResponse{
+			Answer:  answer,
+			Actions: [][]ChatAction{{{Label: "Собрать КП", Data: ActionQuoteYes}}},
+		}}, nil
+
+	case strings.HasPrefix(req.Action, actionProductPrefix):
+		id, err := strconv.ParseInt(strings.TrimPrefix(req.Action, actionProductPrefix), 10, 64)
+		if err != nil || id <= 0 {
+			return nil, newError(http.StatusBadRequest, "invalid product action")
+		}
+		products, err := s.fetchProductsByIDs(ctx, []int64{id})
+		if err != nil {
+			log.Printf("chat req=%s action product load failed: %v", reqID, err)
+			return nil, newError(http.StatusBadGateway, "products lookup failed")
+		}
+		if len(products) == 0 {
+			answer := "Этот товар больше не найден в каталоге."
+			s.persistActionTurn(ctx, reqID, req, nil, answer, nil, fromDBRelay)
+			return &Result{Response: ChatResponse{Answer: answer}}, nil
+		}
+		if err := s.attachAvailability(ctx, products); err != nil {
+			log.Printf("chat req=%s stock lookup failed: %v", reqID, err)
+		}
+		answer := strings.TrimSpace(formatProductCard(products[0])) + "\n\nМогу собрать КП — собрать?"
+		assistantMeta := map[string]interface{}{
+			"kp_offer":    true,
+			"product_ids": collectProductIDs(products),
+		}
+		s.persistActionTurn(ctx, reqID, req, nil, answer, assistantMeta, fromDBRelay)
+		return &Result{Response: ChatResponse{
+			Answer:   answer,
+			Products: products,
+			Actions:  [][]ChatAction{quoteOfferActions()},
+		}}, nil
+	}
+	return nil, newError(http.StatusBadRequest, "unknown action")
+}
+
+// replyMoreProducts repeats the last product search and returns matches that
+// have not been shown in this session yet.
+func (s *Service) replyMoreProducts(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, fromDBRelay bool) (*Result, error) {
+	query := lastProductQuery(history)
+	if query == "" {
+		answer := "Напишите, что подобрать, — покажу варианты."
+		s.persistActionTurn(ctx, reqID, req, nil, answer, nil, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer}}, nil
+	}
+	shown := shownProductIDs(history)
+	limit := len(shown) + 5
+	if limit > 20 {
+		limit = 20
+	}
+	embedding, err := s.getEmbedding(ctx, query)
+	if err != nil {
+		log.Printf("chat req=%s embedding failed: %v", reqID, err)
+		return nil, newError(http.StatusBadGateway, "embedding failed")
+	}
+	matches, err := s.searchProductsHybrid(ctx, query, vectorString(embedding), limit)
+	if err != nil {
+		log.Printf("chat req=%s supabase products failed: %v", reqID, err)
+		return nil, newError(http.StatusBadGateway, "supabase products search failed")
+	}
+	var products []SupabaseMatch
+	for _, p := range matches {
+		if _, ok := shown[p.ID]; ok {
+			continue
+		}
+		products = append(products, p)
+		if len(products) == 5 {
+			break
+		}
+	}
+	if len(products) == 0 {
+		answer := "Больше вариантов по этому запросу не нашёл. Уточните тип, серию или цвет — поищу ещё."
+		s.persistActionTurn(ctx, reqID, req, nil, answer, nil, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer, Actions: [][]ChatAction{{{Label: "Позвать менеджера", Data: ActionManager}}}}}, nil
+	}
+	if err := s.attachAvailability(ctx, products); err != nil {
+		log.Printf("chat req=%s stock lookup failed: %v", reqID, err)
+	}
+	if err := s.attachProductImages(ctx, products); err != nil {
+		log.Printf("chat req=%s product images failed: %v", reqID, err)
+	}
+	lines := make([]string, 0, len(products))
+	for _, p := range products {
+		lines = append(lines, "- "+formatProductCard(p))
+	}
+	answer := "Ещё варианты:\n" + strings.Join(lines, "\n")
+	assistantMeta := map[string]interface{}{
+		"product_ids": collectProductIDs(products),
+		"query":       query,
+	}
+	s.persistActionTurn(ctx, reqID, req, nil, answer, assistantMeta, fromDBRelay)
+	log.Printf("chat req=%s more products count=%d ids=%s", reqID, len(products), joinProductIDs(products, 5))
+	res := &Result{Response: ChatResponse{
+		Answer:   answer,
+		Products: products,
+		Actions:  productActions(products, !hasKPOffered(history)),
+	}}
+	if messenger.IsMessengerSession(req.SessionID) {
+		res.Cards = ProductCards(products)
+	}
+	return res, nil
+}
+
+func (s *Service) persistActionTurn(ctx context.Context, reqID string, req ChatRequest, userMeta map[string]interface{}, answer string, assistantMeta map[string]interface{}, fromDBRelay bool) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	if sessionID == "" {
+		return
+	}
+	if userMeta == nil {
+		userMeta = map[string]interface{}{}
+	}
+	userMeta["action"] = req.Action
+	if assistantMeta == nil {
+		assistantMeta = map[string]interface{}{}
+	}
+	rows := make([]chatMessageInsert, 0, 2)
+	if !fromDBRelay {
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
+	}
+	rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
+	if err := s.insertChatMessages(ctx, rows); err != nil {
+		log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+	}
+}
+
+// productActions builds the keyboard shown under a product answer: one button
+// per product, then "show more", the КП offer and a way to reach a person.
+func productActions(products []SupabaseMatch, offerKp bool) [][]ChatAction {
+	var rows [][]ChatAction
+	for i, p := range products {
+		if i == 3 {
+			break
+		}
+		name := []rune(extractProductName(p))
+		if len(name) > 40 {
+			name = append(name[:39], '…')
+		}
+		rows = append(rows, []ChatAction{{Label: string(name), Data: ActionProduct(p.ID)}})
+	}
+	if offerKp {
+		rows = append(rows, quoteOfferActions())
+	}
+	rows = append(rows, []ChatAction{
+		{Label: "Показать ещё", Data: ActionMore},
+		{Label: "Позвать менеджера", Data: ActionManager},
+	})
+	return rows
+}
+
+func quoteOfferActions() []ChatAction {
+	return []ChatAction{
+		{Label: "Собрать КП", Data: ActionQuoteYes},
+		{Label: "Не нужно", Data: ActionQuoteNo},
+	}
+}
+
+func formatProductCard(p SupabaseMatch) string {
+	parts := []string{extractProductName(p)}
+	if price := extractProductPrice(p); price > 0 {
+		parts = append(parts, fmt.Sprintf("%d ₸", price))
+	}
+	if article := metaString(p.Metadata, "article"); article != "" {
+		parts = append(parts, "арт. "+article)
+	}
+	if avail := productAvailabilityText(p); avail != "" {
+		parts = append(parts, avail)
+	}
+	return strings.Join(parts, " — ")
+}
+
+func lastUserMessage(history []chatMessageRow) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "user" {
+			return history[i].Content
+		}
+	}
+	return ""
+}
+
+// lastProductQuery returns the text that produced the latest product list:
+// the stored query of a "show more" answer, or the user message before it.
+func lastProductQuery(history []chatMessageRow) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		m := history[i]
+		if m.Role != "assistant" || m.MetaData == nil {
+			continue
+		}
+		if _, ok := m.MetaData["product_ids"]; !ok {
+			continue
+		}
+		if q := metaString(m.MetaData, "query"); q != "" {
+			return q
+		}
+		for j := i - 1; j >= 0; j-- {
+			if history[j].Role == "user" {
+				if history[j].MetaData != nil && metaString(history[j].MetaData, "action") != "" {
+					continue
+				}
+				return history[j].Content
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// latestQuoteIDs returns the КП list collected with "add" buttons. A generated
+// КП stores an empty list, which starts a new one.
+func latestQuoteIDs(history []chatMessageRow) []int64 {
+	for i := len(history) - 1; i >= 0; i-- {
+		meta := history[i].MetaData
+		if meta == nil {
+			continue
+		}
+		if _, ok := meta["quote_ids"]; !ok {
+			continue
+		}
+		return extractProductIDsFromHistory([]chatMessageRow{{MetaData: map[string]interface{}{"product_ids": meta["quote_ids"]}}})
+	}
+	return nil
+}
+
+func shownProductIDs(history []chatMessageRow) map[int64]struct{} {
+	out := map[int64]struct{}{}
+	for i := range history {
+		for _, id := range extractProductIDsFromHistory(history[i : i+1]) {
+			out[id] = struct{}{}
+		}
+	}
+	return out
+}
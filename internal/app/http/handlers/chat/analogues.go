@@ -0,0 +1,240 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// crossrefRow is a row of competitor_crossref, see
+// migrations/0004_competitor_crossref.sql.
+type crossrefRow struct {
+	CompetitorBrand   string `json:"competitor_brand"`
+	CompetitorArticle string `json:"competitor_article"`
+	ProductID         int64  `json:"product_id"`
+}
+
+// fetchCrossref returns the cross-reference rows of the articles by normalized
+// article. Brands reuse article numbers, so one article can have a row per
+// brand; all of them are returned.
+func (s *Service) fetchCrossref(ctx context.Context, articles []string) (map[string][]crossrefRow, error) {
+	if len(articles) == 0 {
+		return nil, nil
+	}
+	quoted := make([]string, 0, len(articles))
+	for _, a := range articles {
+		quoted = append(quoted, `"`+strings.ReplaceAll(a, `"`, "")+`"`)
+	}
+	values := url.Values{}
+	values.Set("select", "competitor_brand,competitor_article,product_id")
+	values.Set("competitor_article", "in.("+strings.Join(quoted, ",")+")")
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/competitor_crossref?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []crossrefRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]crossrefRow, len(rows))
+	for _, r := range rows {
+		if r.ProductID <= 0 {
+			continue
+		}
+		key := normalizeArticle(r.CompetitorArticle)
+		out[key] = append(out[key], r)
+	}
+	return out, nil
+}
+
+// crossrefForLine narrows the rows of one article to the brands the document
+// line names; when it names none of them, every brand's analogue is offered.
+func crossrefForLine(refs []crossrefRow, line string) []crossrefRow {
+	l := strings.ToLower(line)
+	var named []crossrefRow
+	for _, r := range refs {
+		if brand := strings.ToLower(strings.TrimSpace(r.CompetitorBrand)); brand != "" && strings.Contains(l, brand) {
+			named = append(named, r)
+		}
+	}
+	if len(named) > 0 {
+		return named
+	}
+	return refs
+}
+
+// findAnalogues resolves competitor articles that have no own product: first via
+// the cross-reference table, then by semantic search over the document line.
+// The semantic search costs an embedding call per article, so at most limit
+// articles go through it.
+func (s *Service) findAnalogues(ctx context.Context, articles []string, lines map[string]string, limit int) ([]SupabaseMatch, error) {
+	if len(articles) == 0 || limit <= 0 {
+		return nil, nil
+	}
+	refs, err := s.fetchCrossref(ctx, articles)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]SupabaseMatch, 0, limit)
+	seen := map[int64]struct{}{}
+	var ids []int64
+	idArticle := map[int64]crossrefRow{}
+	var unresolved []string
+	for _, a := range articles {
+		rows, ok := refs[a]
+		if !ok {
+			unresolved = append(unresolved, a)
+			continue
+		}
+		for _, ref := range crossrefForLine(rows, lines[a]) {
+			if _, dup := idArticle[ref.ProductID]; !dup {
+				ids = append(ids, ref.ProductID)
+				idArticle[ref.ProductID] = ref
+			}
+		}
+	}
+	if len(ids) > 0 {
+		products, err := s.fetchProductsByIDs(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range products {
+			if len(out) >= limit {
+				return out, nil
+			}
+			ref := idArticle[p.ID]
+			markAnalogue(&p, ref.CompetitorArticle, ref.CompetitorBrand, "crossref")
+			seen[p.ID] = struct{}{}
+			out = append(out, p)
+		}
+	}
+
+	searched := 0
+	for _, a := range unresolved {
+		if len(out) >= limit || searched >= limit {
+			break
+		}
+		line := strings.TrimSpace(lines[a])
+		if line == "" {
+			continue
+		}
+		searched++
+		embedding, err := s.getEmbedding(ctx, line)
+		if err != nil {
+			return out, err
+		}
+		matches, err := s.searchProductsHybrid(ctx, line, vectorString(embedding), 1)
+		if err != nil {
+			return out, err
+		}
+		for _, p := range matches {
+			if _, ok := seen[p.ID]; ok {
+				continue
+			}
+			markAnalogue(&p, a, "", "semantic")
+			seen[p.ID] = struct{}{}
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+func markAnalogue(p *SupabaseMatch, article, brand, source string) {
+	if p.Metadata == nil {
+		p.Metadata = map[string]interface{}{}
+	}
+	p.Metadata["analogue_for"] = article
+	p.Metadata["analogue_source"] = source
+	if strings.TrimSpace(brand) != "" {
+		p.Metadata["competitor_brand"] = brand
+	}
+}
+
+func analogueLabel(p SupabaseMatch) string {
+	article := metaString(p.Metadata, "analogue_for")
+	if article == "" {
+		return ""
+	}
+	if brand := metaString(p.Metadata, "competitor_brand"); brand != "" {
+		article = brand + " " + article
+	}
+	if metaString(p.Metadata, "analogue_source") == "semantic" {
+		return "похожий аналог для " + article
+	}
+	return "аналог для " + article
+}
+
+func appendAnalogueNote(answer string, products []SupabaseMatch) string {
+	var lines []string
+	for _, p := range products {
+		if label := analogueLabel(p); label != "" {
+			lines = append(lines, "- "+extractProductName(p)+" — "+label)
+		}
+	}
+	if len(lines) == 0 {
+		return answer
+	}
+	return strings.TrimSpace(answer) + "\n\nАналоги вместо позиций из документа:\n" + strings.Join(lines, "\n")
+}
+
+func extractArticleLines(text string, articles []string) map[string]string {
+	if len(articles) == 0 {
+		return nil
+	}
+	out := map[string]string{}
+	for _, line := range strings.Split(text, "\n") {
+		norm := normalizeArticle(strings.ReplaceAll(line, " ", ""))
+		for _, a := range articles {
+			if _, ok := out[a]; ok {
+				continue
+			}
+			if strings.Contains(norm, a) {
+				clean := strings.TrimSpace(line)
+				if len(clean) > 300 {
+					clean = clean[:300]
+				}
+				out[a] = clean
+			}
+		}
+	}
+	return out
+}
+
+func stringMapMeta(meta map[string]interface{}, key string) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	switch t := meta[key].(type) {
+	case map[string]string:
+		return t
+	case map[string]interface{}:
+		out := make(map[string]string, len(t))
+		for k, v := range t {
+			out[k] = toString(v)
+		}
+		return out
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCrossrefForLine(t *testing.T) {
+	refs := []crossrefRow{
+		{CompetitorBrand: "Schneider", CompetitorArticle: "EPH2900121", ProductID: 11},
+		{CompetitorBrand: "Legrand", CompetitorArticle: "EPH2900121", ProductID: 22},
+	}
+	tests := []struct {
+		line string
+		want []int64
+	}{
+		{"Розетка Schneider EPH2900121 белая — 10 шт", []int64{11}},
+		{"LEGRAND EPH2900121", []int64{22}},
+		{"EPH2900121 розетка", []int64{11, 22}},
+		{"", []int64{11, 22}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			var got []int64
+			for _, r := range crossrefForLine(refs, tt.line) {
+				got = append(got, r.ProductID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("crossrefForLine(%q) = %v, want %v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// Out of business hours an escalation is not sent right away: the customer is
+// told when a manager will answer and asked for a callback number, and the
+// escalation waits in escalation_jobs until the calendar opens. Rules with
+// outside_hours set are meant for on-call staff and still fire immediately.
+
+const calendarSchema = `
+CREATE TABLE IF NOT EXISTS business_calendar (
+	id         int PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+	hours      jsonb NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+const jobManagerEscalation = "manager_escalation"
+
+var defaultBusinessHours = BusinessHours{
+	Timezone: defaultRulesTimezone,
+	Days:     []int{1, 2, 3, 4, 5},
+	From:     "09:00",
+	To:       "18:00",
+}
+
+type managerJobPayload struct {
+	LastUserMessage        string `json:"last_user_message"`
+	Reason                 string `json:"reason"`
+	QueuedAt               string `json:"queued_at"`
+	ManagerMessage         string `json:"manager_message"`
+	DirectorTimeoutMinutes int    `json:"director_timeout_minutes"`
+	DirectorMessage        string `json:"director_message"`
+	CallbackPhone          string `json:"callback_phone,omitempty"`
+}
+
+// NextOpen returns t when the calendar is open at t and otherwise the next
+// opening within two weeks, zero if there is none.
+func (b BusinessHours) NextOpen(t time.Time) time.Time {
+	if b.Open(t) {
+		return t
+	}
+	from, _ := parseClock(b.From)
+	local := t.In(b.location())
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	for i := 0; i <= 14; i++ {
+		open := day.AddDate(0, 0, i).Add(time.Duration(from) * time.Minute)
+		if open.After(t) && b.Open(open) {
+			return open
+		}
+	}
+	return time.Time{}
+}
+
+func (b BusinessHours) location() *time.Location {
+	loc, err := time.LoadLocation(b.timezone())
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+var weekdaysAccusative = [...]string{"в воскресенье", "в понедельник", "во вторник", "в среду", "в четверг", "в пятницу", "в субботу"}
+
+// describeOpening renders an opening time for the customer: "сегодня в 09:00",
+// "завтра в 09:00" or "в понедельник (20.10) в 09:00".
+func describeOpening(b BusinessHours, now, at time.Time) string {
+	loc := b.location()
+	now, at = now.In(loc), at.In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	clock := at.Format("15:04")
+	switch time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, loc).Sub(today) {
+	case 0:
+		return "сегодня в " + clock
+	case 24 * time.Hour:
+		return "завтра в " + clock
+	}
+	return fmt.Sprintf("%s (%s) в %s", weekdaysAccusative[at.Weekday()], at.Format("02.01"), clock)
+}
+
+func outOfHoursNotice(b BusinessHours, now, openAt time.Time) string {
+	return "Сейчас нерабочее время, менеджер ответит " + describeOpening(b, now, openAt) +
+		". Оставьте, пожалуйста, номер телефона — менеджер перезвонит."
+}
+
+// BusinessCalendar returns the stored business hours, or the default Mon–Fri
+// 09:00–18:00 in Asia/Almaty.
+func (s *Service) BusinessCalendar(ctx context.Context) (BusinessHours, error) {
+	if s.DB == nil {
+		return defaultBusinessHours, nil
+	}
+	var raw []byte
+	err := s.DB.Pool.QueryRow(ctx, `SELECT hours FROM business_calendar WHERE id = 1`).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return defaultBusinessHours, nil
+	}
+	if err != nil {
+		return defaultBusinessHours, err
+	}
+	var b BusinessHours
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return defaultBusinessHours, err
+	}
+	return b, nil
+}
+
+// SaveBusinessCalendar replaces the business hours. Invalid input fails with a
+// 400 *Error.
+func (s *Service) SaveBusinessCalendar(ctx context.Context, b BusinessHours) (BusinessHours, error) {
+	if s.DB == nil {
+		return b, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	if strings.TrimSpace(b.Timezone) == "" {
+		b.Timezone = defaultRulesTimezone
+	}
+	if err := b.validate(); err != nil {
+		return b, newError(http.StatusBadRequest, err.Error())
+	}
+	raw, _ := json.Marshal(b)
+	_, err := s.DB.Pool.Exec(ctx, `
+		INSERT INTO business_calendar (id, hours, updated_at) VALUES (1, $1, now())
+		ON CONFLICT (id) DO UPDATE SET hours = excluded.hours, updated_at = excluded.updated_at`, raw)
+	if err != nil {
+		return b, err
+	}
+	log.Printf("chat calendar: saved days=%v from=%s to=%s holidays=%d", b.Days, b.From, b.To, len(b.Holidays))
+	return b, nil
+}
+
+func (s *Service) calendar(ctx context.Context) BusinessHours {
+	b, err := s.BusinessCalendar(ctx)
+	if err != nil {
+		log.Printf("chat calendar: load failed, using defaults: %v", err)
+	}
+	return b
+}
+
+// deferToOpening queues the escalation for the next opening when the calendar
+// is closed and records that on state. It reports false when the escalation
+// should go out now.
+func (s *Service) deferToOpening(ctx context.Context, sessionID, userMessage, reason string, rule EscalationRule, state *escalationState) bool {
+	if rule.OutsideHours || s.DB == nil {
+		return false
+	}
+	cal := s.calendar(ctx)
+	now := time.Now()
+	openAt := cal.NextOpen(now)
+	if openAt.IsZero() || !openAt.After(now) {
+		return false
+	}
+	payload, _ := json.Marshal(managerJobPayload{
+		LastUserMessage:        userMessage,
+		Reason:                 reason,
+		QueuedAt:               now.UTC().Format(time.RFC3339),
+		ManagerMessage:         rule.ManagerMessage,
+		DirectorTimeoutMinutes: rule.DirectorTimeoutMinutes,
+		DirectorMessage:        rule.DirectorMessage,
+	})
+	_, err := s.DB.Pool.Exec(ctx, `
+		INSERT INTO escalation_jobs (kind, session_id, payload, run_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, kind) WHERE status IN ('pending', 'running') DO NOTHING`,
+		jobManagerEscalation, sessionID, payload, openAt)
+	if err != nil {
+		log.Printf("chat escalation: queue failed, notifying now session_id=%s err=%v", sessionID, err)
+		return false
+	}
+	state.QueuedUntil = openAt.UTC().Format(time.RFC3339)
+	state.LastReason = reason
+	state.RuleID = rule.ID
+	state.notice = outOfHoursNotice(cal, now, openAt)
+	log.Printf("chat escalation: out of hours, queued session_id=%s reason=%s run_at=%s", sessionID, reason, state.QueuedUntil)
+	return true
+}
+
+// resolveQueuedEscalation updates a queued state from the outcome of its
+// manager job and reports whether the escalation is still waiting. A sent job
+// marks the manager notified at the time of the notification; a cancelled or
+// failed one clears the queue so the rules can fire again.
+func (s *Service) resolveQueuedEscalation(ctx context.Context, sessionID string, state *escalationState) bool {
+	if s.DB == nil {
+		return false
+	}
+	var status string
+	var runAt time.Time
+	var sentAt time.Time
+	err := s.DB.Pool.QueryRow(ctx, `
+		SELECT j.status, j.run_at,
+		       coalesce((SELECT max(n.sent_at) FROM escalation_notifications n WHERE n.job_id = j.id AND n.level = 'manager'), j.updated_at)
+		FROM escalation_jobs j
+		WHERE j.session_id = $1 AND j.kind = $2
+		ORDER BY j.id DESC
+		LIMIT 1`, sessionID, jobManagerEscalation).Scan(&status, &runAt, &sentAt)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		status = "cancelled"
+	case err != nil:
+		// Better to stay queued than to page a manager twice.
+		log.Printf("chat escalation: queued job lookup failed session_id=%s err=%v", sessionID, err)
+		return true
+	}
+	switch status {
+	case "pending", "running":
+		state.QueuedUntil = runAt.UTC().Format(time.RFC3339)
+		return true
+	case "done":
+		state.ManagerNotifiedAt = sentAt.UTC().Format(time.RFC3339)
+		state.QueuedUntil = ""
+		return false
+	}
+	state.QueuedUntil = ""
+	state.LastReason = ""
+	state.RuleID = 0
+	return false
+}
+
+// runManagerJob sends an escalation queued out of hours, unless a manager has
+// answered in the meantime.
+func (s *Service) runManagerJob(ctx context.Context, job escalationJob) (string, error) {
+	var p managerJobPayload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return "failed", nil
+	}
+	if s.deferIfClosed(ctx, job) {
+		return "deferred", nil
+	}
+	history, err := s.fetchChatHistory(ctx, job.SessionID, 50)
+	if err != nil {
+		return "", err
+	}
+	if lastHumanAdminReply(history).After(parseTime(p.QueuedAt)) {
+		return "cancelled", nil
+	}
+	chatID, manager := s.escalationTarget(ctx, job.SessionID, p.LastUserMessage)
+	if chatID == 0 {
+		return "", errors.New("no manager available")
+	}
+	timeout, directorTpl := directorSLA(EscalationRule{DirectorTimeoutMinutes: p.DirectorTimeoutMinutes, DirectorMessage: p.DirectorMessage}, manager)
+	msg := "Обращение из нерабочего времени.\n" + renderTemplate(p.ManagerMessage, job.SessionID, p.LastUserMessage, timeout)
+	if p.CallbackPhone != "" {
+		msg += "\nПерезвонить: " + p.CallbackPhone
+	}
+	if err := s.notifyManager(ctx, chatID, job.SessionID, msg); err != nil {
+		return "", err
+	}
+	log.Printf("chat escalation: queued manager notified session_id=%s job_id=%d", job.SessionID, job.ID)
+	s.auditNotification(ctx, job.ID, job.SessionID, "manager", chatID, p.Reason, msg)
+	s.scheduleDirectorEscalation(ctx, job.SessionID, p.LastUserMessage, time.Now(), timeout, directorTpl)
+	return "done", nil
+}
+
+// deferIfClosed moves a due job to the next opening while the calendar is
+// closed, so nobody is paged at night.
+func (s *Service) deferIfClosed(ctx context.Context, job escalationJob) bool {
+	cal := s.calendar(ctx)
+	now := time.Now()
+	openAt := cal.NextOpen(now)
+	if openAt.IsZero() || !openAt.After(now) {
+		return false
+	}
+	_, err := s.DB.Pool.Exec(ctx, `
+		UPDATE escalation_jobs
+		SET status = 'pending', run_at = $2, attempts = attempts - 1, locked_until = NULL, updated_at = now()
+		WHERE id = $1`, job.ID, openAt)
+	if err != nil {
+		log.Printf("chat escalation: defer failed id=%d err=%v", job.ID, err)
+		return false
+	}
+	log.Printf("chat escalation: closed, job deferred id=%d kind=%s run_at=%s", job.ID, job.Kind, openAt.Format(time.RFC3339))
+	return true
+}
+
+// awaitedCallbackPhone returns the phone in userMessage when the previous
+// answer asked for a callback number.
+func awaitedCallbackPhone(history []chatMessageRow, userMessage string) string {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "assistant" {
+			continue
+		}
+		if !boolMeta(history[i].MetaData, "awaiting_callback_phone") {
+			return ""
+		}
+		return lead.ParsePhone(userMessage)
+	}
+	return ""
+}
+
+// replyCallbackPhone attaches the number to the queued escalation.
+func (s *Service) replyCallbackPhone(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, phone string, fromDBRelay bool) (*Result, error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	answer := "Спасибо! Менеджер перезвонит на " + phone + " в рабочее время."
+	var runAt time.Time
+	err := pgx.ErrNoRows
+	if s.DB != nil {
+		err = s.DB.Pool.QueryRow(ctx, `
+			UPDATE escalation_jobs SET payload = jsonb_set(payload, '{callback_phone}', to_jsonb($2::text)), updated_at = now()
+			WHERE session_id = $1 AND kind = $3 AND status = 'pending'
+			RETURNING run_at`, sessionID, phone, jobManagerEscalation).Scan(&runAt)
+	}
+	switch {
+	case err == nil:
+		answer = "Спасибо! Менеджер перезвонит на " + phone + " " + describeOpening(s.calendar(ctx), time.Now(), runAt) + "."
+	case errors.Is(err, pgx.ErrNoRows):
+		// The escalation already went out; tell the managers directly.
+		s.forwardToManager(ctx, sessionID, "перезвоните на "+phone)
+	default:
+		log.Printf("chat req=%s callback phone save failed: %v", reqID, err)
+		s.forwardToManager(ctx, sessionID, "перезвоните на "+phone)
+	}
+	log.Printf("chat req=%s callback phone session_id=%s queued=%t", reqID, sessionID, err == nil)
+	if sessionID != "" {
+		rows := make([]chatMessageInsert, 0, 2)
+		if !fromDBRelay {
+			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: mergeMeta(map[string]interface{}{"callback_phone": phone}, req.UserMeta)})
+		}
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: map[string]interface{}{}})
+		if err := s.insertChatMessages(ctx, rows); err != nil {
+			log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+		}
+		contact, changed := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+		s.captureLead(ctx, reqID, sessionID, contact, changed, []string{lead.IntentCallback}, 0)
+	}
+	return &Result{Response: ChatResponse{Answer: answer}}, nil
+}
@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const productPageURL = "https://apache.iq-home.kz/products/"
+
+// ProductCard is a product prepared for messengers that can show photos.
+type ProductCard struct {
+	ProductID int64
+	ImageURL  string
+	Caption   string
+}
+
+func ProductURL(id int64) string {
+	return productPageURL + strconv.FormatInt(id, 10)
+}
+
+func ProductCards(products []SupabaseMatch) []ProductCard {
+	out := make([]ProductCard, 0, len(products))
+	for _, p := range products {
+		out = append(out, ProductCard{
+			ProductID: p.ID,
+			ImageURL:  metaString(p.Metadata, "image_url"),
+			Caption:   productCaption(p),
+		})
+	}
+	return out
+}
+
+func productCaption(p SupabaseMatch) string {
+	lines := []string{extractProductName(p)}
+	if price := extractProductPrice(p); price > 0 {
+		lines = append(lines, "Цена: "+formatTenge(price))
+	}
+	if article := metaString(p.Metadata, "article"); article != "" {
+		lines = append(lines, "Артикул: "+article)
+	}
+	if avail := productAvailabilityText(p); avail != "" {
+		lines = append(lines, "Наличие: "+avail)
+	}
+	if label := analogueLabel(p); label != "" {
+		lines = append(lines, label)
+	}
+	lines = append(lines, ProductURL(p.ID))
+	return strings.Join(lines, "\n")
+}
+
+// formatTenge groups thousands with a space: 12 500 ₸.
+func formatTenge(v int64) string {
+	raw := strconv.FormatInt(v, 10)
+	var b strings.Builder
+	for i, r := range raw {
+		if i > 0 && (len(raw)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(r)
+	}
+	return b.String() + " ₸"
+}
+
+type productImageRow struct {
+	ProductID    int64   `json:"product_id"`
+	ImageURL     *string `json:"image_url"`
+	DisplayOrder int     `json:"display_order"`
+}
+
+// attachProductImages fills metadata "image_url" from product_images for products
+// the search did not return a picture for.
+func (s *Service) attachProductImages(ctx context.Context, products []SupabaseMatch) error {
+	var ids []int64
+	for _, p := range products {
+		if metaString(p.Metadata, "image_url") == "" {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	values.Set("select", "product_id,image_url,display_order")
+	values.Set("product_id", "in.("+joinIDs(ids)+")")
+	values.Set("order", "display_order.asc")
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/product_images?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []productImageRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return err
+	}
+	first := map[int64]string{}
+	for _, r := range rows {
+		if r.ImageURL == nil || strings.TrimSpace(*r.ImageURL) == "" {
+			continue
+		}
+		if _, ok := first[r.ProductID]; !ok {
+			first[r.ProductID] = *r.ImageURL
+		}
+	}
+	for i := range products {
+		img, ok := first[products[i].ID]
+		if !ok {
+			continue
+		}
+		if products[i].Metadata == nil {
+			products[i].Metadata = map[string]interface{}{}
+		}
+		products[i].Metadata["image_url"] = img
+	}
+	return nil
+}
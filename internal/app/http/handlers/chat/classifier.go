@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TurnScores is the classifier's reading of one customer message. It is stored
+// under "scores" in the user message metadata and feeds escalation triggers.
+type TurnScores struct {
+	Sentiment      float64 `json:"sentiment"`       // -1 negative .. 1 positive
+	Frustration    float64 `json:"frustration"`     // 0..1
+	PurchaseIntent float64 `json:"purchase_intent"` // 0..1
+	HumanRequest   float64 `json:"human_request"`   // 0..1, asks for a person
+}
+
+// SessionScores aggregates the scored turns of a session, see the
+// chat_session_scores view.
+type SessionScores struct {
+	SessionID         string    `json:"session_id"`
+	ScoredTurns       int       `json:"scored_turns"`
+	AvgSentiment      float64   `json:"avg_sentiment"`
+	MinSentiment      float64   `json:"min_sentiment"`
+	LastSentiment     float64   `json:"last_sentiment"`
+	AvgFrustration    float64   `json:"avg_frustration"`
+	MaxFrustration    float64   `json:"max_frustration"`
+	MaxPurchaseIntent float64   `json:"max_purchase_intent"`
+	MaxHumanRequest   float64   `json:"max_human_request"`
+	LastScoredAt      time.Time `json:"last_scored_at"`
+}
+
+const scoresSchema = `
+CREATE OR REPLACE VIEW chat_session_scores AS
+SELECT session_id,
+	count(*)::int AS scored_turns,
+	avg((meta_data->'scores'->>'sentiment')::float8) AS avg_sentiment,
+	min((meta_data->'scores'->>'sentiment')::float8) AS min_sentiment,
+	(array_agg((meta_data->'scores'->>'sentiment')::float8 ORDER BY created_at DESC))[1] AS last_sentiment,
+	avg((meta_data->'scores'->>'frustration')::float8) AS avg_frustration,
+	max((meta_data->'scores'->>'frustration')::float8) AS max_frustration,
+	max((meta_data->'scores'->>'purchase_intent')::float8) AS max_purchase_intent,
+	max((meta_data->'scores'->>'human_request')::float8) AS max_human_request,
+	max(created_at) AS last_scored_at
+FROM chat_messages
+WHERE role = 'user' AND meta_data ? 'scores'
+GROUP BY session_id;
+`
+
+// classifierTimeout keeps a slow classifier from holding up the answer; the
+// turn then simply goes unscored.
+const classifierTimeout = 8 * time.Second
+
+// turnScoringNeeded reports whether the turn should be classified: always with
+// TURN_SCORING=always, otherwise only when a rule that applies to the session
+// now has a score threshold.
+func (s *Service) turnScoringNeeded(rules []EscalationRule, sessionID string) bool {
+	if strings.EqualFold(strings.TrimSpace(s.Cfg.TurnScoring), "always") {
+		return true
+	}
+	for _, r := range applicableRules(rules, sessionID, time.Now()) {
+		if r.Trigger.usesScores() {
+			return true
+		}
+	}
+	return false
+}
+
+// startTurnClassifier scores the message in the background while the answer
+// is generated. The returned func waits for the result; it is nil when the
+// classifier is off or failed.
+func (s *Service) startTurnClassifier(ctx context.Context, reqID, userMessage string, history []chatMessageRow) func() *TurnScores {
+	if strings.EqualFold(strings.TrimSpace(s.Cfg.OpenAIClassifierModel), "off") {
+		return func() *TurnScores { return nil }
+	}
+	done := make(chan *TurnScores, 1)
+	go func() {
+		cctx, cancel := context.WithTimeout(ctx, classifierTimeout)
+		defer cancel()
+		start := time.Now()
+		scores, err := s.classifyTurn(cctx, userMessage, history)
+		if err != nil {
+			log.Printf("chat req=%s classifier failed: %v", reqID, err)
+		} else {
+			log.Printf("chat req=%s classifier ok sentiment=%.2f frustration=%.2f intent=%.2f human=%.2f took=%s",
+				reqID, scores.Sentiment, scores.Frustration, scores.PurchaseIntent, scores.HumanRequest, time.Since(start))
+		}
+		done <- scores
+	}()
+	return func() *TurnScores { return <-done }
+}
+
+func (s *Service) classifyTurn(ctx context.Context, userMessage string, history []chatMessageRow) (*TurnScores, error) {
+	system := "Ты оцениваешь последнее сообщение клиента интернет-магазина электрики с учётом контекста. Отвечай строго JSON без пояснений. Формат: {\"sentiment\": -1..1, \"frustration\": 0..1, \"purchase_intent\": 0..1, \"human_request\": 0..1}. sentiment — тон от негативного (-1) до позитивного (1). frustration — раздражение, недовольство ответами бота. purchase_intent — готовность купить. human_request — просит живого человека или менеджера."
+	var b strings.Builder
+	start := 0
+	if len(history) > 6 {
+		start = len(history) - 6
+	}
+	if start < len(history) {
+		b.WriteString("Контекст:\n")
+	}
+	for _, m := range history[start:] {
+		if strings.ToLower(strings.TrimSpace(m.Role)) == "assistant" {
+			b.WriteString("Ассистент: ")
+		} else {
+			b.WriteString("Клиент: ")
+		}
+		b.WriteString(truncateRunes(strings.TrimSpace(m.Content), 300))
+		b.WriteString("\n")
+	}
+	b.WriteString("\nСообщение клиента: ")
+	b.WriteString(userMessage)
+
+	payload := openAIChatRequest{
+		Model: s.Cfg.OpenAIClassifierModel,
+		Messages: []openAIChatMessage{
+			{Role: "system", Content: system},
+			{Role: "user", Content: b.String()},
+		},
+		MaxTokens:      60,
+		ResponseFormat: &openAIResponseFormat{Type: "json_object"},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	urlStr := strings.TrimRight(s.Cfg.OpenAIBaseURL, "/") + "/v1/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.OpenAIAPIKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return nil, fmt.Errorf("openai status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var out openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Choices) == 0 {
+		return nil, errors.New("empty openai response")
+	}
+	content := stripCodeFences(strings.TrimSpace(out.Choices[0].Message.Content))
+	var c TurnScores
+	if err := json.Unmarshal([]byte(content), &c); err != nil {
+		return nil, fmt.Errorf("invalid classification json: %w", err)
+	}
+	return &TurnScores{
+		Sentiment:      clampScore(c.Sentiment, -1, 1),
+		Frustration:    clampScore(c.Frustration, 0, 1),
+		PurchaseIntent: clampScore(c.PurchaseIntent, 0, 1),
+		HumanRequest:   clampScore(c.HumanRequest, 0, 1),
+	}, nil
+}
+
+func clampScore(v, lo, hi float64) float64 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// GetSessionScores returns the score aggregate of a session, nil when none of
+// its turns were scored.
+func (s *Service) GetSessionScores(ctx context.Context, sessionID string) (*SessionScores, error) {
+	if s.DB == nil {
+		return nil, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	var out SessionScores
+	err := s.DB.Pool.QueryRow(ctx, `
+		SELECT session_id, scored_turns, coalesce(avg_sentiment, 0), coalesce(min_sentiment, 0),
+		       coalesce(last_sentiment, 0), coalesce(avg_frustration, 0), coalesce(max_frustration, 0),
+		       coalesce(max_purchase_intent, 0), coalesce(max_human_request, 0), last_scored_at
+		FROM chat_session_scores
+		WHERE session_id = $1`, sessionID).Scan(&out.SessionID, &out.ScoredTurns, &out.AvgSentiment, &out.MinSentiment,
+		&out.LastSentiment, &out.AvgFrustration, &out.MaxFrustration, &out.MaxPurchaseIntent, &out.MaxHumanRequest,
+		&out.LastScoredAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
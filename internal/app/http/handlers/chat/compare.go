@@ -0,0 +1,339 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ComparisonTable struct {
+	Kind    string          `json:"kind"`
+	Columns []string        `json:"columns"`
+	Rows    []ComparisonRow `json:"rows"`
+	// Approximate lists the sides found by a partial match of the name
+	// instead of an exact one.
+	Approximate []string `json:"approximate,omitempty"`
+}
+
+type ComparisonRow struct {
+	Label  string   `json:"label"`
+	Values []string `json:"values"`
+}
+
+type comparisonRequest struct {
+	Kind  string
+	Left  string
+	Right string
+}
+
+type productSpecRow struct {
+	ID             int64    `json:"id"`
+	Article        *string  `json:"article"`
+	NameRaw        string   `json:"name_raw"`
+	Price          *float64 `json:"price"`
+	BrandName      *string  `json:"brand_name"`
+	ColorName      *string  `json:"color_name"`
+	SeriesName     *string  `json:"series_name"`
+	ProductType    *string  `json:"product_type"`
+	Material       *string  `json:"material"`
+	IPRating       *string  `json:"ip_rating"`
+	WarrantyMonths *int     `json:"warranty_months"`
+}
+
+// productSpecSelect is "*" because material, ip_rating and warranty_months
+// are not in every products_full deployment; naming a missing column makes
+// PostgREST reject the request, while absent fields just stay nil here.
+const productSpecSelect = "*"
+
+// compareSeriesTok is a series name, optionally after "серия": Latin letters
+// and digits ("FD", "G2"), or any word when "серия" names it explicitly.
+const compareSeriesTok = `((?:сери\p{L}*\s+)?[\p{L}0-9][\p{L}0-9\-]*)`
+
+var (
+	// compareSeriesREs are anchored on the comparison wording, so ordinary
+	// phrases joined by "и"/"с" are not read as two series.
+	compareSeriesREs = []*regexp.Regexp{
+		regexp.MustCompile(`чем\s+` + compareSeriesTok + `\s+(?:отлича\p{L}*|лучше|хуже)\s+(?:от\s+|чем\s+)?` + compareSeriesTok),
+		regexp.MustCompile(`(?:сравн\p{L}*|разниц\p{L}*(?:\s+между)?|отлича\p{L}*(?:\s+ли)?)\s+` + compareSeriesTok + `\s+(?:и|с|от|vs)\s+` + compareSeriesTok),
+		regexp.MustCompile(compareSeriesTok + `\s+(?:vs|против)\s+` + compareSeriesTok),
+		regexp.MustCompile(`лучше\s*[,:]?\s*` + compareSeriesTok + `\s+или\s+` + compareSeriesTok),
+		regexp.MustCompile(compareSeriesTok + `\s+или\s+` + compareSeriesTok + `\s*[,?]?\s*(?:что\s+|какая\s+)?лучше`),
+	}
+	compareSeriesPrefixRE = regexp.MustCompile(`^сери\p{L}*\s+`)
+	compareLatinRE        = regexp.MustCompile(`^[a-z0-9][a-z0-9\-]*$`)
+	compareWordRE         = regexp.MustCompile(`(?i)(отлича|сравн|разниц|лучше|\bvs\b)`)
+)
+
+func detectComparisonRequest(msg string) *comparisonRequest {
+	m := strings.TrimSpace(msg)
+	if m == "" || !compareWordRE.MatchString(m) {
+		return nil
+	}
+	if articles := extractDocumentArticles(m, 2); len(articles) == 2 {
+		return &comparisonRequest{Kind: "products", Left: articles[0], Right: articles[1]}
+	}
+	lower := strings.ToLower(m)
+	if !strings.Contains(lower, "сери") {
+		return nil
+	}
+	for _, re := range compareSeriesREs {
+		sub := re.FindStringSubmatch(lower)
+		if len(sub) < 3 {
+			continue
+		}
+		left, okLeft := comparisonSeries(sub[1], false)
+		// "сериями Этюд и Прима": a plural "серии" names both sides.
+		plural := strings.HasPrefix(sub[1], "серии ") || strings.HasPrefix(sub[1], "сериями ") || strings.HasPrefix(sub[1], "серий ")
+		right, okRight := comparisonSeries(sub[2], plural)
+		if okLeft && okRight && left != right {
+			return &comparisonRequest{Kind: "series", Left: left, Right: right}
+		}
+	}
+	return nil
+}
+
+// comparisonSeries normalizes a matched series token. Cyrillic words count
+// only when "серия" precedes them (or named is set), so "чем розетка
+// отличается" is no series.
+func comparisonSeries(tok string, named bool) (string, bool) {
+	name := compareSeriesPrefixRE.ReplaceAllString(tok, "")
+	if name == "" || isComparisonStopWord(name) {
+		return "", false
+	}
+	if name == tok && !named && !compareLatinRE.MatchString(name) {
+		return "", false
+	}
+	return strings.ToUpper(name), true
+}
+
+func isComparisonStopWord(w string) bool {
+	switch strings.ToLower(w) {
+	case "серия", "серии", "чем", "отличается", "отличаются", "сравни", "сравнить", "между", "разница", "и", "с", "от", "или", "ли", "vs":
+		return true
+	}
+	return false
+}
+
+// compareMinPartial is the shortest name looked up by a partial match when
+// nothing matches it exactly; "G" as a substring would match every series.
+const compareMinPartial = 3
+
+func (s *Service) handleComparison(ctx context.Context, cmp *comparisonRequest) (string, *ComparisonTable, error) {
+	if cmp.Kind != "series" && cmp.Kind != "products" {
+		return "", nil, fmt.Errorf("unknown comparison kind %q", cmp.Kind)
+	}
+	left, leftPartial, err := s.fetchComparisonSide(ctx, cmp.Kind, cmp.Left)
+	if err != nil {
+		return "", nil, err
+	}
+	right, rightPartial, err := s.fetchComparisonSide(ctx, cmp.Kind, cmp.Right)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(left) == 0 && len(right) == 0 {
+		return "", nil, nil
+	}
+	if len(left) == 0 || len(right) == 0 {
+		missing := cmp.Left
+		if len(right) == 0 {
+			missing = cmp.Right
+		}
+		return fmt.Sprintf("Не нашёл в каталоге «%s». Уточните название серии или артикул.", missing), nil, nil
+	}
+
+	table := buildComparisonTable(cmp, left, right)
+	if leftPartial {
+		table.Approximate = append(table.Approximate, cmp.Left)
+	}
+	if rightPartial {
+		table.Approximate = append(table.Approximate, cmp.Right)
+	}
+	return formatComparisonText(table), table, nil
+}
+
+// fetchComparisonSide loads one side of a comparison: the series whose name
+// is exactly name, or the product with exactly that article. Only when nothing
+// matches exactly is name looked up as a substring, and partial is set so the
+// answer can say so.
+func (s *Service) fetchComparisonSide(ctx context.Context, kind, name string) (rows []productSpecRow, partial bool, err error) {
+	field, exact, limit := "series_name", "ilike."+name, 200
+	if kind == "products" {
+		field, exact, limit = "article", "eq."+name, 1
+	}
+	rows, err = s.fetchProductSpecs(ctx, field, exact, limit)
+	if err != nil || len(rows) > 0 || utf8.RuneCountInString(name) < compareMinPartial {
+		return rows, false, err
+	}
+	rows, err = s.fetchProductSpecs(ctx, field, "ilike.*"+name+"*", limit)
+	return rows, len(rows) > 0, err
+}
+
+func (s *Service) fetchProductSpecs(ctx context.Context, field, filter string, limit int) ([]productSpecRow, error) {
+	values := url.Values{}
+	values.Set("select", productSpecSelect)
+	values.Set(field, filter)
+	values.Set("order", "price.asc")
+	values.Set("limit", strconv.Itoa(limit))
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/products_full?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []productSpecRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func buildComparisonTable(cmp *comparisonRequest, left, right []productSpecRow) *ComparisonTable {
+	table := &ComparisonTable{Kind: cmp.Kind}
+	sides := [][]productSpecRow{left, right}
+	if cmp.Kind == "products" {
+		for _, side := range sides {
+			table.Columns = append(table.Columns, side[0].NameRaw)
+		}
+	} else {
+		table.Columns = []string{"Серия " + cmp.Left, "Серия " + cmp.Right}
+	}
+
+	// Rows empty on both sides are left out: the catalog may not carry that
+	// spec at all.
+	row := func(label string, value func([]productSpecRow) string) {
+		r := ComparisonRow{Label: label}
+		known := false
+		for _, side := range sides {
+			v := value(side)
+			if v == "" {
+				v = "—"
+			} else {
+				known = true
+			}
+			r.Values = append(r.Values, v)
+		}
+		if known {
+			table.Rows = append(table.Rows, r)
+		}
+	}
+
+	if cmp.Kind == "products" {
+		row("Артикул", func(rows []productSpecRow) string { return derefString(rows[0].Article) })
+	}
+	row("Цена", func(rows []productSpecRow) string { return formatPriceRange(rows) })
+	row("Бренд", func(rows []productSpecRow) string {
+		return joinDistinct(rows, func(r productSpecRow) string { return derefString(r.BrandName) }, 3)
+	})
+	row("Материал", func(rows []productSpecRow) string {
+		return joinDistinct(rows, func(r productSpecRow) string { return derefString(r.Material) }, 3)
+	})
+	row("Цвета", func(rows []productSpecRow) string {
+		return joinDistinct(rows, func(r productSpecRow) string { return derefString(r.ColorName) }, 8)
+	})
+	row("Степень защиты", func(rows []productSpecRow) string {
+		return joinDistinct(rows, func(r productSpecRow) string { return derefString(r.IPRating) }, 3)
+	})
+	row("Гарантия", func(rows []productSpecRow) string {
+		return joinDistinct(rows, func(r productSpecRow) string {
+			if r.WarrantyMonths == nil || *r.WarrantyMonths <= 0 {
+				return ""
+			}
+			return fmt.Sprintf("%d мес.", *r.WarrantyMonths)
+		}, 3)
+	})
+	if cmp.Kind == "series" {
+		row("Позиций в каталоге", func(rows []productSpecRow) string { return strconv.Itoa(len(rows)) })
+	}
+	return table
+}
+
+func formatComparisonText(table *ComparisonTable) string {
+	if table == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Сравнение: ")
+	b.WriteString(strings.Join(table.Columns, " / "))
+	for _, r := range table.Rows {
+		b.WriteString("\n")
+		b.WriteString(r.Label)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(r.Values, " | "))
+	}
+	if len(table.Approximate) > 0 {
+		quoted := make([]string, len(table.Approximate))
+		for i, name := range table.Approximate {
+			quoted[i] = "«" + name + "»"
+		}
+		b.WriteString("\n\nТочного совпадения для " + strings.Join(quoted, " и ") + " нет — сравнил с ближайшим по названию, проверьте, то ли это.")
+	}
+	return b.String()
+}
+
+func formatPriceRange(rows []productSpecRow) string {
+	var lo, hi float64
+	found := false
+	for _, r := range rows {
+		if r.Price == nil || *r.Price <= 0 {
+			continue
+		}
+		if !found || *r.Price < lo {
+			lo = *r.Price
+		}
+		if !found || *r.Price > hi {
+			hi = *r.Price
+		}
+		found = true
+	}
+	if !found {
+		return ""
+	}
+	if lo == hi {
+		return fmt.Sprintf("%s ₸", formatQty(lo))
+	}
+	return fmt.Sprintf("%s–%s ₸", formatQty(lo), formatQty(hi))
+}
+
+func joinDistinct(rows []productSpecRow, value func(productSpecRow) string, max int) string {
+	seen := map[string]struct{}{}
+	out := make([]string, 0, max)
+	for _, r := range rows {
+		v := strings.TrimSpace(value(r))
+		if v == "" {
+			continue
+		}
+		key := strings.ToLower(v)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	if len(out) > max {
+		out = append(out[:max], "…")
+	}
+	return strings.Join(out, ", ")
+}
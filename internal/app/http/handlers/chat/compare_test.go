@@ -0,0 +1,52 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectComparisonRequest(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want *comparisonRequest
+	}{
+		{"Чем серия FD отличается от G?", &comparisonRequest{Kind: "series", Left: "FD", Right: "G"}},
+		{"сравни серии Этюд и Прима", &comparisonRequest{Kind: "series", Left: "ЭТЮД", Right: "ПРИМА"}},
+		{"серия FD vs серия G2", &comparisonRequest{Kind: "series", Left: "FD", Right: "G2"}},
+		{"что лучше, серия FD или серия FS?", &comparisonRequest{Kind: "series", Left: "FD", Right: "FS"}},
+		{"сравни 120345 и 120346", &comparisonRequest{Kind: "products", Left: "120345", Right: "120346"}},
+		{"чем розетка отличается от выключателя", nil},
+		{"чем серия FD отличается от серии FD", nil},
+		{"какая серия лучше для кухни", nil},
+		{"розетка и выключатель серии FD", nil},
+		{"привет", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			got := detectComparisonRequest(tt.msg)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || *got != *tt.want:
+				t.Errorf("detectComparisonRequest(%q) = %+v, want %+v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatComparisonTextFlagsPartialMatches(t *testing.T) {
+	table := &ComparisonTable{
+		Kind:        "series",
+		Columns:     []string{"Серия FD", "Серия GALA"},
+		Rows:        []ComparisonRow{{Label: "Цена", Values: []string{"1 200 ₸", "900 ₸"}}},
+		Approximate: []string{"GALA"},
+	}
+	text := formatComparisonText(table)
+	if !strings.Contains(text, "Точного совпадения для «GALA» нет") {
+		t.Errorf("text = %q, want the partial match flagged", text)
+	}
+	table.Approximate = nil
+	if text := formatComparisonText(table); strings.Contains(text, "Точного совпадения") {
+		t.Errorf("text = %q flags an exact match", text)
+	}
+}
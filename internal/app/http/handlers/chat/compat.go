@@ -0,0 +1,298 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"iq-home/go_beckend/internal/domain/compat"
+)
+
+// compatRulesTTL bounds how stale the series rules may get; every turn that
+// plans a set or validates a КП reads them.
+const compatRulesTTL = 5 * time.Minute
+
+var (
+	pointsRE = regexp.MustCompile(`(?i)(\d+)\s*(?:шт\.?\s*)?(розет|выключ|механизм|диммер|переключ|tv|rj45)`)
+	seriesRE = regexp.MustCompile(`(?i)сери[яиюейь]\s+([a-zа-я0-9][a-zа-я0-9\-]*)`)
+)
+
+// coverQueries maps the mechanism terms of pointsRE to the catalog query for
+// their cover.
+var coverQueries = map[string]string{
+	"розет":    "накладка для розетки",
+	"выключ":   "клавиша для выключателя",
+	"переключ": "клавиша для выключателя",
+	"диммер":   "накладка для диммера",
+	"tv":       "накладка для розетки TV",
+	"rj45":     "накладка для розетки RJ45",
+}
+
+type compatCache struct {
+	mu     sync.Mutex
+	rules  compat.Rules
+	loaded time.Time
+}
+
+// seriesCompatibilityRow is a row of series_compatibility, see
+// migrations/0003_series_compatibility.sql.
+type seriesCompatibilityRow struct {
+	Series        string              `json:"series"`
+	FramePosts    []int               `json:"frame_posts"`
+	FrameSeries   []string            `json:"frame_series"`
+	ColorFamilies map[string][]string `json:"color_families"`
+}
+
+func (s *Service) fetchCompatRules(ctx context.Context) (compat.Rules, error) {
+	values := url.Values{}
+	values.Set("select", "series,frame_posts,frame_series,color_families")
+	values.Set("limit", "500")
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/series_compatibility?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return compat.Rules{}, err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return compat.Rules{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return compat.Rules{}, fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []seriesCompatibilityRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return compat.Rules{}, err
+	}
+	rules := make([]compat.SeriesRule, 0, len(rows))
+	for _, r := range rows {
+		rules = append(rules, compat.SeriesRule{
+			Series:        r.Series,
+			FramePosts:    r.FramePosts,
+			FrameSeries:   r.FrameSeries,
+			ColorFamilies: r.ColorFamilies,
+		})
+	}
+	return compat.NewRules(rules), nil
+}
+
+// compatRules returns the series rules, loading them at most once per
+// compatRulesTTL. The fetch runs without the lock, so a slow Supabase does not
+// hold up every other turn; concurrent reloads just store the same rules.
+func (s *Service) compatRules(ctx context.Context) (compat.Rules, error) {
+	s.compat.mu.Lock()
+	if s.compat.rules.Series != nil && time.Since(s.compat.loaded) < compatRulesTTL {
+		rules := s.compat.rules
+		s.compat.mu.Unlock()
+		return rules, nil
+	}
+	s.compat.mu.Unlock()
+
+	rules, err := s.fetchCompatRules(ctx)
+	if err != nil {
+		return compat.Rules{}, err
+	}
+	s.compat.mu.Lock()
+	s.compat.rules, s.compat.loaded = rules, time.Now()
+	s.compat.mu.Unlock()
+	return rules, nil
+}
+
+func compatLinesFromProducts(products []SupabaseMatch) []compat.Line {
+	out := make([]compat.Line, 0, len(products))
+	for _, p := range products {
+		l := compat.Line{ProductID: p.ID, Name: extractProductName(p), Qty: 1}
+		if p.Metadata != nil {
+			l.Type = metaString(p.Metadata, "type")
+			l.Series = metaString(p.Metadata, "series")
+			l.Color = metaString(p.Metadata, "color")
+			if q, ok := p.Metadata["qty"]; ok {
+				l.Qty = parseIntDefault(toString(q), 1)
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func compatNotes(rules compat.Rules, message string, products []SupabaseMatch) []string {
+	points := countRequestedPoints(message)
+	if points == 0 {
+		return nil
+	}
+	series := detectSeries(message)
+	if series == "" {
+		series = dominantSeries(products)
+	}
+	if text := rules.PlanFrames(series, points).Text(); text != "" {
+		return []string{"Комплектация: " + text + ". Механизмы, накладки и рамки должны быть одной серии и цветовой гаммы."}
+	}
+	return nil
+}
+
+// completeSet adds the frames and covers the requested points need, in the
+// requested (or dominant) series and color, unless products already have them.
+func (s *Service) completeSet(ctx context.Context, reqID string, rules compat.Rules, message string, products []SupabaseMatch) []SupabaseMatch {
+	lower := strings.ToLower(message)
+	points := countRequestedPoints(lower)
+	if points == 0 {
+		return products
+	}
+	series := detectSeries(message)
+	if series == "" {
+		series = dominantSeries(products)
+	}
+	color := ""
+	if slots := extractSlots(message); slots != nil {
+		color = slots["last_color"]
+	}
+	have := map[compat.Kind]bool{}
+	seen := map[int64]bool{}
+	for _, p := range products {
+		have[compat.KindOf(metaString(p.Metadata, "type"), extractProductName(p))] = true
+		seen[p.ID] = true
+	}
+
+	var queries []string
+	if !have[compat.KindFrame] {
+		sizes := map[int]bool{}
+		for _, posts := range rules.PlanFrames(series, points).Frames {
+			if !sizes[posts] {
+				sizes[posts] = true
+				queries = append(queries, fmt.Sprintf("рамка %d %s", posts, compat.Plural(posts, "пост", "поста", "постов")))
+			}
+		}
+	}
+	if !have[compat.KindCover] {
+		added := map[string]bool{}
+		for _, m := range pointsRE.FindAllStringSubmatch(lower, -1) {
+			if q := coverQueries[m[2]]; q != "" && !added[q] {
+				added[q] = true
+				queries = append(queries, q)
+			}
+		}
+	}
+
+	out := products
+	for _, q := range queries {
+		p, err := s.findSetProduct(ctx, q, compat.KindOf("", q), series, color)
+		if err != nil {
+			log.Printf("chat req=%s set completion %q failed: %v", reqID, q, err)
+			continue
+		}
+		if p == nil || seen[p.ID] {
+			continue
+		}
+		seen[p.ID] = true
+		out = append(out, *p)
+	}
+	if len(out) > len(products) {
+		log.Printf("chat req=%s set completed series=%s added=%d", reqID, series, len(out)-len(products))
+	}
+	return out
+}
+
+func countRequestedPoints(message string) int {
+	total := 0
+	for _, m := range pointsRE.FindAllStringSubmatch(strings.ToLower(message), -1) {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n <= 0 || n > 200 {
+			continue
+		}
+		total += n
+	}
+	return total
+}
+
+func detectSeries(message string) string {
+	m := seriesRE.FindStringSubmatch(message)
+	if len(m) < 2 {
+		return ""
+	}
+	return strings.ToUpper(strings.TrimSpace(m[1]))
+}
+
+// findSetProduct picks the priced catalog product for query that best matches
+// series and color. Candidates of another kind are skipped when kind is known.
+func (s *Service) findSetProduct(ctx context.Context, query string, kind compat.Kind, series, color string) (*SupabaseMatch, error) {
+	candidates, err := s.searchProductsFallback(ctx, strings.TrimSpace(query+" "+series), 10)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		candidates, err = s.searchProductsFallback(ctx, query, 10)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.attachAvailability(ctx, candidates); err != nil {
+		log.Printf("chat set: stock lookup failed: %v", err)
+	}
+	var best *SupabaseMatch
+	bestScore := -1
+	for i := range candidates {
+		p := candidates[i]
+		if extractProductPrice(p) <= 0 {
+			continue
+		}
+		if kind != compat.KindUnknown && compat.KindOf(metaString(p.Metadata, "type"), extractProductName(p)) != kind {
+			continue
+		}
+		name := strings.ToLower(extractProductName(p))
+		score := 0
+		if series != "" && (strings.Contains(name, strings.ToLower(series)) || strings.EqualFold(metaString(p.Metadata, "series"), series)) {
+			score += 2
+		}
+		if color != "" && (strings.Contains(name, color) || strings.Contains(strings.ToLower(metaString(p.Metadata, "color")), color)) {
+			score++
+		}
+		if score > bestScore {
+			best = &candidates[i]
+			bestScore = score
+		}
+	}
+	return best, nil
+}
+
+func dominantSeries(products []SupabaseMatch) string {
+	counts := map[string]int{}
+	best := ""
+	for _, p := range products {
+		series := metaString(p.Metadata, "series")
+		if series == "" {
+			continue
+		}
+		counts[series]++
+		if counts[series] > counts[best] {
+			best = series
+		}
+	}
+	return best
+}
+
+func metaString(meta map[string]interface{}, key string) string {
+	if meta == nil {
+		return ""
+	}
+	v, ok := meta[key]
+	if !ok || v == nil {
+		return ""
+	}
+	return strings.TrimSpace(toString(v))
+}
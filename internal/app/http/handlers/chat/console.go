@@ -0,0 +1,177 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Manager console: escalations reach the manager Telegram chat with a
+// "Взять диалог" button, and every console message starts with "Чат <session>"
+// so that a manager's reply can be routed back without extra state.
+
+const actionTakePrefix = "take:"
+
+func ActionTakeDialog(sessionID string) string {
+	return actionTakePrefix + sessionID
+}
+
+// TakeDialogSession returns the session of a "Взять диалог" button payload.
+func TakeDialogSession(action string) (string, bool) {
+	if !strings.HasPrefix(action, actionTakePrefix) {
+		return "", false
+	}
+	sid := strings.TrimSpace(strings.TrimPrefix(action, actionTakePrefix))
+	return sid, sid != ""
+}
+
+var consoleSessionRe = regexp.MustCompile(`(?m)^Чат (\S+)$`)
+
+func ConsoleText(sessionID, text string) string {
+	return "Чат " + sessionID + "\n" + text
+}
+
+// ConsoleSession finds the session a console message is about.
+func ConsoleSession(text string) string {
+	m := consoleSessionRe.FindStringSubmatch(text)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// notifyManager sends an escalation to the manager chat with the button that
+// hands the dialog over.
+func (s *Service) notifyManager(ctx context.Context, chatID int64, sessionID, text string) error {
+	if ConsoleSession(text) != sessionID {
+		text = ConsoleText(sessionID, text)
+	}
+	return s.postTelegram(ctx, map[string]interface{}{
+		"chat_id": chatID,
+		"text":    text,
+		"reply_markup": map[string]interface{}{"inline_keyboard": [][]map[string]string{{
+			{"text": "Взять диалог", "callback_data": ActionTakeDialog(sessionID)},
+		}}},
+	})
+}
+
+// forwardToManager shows a customer message of a session in human mode in the
+// manager chat.
+func (s *Service) forwardToManager(ctx context.Context, sessionID, text string) {
+	chatID, ok := parseChatID(s.Cfg.ManagerChatID)
+	if !ok || strings.TrimSpace(text) == "" {
+		return
+	}
+	if err := s.sendTelegramToChat(ctx, chatID, ConsoleText(sessionID, "Клиент: "+text)); err != nil {
+		log.Printf("chat console: forward failed session_id=%s err=%v", sessionID, err)
+	}
+}
+
+// SetHumanMode switches the AI off (true) or back on (false) for a session.
+func (s *Service) SetHumanMode(ctx context.Context, sessionID string, on bool) error {
+	if err := s.ensureChatSession(ctx, sessionID, ""); err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"is_human_mode": on,
+		"updated_at":    time.Now().UTC().Format(time.RFC3339),
+	})
+	values := url.Values{}
+	values.Set("session_id", "eq."+sessionID)
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/chat_sessions?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Prefer", "return=minimal")
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// MirrorManagerReply stores a manager's console message as a human_admin turn.
+// The manager relay delivers it to the customer like any admin panel reply.
+func (s *Service) MirrorManagerReply(ctx context.Context, sessionID, manager, text string) error {
+	return s.insertChatMessages(ctx, []chatMessageInsert{{
+		SessionID:  sessionID,
+		Role:       "assistant",
+		Content:    text,
+		SenderType: "human_admin",
+		MetaData:   map[string]interface{}{"manager": manager, "source": "telegram_console"},
+	}})
+}
+
+// Transcript renders the last messages of a session for the manager who takes
+// the dialog.
+func (s *Service) Transcript(ctx context.Context, sessionID string, limit int) (string, error) {
+	values := url.Values{}
+	values.Set("select", "role,content,meta_data,created_at,sender_type")
+	values.Set("session_id", "eq."+sessionID)
+	values.Set("order", "created_at.desc")
+	values.Set("limit", strconv.Itoa(limit))
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/chat_messages?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return "", fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []chatMessageRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return "", err
+	}
+	lines := make([]string, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		who := "Бот"
+		switch {
+		case rows[i].SenderType == "human_admin" || rows[i].SenderType == "manager":
+			who = "Менеджер"
+		case rows[i].Role == "user":
+			who = "Клиент"
+		}
+		lines = append(lines, who+": "+truncateRunes(strings.TrimSpace(rows[i].Content), 300))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
@@ -0,0 +1,250 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"iq-home/go_beckend/internal/domain/lead"
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+// Contacts: phone, email, name and city found in customer messages (or shared
+// with Telegram's contact button) are kept on chat_sessions.contact and put on
+// every КП built for the session. When a КП is requested before a phone number
+// is known, the bot asks for one once and builds the КП with the reply.
+
+const contactSchema = `
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS contact jsonb NOT NULL DEFAULT '{}'::jsonb;
+`
+
+// sharedContactKey is the user meta key channels put a shared contact under.
+const sharedContactKey = "shared_contact"
+
+func contactMeta(c quote.Customer) map[string]string {
+	out := map[string]string{}
+	for k, v := range map[string]string{"name": c.Name, "phone": c.Phone, "email": c.Email, "city": c.City} {
+		if v != "" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func contactFromMap(m map[string]string) quote.Customer {
+	return quote.Customer{Name: m["name"], Phone: lead.NormalizePhone(m["phone"]), Email: m["email"], City: m["city"]}
+}
+
+// sharedContact returns the contact a channel attached to the request.
+func sharedContact(meta map[string]interface{}) quote.Customer {
+	raw, ok := meta[sharedContactKey].(map[string]interface{})
+	if !ok {
+		return quote.Customer{}
+	}
+	m := map[string]string{}
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			m[k] = strings.TrimSpace(s)
+		}
+	}
+	return contactFromMap(m)
+}
+
+// verifiedPhone returns a number the messenger vouches for: the one a WhatsApp
+// session is keyed by, or the sender's own contact shared in a Telegram
+// session, now or earlier. Numbers typed into the chat are never verified.
+func verifiedPhone(sessionID string, history []chatMessageRow, meta map[string]interface{}) string {
+	switch {
+	case strings.HasPrefix(sessionID, "wa:"):
+		return lead.NormalizePhone(strings.TrimPrefix(sessionID, "wa:"))
+	case !strings.HasPrefix(sessionID, "tg:"):
+		return ""
+	}
+	if phone := ownSharedPhone(meta); phone != "" {
+		return phone
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "user" {
+			continue
+		}
+		if phone := ownSharedPhone(history[i].MetaData); phone != "" {
+			return phone
+		}
+	}
+	return ""
+}
+
+func ownSharedPhone(meta map[string]interface{}) string {
+	raw, ok := meta[sharedContactKey].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if own, _ := raw["own"].(bool); !own {
+		return ""
+	}
+	phone, _ := raw["phone"].(string)
+	return lead.NormalizePhone(phone)
+}
+
+func (s *Service) sessionContact(ctx context.Context, sessionID string) (quote.Customer, error) {
+	if s.DB == nil || sessionID == "" {
+		return quote.Customer{}, nil
+	}
+	var raw []byte
+	err := s.DB.Pool.QueryRow(ctx, `SELECT contact FROM chat_sessions WHERE session_id = $1`, sessionID).Scan(&raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return quote.Customer{}, nil
+	}
+	if err != nil {
+		return quote.Customer{}, err
+	}
+	var m map[string]string
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return quote.Customer{}, err
+	}
+	return contactFromMap(m), nil
+}
+
+// updateSessionContact merges the details of the current message into the
+// session's contact and reports whether anything new was learned. Gaps are
+// filled from earlier messages, newest first, for sessions that started
+// before the contact was stored.
+func (s *Service) updateSessionContact(ctx context.Context, reqID, sessionID string, history []chatMessageRow, req ChatRequest) (quote.Customer, bool) {
+	stored, err := s.sessionContact(ctx, sessionID)
+	if err != nil {
+		log.Printf("chat req=%s session contact load failed: %v", reqID, err)
+	}
+	c := stored
+	for i := len(history) - 1; i >= 0 && (c.Name == "" || c.Phone == "" || c.Email == "" || c.City == ""); i-- {
+		if history[i].Role != "user" {
+			continue
+		}
+		c = lead.MergeContact(lead.ParseContact(history[i].Content), c)
+	}
+	c = lead.MergeContact(c, lead.ParseContact(req.Message))
+	c = lead.MergeContact(c, sharedContact(req.UserMeta))
+	if c == stored {
+		return c, false
+	}
+	if s.DB != nil && sessionID != "" {
+		raw, _ := json.Marshal(contactMeta(c))
+		if _, err := s.DB.Pool.Exec(ctx, `UPDATE chat_sessions SET contact = $2 WHERE session_id = $1`, sessionID, raw); err != nil {
+			log.Printf("chat req=%s session contact save failed: %v", reqID, err)
+		}
+	}
+	log.Printf("chat req=%s session contact updated session_id=%s fields=%d", reqID, sessionID, len(contactMeta(c)))
+	return c, true
+}
+
+// contactAsked reports whether the bot already asked this session for a
+// contact; it asks only once.
+func contactAsked(history []chatMessageRow) bool {
+	for _, m := range history {
+		if m.Role == "assistant" && boolMeta(m.MetaData, "awaiting_contact") {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitingContact reports whether the last bot message asked for a contact.
+func awaitingContact(history []chatMessageRow) bool {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "assistant" {
+			return boolMeta(history[i].MetaData, "awaiting_contact")
+		}
+	}
+	return false
+}
+
+func declinesContact(text string) bool {
+	t := strings.ToLower(strings.TrimSpace(text))
+	if t == "нет" || t == "не" {
+		return true
+	}
+	for _, p := range []string{"без контакт", "без номера", "не хочу", "не надо", "не буду", "пропуст"} {
+		if strings.Contains(t, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// askContact holds the КП back and asks for a phone number. The products wait
+// in the КП list, so a later "Собрать КП" finds them too.
+func (s *Service) askContact(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, products []SupabaseMatch, fromDBRelay bool) *Result {
+	sessionID := strings.TrimSpace(req.SessionID)
+	answer := "Оформлю КП на вас: напишите, пожалуйста, имя и номер телефона, можно также город и email — менеджер свяжется по КП. " +
+		"Если не хотите оставлять контакт, напишите «без контакта»."
+	if strings.HasPrefix(sessionID, "tg:") {
+		answer += " В Telegram можно нажать «Поделиться контактом»."
+	}
+	userMeta := map[string]interface{}{}
+	if hasKPOffered(history) {
+		userMeta["kp_accept"] = true
+	}
+	if req.Action != "" {
+		userMeta["action"] = req.Action
+	}
+	assistantMeta := map[string]interface{}{"awaiting_contact": true, "quote_ids": collectProductIDs(products)}
+	rows := make([]chatMessageInsert, 0, 2)
+	if !fromDBRelay {
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: mergeMeta(userMeta, req.UserMeta)})
+	}
+	rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
+	if err := s.insertChatMessages(ctx, rows); err != nil {
+		log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+	}
+	log.Printf("chat req=%s contact requested session_id=%s products=%d", reqID, sessionID, len(products))
+	return &Result{Response: ChatResponse{Answer: answer, RequestContact: true}}
+}
+
+// replyContact handles the answer to askContact and contacts shared with the
+// messenger's button. ok is false when the message is something else and
+// should go through the normal pipeline.
+func (s *Service) replyContact(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, fromDBRelay bool) (res *Result, ok bool, err error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	shared := sharedContact(req.UserMeta)
+	found := lead.MergeContact(lead.ParseContact(req.Message), shared)
+	awaiting := awaitingContact(history)
+	if awaiting && (found.Phone != "" || found.Email != "" || declinesContact(req.Message)) {
+		if ids := latestQuoteIDs(history); len(ids) > 0 {
+			products, err := s.fetchProductsByIDs(ctx, ids)
+			if err != nil {
+				log.Printf("chat req=%s contact quote products load failed: %v", reqID, err)
+				return nil, true, newError(http.StatusBadGateway, "products lookup failed")
+			}
+			if len(products) > 0 {
+				if err := s.attachAvailability(ctx, products); err != nil {
+					log.Printf("chat req=%s stock lookup failed: %v", reqID, err)
+				}
+				res, err := s.replyQuote(ctx, reqID, req, history, products, nil, fromDBRelay)
+				return res, true, err
+			}
+		}
+	}
+	// Typed numbers outside the КП flow stay part of the message; the normal
+	// pipeline records them. Only a shared contact is answered here.
+	if shared.Phone == "" {
+		return nil, false, nil
+	}
+	contact, changed := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+	answer := "Спасибо, записал ваш контакт — менеджер сможет с вами связаться."
+	if sessionID != "" {
+		rows := make([]chatMessageInsert, 0, 2)
+		if !fromDBRelay {
+			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: mergeMeta(nil, req.UserMeta)})
+		}
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: map[string]interface{}{"contact": contactMeta(contact)}})
+		if err := s.insertChatMessages(ctx, rows); err != nil {
+			log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+		}
+		s.captureLead(ctx, reqID, sessionID, contact, changed, nil, 0)
+	}
+	return &Result{Response: ChatResponse{Answer: answer}}, true, nil
+}
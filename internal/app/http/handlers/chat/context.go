@@ -2,7 +2,7 @@ package chat
 
 import "strings"
 
-func buildContext(history []chatMessageRow, products []SupabaseMatch, knowledge []SupabaseMatch, behavior *userBehaviorContext) string {
+func buildContext(history []chatMessageRow, products []SupabaseMatch, knowledge []SupabaseMatch, behavior *userBehaviorContext, notes []string) string {
 	var b strings.Builder
 
 	summary := latestSummary(history)
@@ -75,11 +75,28 @@ func buildContext(history []chatMessageRow, products []SupabaseMatch, knowledge
 					b.WriteString(" | Бренд: ")
 					b.WriteString(toString(brand))
 				}
+				if label := analogueLabel(p); label != "" {
+					b.WriteString(" | ")
+					b.WriteString(label)
+				}
+				if avail := productAvailabilityText(p); avail != "" {
+					b.WriteString(" | Наличие: ")
+					b.WriteString(avail)
+				}
 			}
 			b.WriteString("\n")
 		}
 	}
 
+	if len(notes) > 0 {
+		b.WriteString("\nПодсказки:\n")
+		for _, n := range notes {
+			b.WriteString("- ")
+			b.WriteString(n)
+			b.WriteString("\n")
+		}
+	}
+
 	if len(knowledge) == 0 {
 		b.WriteString("\nМетодички: не найдено.\n")
 	} else {
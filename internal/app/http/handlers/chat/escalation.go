@@ -13,172 +13,150 @@ import (
 	"time"
 )
 
-type escalationRule struct {
-	Type     string                 `json:"type"`
-	Manager  escalationManagerRule  `json:"manager"`
-	Director escalationDirectorRule `json:"director"`
-}
-
-type escalationManagerRule struct {
-	Trigger escalationTrigger `json:"trigger"`
-	Message string            `json:"message_template"`
-}
-
-type escalationDirectorRule struct {
-	TimeoutMinutes int    `json:"timeout_minutes"`
-	Message        string `json:"message_template"`
-}
+type escalationState struct {
+	ManagerNotifiedAt string `json:"manager_notified_at,omitempty"`
+	LastReason        string `json:"last_escalation_reason,omitempty"`
+	LastClarifyCount  int    `json:"last_clarify_count,omitempty"`
+	RuleID            int64  `json:"rule_id,omitempty"`
+	ManagerID         int64  `json:"manager_id,omitempty"`
+	ManagerName       string `json:"manager_name,omitempty"`
+	SLAMinutes        int    `json:"sla_minutes,omitempty"`
+	QueuedUntil       string `json:"queued_until,omitempty"`
 
-type escalationTrigger struct {
-	MaxConsecutiveClarifyQuestions int      `json:"max_consecutive_clarify_questions"`
-	NegativeKeywords               []string `json:"negative_keywords"`
+	// notice is told to the customer when the escalation was queued this turn.
+	notice string
 }
 
-type escalationState struct {
-	ManagerNotifiedAt  string `json:"manager_notified_at,omitempty"`
-	DirectorNotifiedAt string `json:"director_notified_at,omitempty"`
-	LastReason         string `json:"last_escalation_reason,omitempty"`
-	LastClarifyCount   int    `json:"last_clarify_count,omitempty"`
+// escalationSignals is what rule triggers look at for the current turn.
+type escalationSignals struct {
+	UserMessage string
+	Answer      string
+	NoProducts  bool // a product search ran and found nothing
+	QuoteTotal  int64
+	Scores      *TurnScores // nil when the turn was not classified
 }
 
-func (s *Service) fetchEscalationRule(ctx context.Context, vector string) (*escalationRule, error) {
-	payload := map[string]interface{}{
-		"query_embedding": vector,
-		"match_threshold": 0.2,
-		"match_count":     1,
-		"filter": map[string]interface{}{
-			"topic": "escalation_rule",
-		},
-	}
-	var matches []SupabaseMatch
-	if err := s.callSupabaseRPC(ctx, "match_sales_knowledge", payload, &matches); err != nil {
-		return nil, err
-	}
-	if len(matches) == 0 {
-		return nil, nil
+// maybeEscalate notifies a manager when a rule triggers. The director is only
+// ever told by the director_escalation job scheduled here, see
+// runDirectorJob.
+func (s *Service) maybeEscalate(ctx context.Context, sessionID string, history []chatMessageRow, rules []EscalationRule, sig escalationSignals) *escalationState {
+	if len(rules) == 0 {
+		return nil
 	}
-	raw := strings.TrimSpace(matches[0].Content)
-	if raw == "" || !strings.Contains(raw, "{") {
-		return nil, nil
+	state, queued := s.currentEscalation(ctx, sessionID, history)
+	// A queued escalation is sent by its job at opening time.
+	if queued {
+		return state
 	}
-	var rule escalationRule
-	if err := json.Unmarshal([]byte(raw), &rule); err != nil {
-		return nil, nil
+
+	clarifyCount := 0
+	if sig.Answer != "" {
+		clarifyCount = countConsecutiveClarify(history, sig.Answer)
 	}
-	if strings.TrimSpace(rule.Type) != "escalation_rule" {
-		return nil, nil
+	state.LastClarifyCount = clarifyCount
+	failedSearches := countFailedSearches(history, sig.NoProducts)
+
+	if state.ManagerNotifiedAt == "" {
+		for _, rule := range applicableRules(rules, sessionID, time.Now()) {
+			triggered, reason := rule.Trigger.evaluate(sig, clarifyCount, failedSearches)
+			if !triggered {
+				continue
+			}
+			s.escalate(ctx, sessionID, sig.UserMessage, reason, rule, state)
+			break
+		}
 	}
-	return &rule, nil
+
+	return state
 }
 
-func (s *Service) maybeEscalate(ctx context.Context, sessionID, userMessage, answer string, history []chatMessageRow, rule *escalationRule) *escalationState {
-	if rule == nil {
-		return nil
-	}
-	chatID, ok := parseChatID(s.Cfg.ManagerChatID)
-	if !ok || chatID == 0 {
-		log.Printf("chat escalation: manager chat id missing")
-		return nil
-	}
+// currentEscalation returns the session's escalation state as of now: it is
+// reset once a manager replied after the notification, and a queued
+// escalation takes the outcome of its manager job. queued reports that the
+// escalation still waits for opening time.
+func (s *Service) currentEscalation(ctx context.Context, sessionID string, history []chatMessageRow) (*escalationState, bool) {
 	state := latestEscalationState(history)
 	if state == nil {
 		state = &escalationState{}
 	}
-
 	lastManagerReply := lastHumanAdminReply(history)
 	if state.ManagerNotifiedAt != "" && lastManagerReply.After(parseTime(state.ManagerNotifiedAt)) {
 		state.ManagerNotifiedAt = ""
-		state.DirectorNotifiedAt = ""
 		state.LastReason = ""
 		state.LastClarifyCount = 0
+		state.RuleID = 0
+		state.ManagerID = 0
+		state.ManagerName = ""
+		state.SLAMinutes = 0
+		state.QueuedUntil = ""
 	}
-
-	clarifyCount := countConsecutiveClarify(history, answer)
-	state.LastClarifyCount = clarifyCount
-
-	triggered, reason := shouldTriggerManager(userMessage, clarifyCount, rule.Manager.Trigger)
-	if triggered && state.ManagerNotifiedAt == "" {
-		msg := renderTemplate(rule.Manager.Message, sessionID, userMessage, rule.Director.TimeoutMinutes)
-		if err := s.sendTelegramToChat(ctx, chatID, msg); err != nil {
-			log.Printf("chat escalation: manager notify failed: %v", err)
-		} else {
-			state.ManagerNotifiedAt = time.Now().UTC().Format(time.RFC3339)
-			state.LastReason = reason
-			log.Printf("chat escalation: manager notified session_id=%s reason=%s", sessionID, reason)
-			s.scheduleDirectorEscalation(sessionID, userMessage, parseTime(state.ManagerNotifiedAt), rule)
-		}
+	if state.ManagerNotifiedAt == "" && state.QueuedUntil != "" && s.resolveQueuedEscalation(ctx, sessionID, state) {
+		return state, true
 	}
-
-	if state.ManagerNotifiedAt != "" && state.DirectorNotifiedAt == "" && rule.Director.TimeoutMinutes > 0 {
-		directorID, ok := parseChatID(s.Cfg.DirectorChatID)
-		if ok && directorID != 0 {
-			managerAt := parseTime(state.ManagerNotifiedAt)
-			if !managerAt.IsZero() && time.Since(managerAt) >= time.Duration(rule.Director.TimeoutMinutes)*time.Minute {
-				if lastManagerReply.IsZero() || lastManagerReply.Before(managerAt) {
-					msg := renderTemplate(rule.Director.Message, sessionID, userMessage, rule.Director.TimeoutMinutes)
-					if err := s.sendTelegramToChat(ctx, directorID, msg); err != nil {
-						log.Printf("chat escalation: director notify failed: %v", err)
-					} else {
-						state.DirectorNotifiedAt = time.Now().UTC().Format(time.RFC3339)
-						log.Printf("chat escalation: director notified session_id=%s", sessionID)
-					}
-				}
-			}
-		}
-	}
-
-	return state
+	return state, false
 }
 
-func (s *Service) scheduleDirectorEscalation(sessionID, lastUserMessage string, managerAt time.Time, rule *escalationRule) {
-	if rule == nil || rule.Director.TimeoutMinutes <= 0 || managerAt.IsZero() {
-		return
+// escalate hands the session to a manager for reason: it queues the
+// notification until opening time or assigns a manager, notifies them and
+// schedules the director follow-up. It reports false when nobody could be
+// notified.
+func (s *Service) escalate(ctx context.Context, sessionID, userMessage, reason string, rule EscalationRule, state *escalationState) bool {
+	if s.deferToOpening(ctx, sessionID, userMessage, reason, rule, state) {
+		return true
+	}
+	chatID, manager := s.escalationTarget(ctx, sessionID, userMessage)
+	if chatID == 0 {
+		log.Printf("chat escalation: no manager available and manager chat id missing session_id=%s", sessionID)
+		return false
 	}
-	directorID, ok := parseChatID(s.Cfg.DirectorChatID)
-	if !ok || directorID == 0 {
-		return
+	timeout, directorTpl := directorSLA(rule, manager)
+	msg := renderTemplate(rule.ManagerMessage, sessionID, userMessage, timeout)
+	if err := s.notifyManager(ctx, chatID, sessionID, msg); err != nil {
+		log.Printf("chat escalation: manager notify failed: %v", err)
+		return false
 	}
-	timeout := time.Duration(rule.Director.TimeoutMinutes) * time.Minute
-	time.AfterFunc(timeout, func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	state.ManagerNotifiedAt = time.Now().UTC().Format(time.RFC3339)
+	state.LastReason = reason
+	state.RuleID = rule.ID
+	if manager != nil {
+		state.ManagerID = manager.ID
+		state.ManagerName = manager.Name
+		state.SLAMinutes = manager.SLAMinutes
+	}
+	log.Printf("chat escalation: manager notified session_id=%s rule_id=%d manager_id=%d reason=%s", sessionID, rule.ID, state.ManagerID, reason)
+	s.auditNotification(ctx, 0, sessionID, "manager", chatID, reason, msg)
+	s.scheduleDirectorEscalation(ctx, sessionID, userMessage, parseTime(state.ManagerNotifiedAt), timeout, directorTpl)
+	return true
+}
 
-		history, err := s.fetchChatHistory(ctx, sessionID, 50)
-		if err != nil {
-			log.Printf("chat escalation: director check failed session_id=%s err=%v", sessionID, err)
-			return
-		}
-		if lastHumanAdminReply(history).After(managerAt) {
-			return
-		}
-		if st := latestEscalationState(history); st != nil {
-			if t := parseTime(st.DirectorNotifiedAt); !t.IsZero() && t.After(managerAt) {
-				return
-			}
-		}
-		msg := renderTemplate(rule.Director.Message, sessionID, lastUserMessage, rule.Director.TimeoutMinutes)
-		if err := s.sendTelegramToChat(ctx, directorID, msg); err != nil {
-			log.Printf("chat escalation: director notify failed: %v", err)
-		} else {
-			log.Printf("chat escalation: director notified session_id=%s", sessionID)
-		}
-	})
+// userRequestRule is the rule a "Позвать менеджера" press escalates under: the
+// default manager message with the director follow-up and hours of the first
+// rule that applies to the session.
+func userRequestRule(rules []EscalationRule, sessionID string) EscalationRule {
+	var rule EscalationRule
+	if applicable := applicableRules(rules, sessionID, time.Now()); len(applicable) > 0 {
+		rule.DirectorTimeoutMinutes = applicable[0].DirectorTimeoutMinutes
+		rule.DirectorMessage = applicable[0].DirectorMessage
+		rule.OutsideHours = applicable[0].OutsideHours
+	}
+	return rule
 }
 
-func shouldTriggerManager(userMessage string, clarifyCount int, trigger escalationTrigger) (bool, string) {
-	if trigger.MaxConsecutiveClarifyQuestions > 0 && clarifyCount >= trigger.MaxConsecutiveClarifyQuestions {
-		return true, "clarify_count"
+// directorSLA returns the director timeout and message template for an
+// escalation assigned to manager, nil when it went to MANAGER_CHAT_ID. The
+// manager's SLA overrides the rule's timeout.
+func directorSLA(rule EscalationRule, manager *Manager) (int, string) {
+	timeout, tpl := rule.DirectorTimeoutMinutes, rule.DirectorMessage
+	if manager == nil {
+		return timeout, tpl
 	}
-	for _, kw := range trigger.NegativeKeywords {
-		kw = strings.TrimSpace(strings.ToLower(kw))
-		if kw == "" {
-			continue
-		}
-		if strings.Contains(strings.ToLower(userMessage), kw) {
-			return true, "negative_keyword"
-		}
+	if manager.SLAMinutes > 0 {
+		timeout = manager.SLAMinutes
 	}
-	return false, ""
+	if tpl == "" {
+		tpl = "Менеджер {manager} не ответил в чате {session_id} за {timeout} мин. Последний запрос: {last_user_message}"
+	}
+	return timeout, strings.ReplaceAll(tpl, "{manager}", manager.Name)
 }
 
 func countConsecutiveClarify(history []chatMessageRow, currentAnswer string) int {
@@ -242,12 +220,18 @@ func (s *Service) sendTelegramToChat(ctx context.Context, chatID int64, text str
 	if chatID == 0 || strings.TrimSpace(text) == "" || s.Cfg.TelegramBotToken == "" {
 		return nil
 	}
-	base := strings.TrimRight(s.Cfg.TelegramBaseURL, "/")
-	urlStr := fmt.Sprintf("%s/bot%s/sendMessage", base, s.Cfg.TelegramBotToken)
-	payload := map[string]interface{}{
+	return s.postTelegram(ctx, map[string]interface{}{
 		"chat_id": chatID,
 		"text":    text,
+	})
+}
+
+func (s *Service) postTelegram(ctx context.Context, payload map[string]interface{}) error {
+	if s.Cfg.TelegramBotToken == "" {
+		return nil
 	}
+	base := strings.TrimRight(s.Cfg.TelegramBaseURL, "/")
+	urlStr := fmt.Sprintf("%s/bot%s/sendMessage", base, s.Cfg.TelegramBotToken)
 	body, _ := json.Marshal(payload)
 	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
@@ -0,0 +1,297 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Escalation rules live in escalation_rules, see escalation_rules.go.
+// Director escalations are rows in escalation_jobs instead of in-process
+// timers, so they survive restarts and fire once across replicas: a worker
+// leases due rows with FOR UPDATE SKIP LOCKED. A human_admin message cancels
+// the pending jobs of its session in the database. Every notification that
+// goes out is written to escalation_notifications.
+const escalationSchema = `
+CREATE TABLE IF NOT EXISTS escalation_jobs (
+	id           bigserial PRIMARY KEY,
+	kind         text NOT NULL,
+	session_id   text NOT NULL,
+	payload      jsonb NOT NULL DEFAULT '{}',
+	run_at       timestamptz NOT NULL,
+	status       text NOT NULL DEFAULT 'pending',
+	attempts     int NOT NULL DEFAULT 0,
+	locked_until timestamptz,
+	last_error   text,
+	created_at   timestamptz NOT NULL DEFAULT now(),
+	updated_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS escalation_jobs_due ON escalation_jobs (run_at) WHERE status IN ('pending', 'running');
+CREATE UNIQUE INDEX IF NOT EXISTS escalation_jobs_active ON escalation_jobs (session_id, kind) WHERE status IN ('pending', 'running');
+
+CREATE TABLE IF NOT EXISTS escalation_rules (
+	id                       bigserial PRIMARY KEY,
+	name                     text NOT NULL,
+	priority                 int NOT NULL DEFAULT 0,
+	enabled                  boolean NOT NULL DEFAULT true,
+	channels                 text[] NOT NULL DEFAULT '{}',
+	business_hours           jsonb,
+	outside_hours            boolean NOT NULL DEFAULT false,
+	triggers                 jsonb NOT NULL DEFAULT '{}',
+	manager_message          text NOT NULL DEFAULT '',
+	director_timeout_minutes int NOT NULL DEFAULT 0,
+	director_message         text NOT NULL DEFAULT '',
+	created_at               timestamptz NOT NULL DEFAULT now(),
+	updated_at               timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS escalation_notifications (
+	id         bigserial PRIMARY KEY,
+	job_id     bigint,
+	session_id text NOT NULL,
+	level      text NOT NULL,
+	chat_id    text NOT NULL,
+	reason     text,
+	message    text NOT NULL,
+	sent_at    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION cancel_escalation_jobs() RETURNS trigger AS $$
+BEGIN
+	IF NEW.sender_type = 'human_admin' THEN
+		UPDATE escalation_jobs SET status = 'cancelled', updated_at = now()
+		WHERE session_id = NEW.session_id AND status = 'pending';
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER chat_messages_cancel_escalation
+	AFTER INSERT ON chat_messages
+	FOR EACH ROW EXECUTE FUNCTION cancel_escalation_jobs();
+`
+
+const (
+	jobDirectorEscalation = "director_escalation"
+
+	escalationPollInterval = 15 * time.Second
+	escalationLease        = time.Minute
+	escalationMaxAttempts  = 5
+)
+
+type directorJobPayload struct {
+	LastUserMessage   string `json:"last_user_message"`
+	ManagerNotifiedAt string `json:"manager_notified_at"`
+	TimeoutMinutes    int    `json:"timeout_minutes"`
+	MessageTemplate   string `json:"message_template"`
+}
+
+type escalationJob struct {
+	ID        int64
+	Kind      string
+	SessionID string
+	Payload   []byte
+	Attempts  int
+}
+
+// scheduleDirectorEscalation stores a job that notifies the director when no
+// manager has answered timeoutMinutes after managerAt.
+func (s *Service) scheduleDirectorEscalation(ctx context.Context, sessionID, lastUserMessage string, managerAt time.Time, timeoutMinutes int, template string) {
+	if timeoutMinutes <= 0 || managerAt.IsZero() {
+		return
+	}
+	if _, ok := parseChatID(s.Cfg.DirectorChatID); !ok {
+		return
+	}
+	if s.DB == nil {
+		log.Printf("chat escalation: no database, director escalation not scheduled session_id=%s", sessionID)
+		return
+	}
+	payload, _ := json.Marshal(directorJobPayload{
+		LastUserMessage:   lastUserMessage,
+		ManagerNotifiedAt: managerAt.UTC().Format(time.RFC3339),
+		TimeoutMinutes:    timeoutMinutes,
+		MessageTemplate:   template,
+	})
+	runAt := managerAt.Add(time.Duration(timeoutMinutes) * time.Minute)
+	_, err := s.DB.Pool.Exec(ctx, `
+		INSERT INTO escalation_jobs (kind, session_id, payload, run_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, kind) WHERE status IN ('pending', 'running') DO NOTHING`,
+		jobDirectorEscalation, sessionID, payload, runAt)
+	if err != nil {
+		log.Printf("chat escalation: schedule failed session_id=%s err=%v", sessionID, err)
+		return
+	}
+	log.Printf("chat escalation: director job scheduled session_id=%s run_at=%s", sessionID, runAt.Format(time.RFC3339))
+}
+
+func (s *Service) cancelEscalationJobs(ctx context.Context, sessionID, kind string) {
+	if s.DB == nil {
+		return
+	}
+	_, err := s.DB.Pool.Exec(ctx, `
+		UPDATE escalation_jobs SET status = 'cancelled', updated_at = now()
+		WHERE session_id = $1 AND kind = $2 AND status = 'pending'`, sessionID, kind)
+	if err != nil {
+		log.Printf("chat escalation: cancel failed session_id=%s err=%v", sessionID, err)
+	}
+}
+
+// RunEscalationJobs executes due escalation jobs until ctx is cancelled. The
+// tables are created by Migrate.
+func (s *Service) RunEscalationJobs(ctx context.Context) {
+	if s.DB == nil {
+		return
+	}
+	ticker := time.NewTicker(escalationPollInterval)
+	defer ticker.Stop()
+	for {
+		jobs, err := s.leaseEscalationJobs(ctx)
+		if err != nil {
+			log.Printf("chat escalation: lease failed: %v", err)
+		}
+		for _, job := range jobs {
+			s.runEscalationJob(ctx, job)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leaseEscalationJobs claims due jobs, including running ones whose lease ran
+// out because their worker died.
+func (s *Service) leaseEscalationJobs(ctx context.Context) ([]escalationJob, error) {
+	rows, err := s.DB.Pool.Query(ctx, `
+		UPDATE escalation_jobs
+		SET status = 'running', attempts = attempts + 1, locked_until = now() + $1::interval, updated_at = now()
+		WHERE id IN (
+			SELECT id FROM escalation_jobs
+			WHERE (status = 'pending' AND run_at <= now())
+			   OR (status = 'running' AND locked_until < now())
+			ORDER BY run_at
+			LIMIT 10
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, session_id, payload, attempts`,
+		fmt.Sprintf("%d seconds", int(escalationLease/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[escalationJob])
+}
+
+func (s *Service) runEscalationJob(ctx context.Context, job escalationJob) {
+	jobCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var status string
+	var err error
+	switch job.Kind {
+	case jobDirectorEscalation:
+		status, err = s.runDirectorJob(jobCtx, job)
+	case jobManagerEscalation:
+		status, err = s.runManagerJob(jobCtx, job)
+	default:
+		status, err = "failed", fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if status == "deferred" {
+		return
+	}
+	if err != nil {
+		log.Printf("chat escalation: job failed id=%d session_id=%s attempt=%d err=%v", job.ID, job.SessionID, job.Attempts, err)
+		status = "pending"
+		if job.Attempts >= escalationMaxAttempts {
+			status = "failed"
+		}
+	}
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	}
+	// A failed attempt is retried a minute later.
+	_, uerr := s.DB.Pool.Exec(ctx, `
+		UPDATE escalation_jobs
+		SET status = $2, last_error = nullif($3, ''), locked_until = NULL, updated_at = now(),
+		    run_at = CASE WHEN $2 = 'pending' THEN now() + interval '1 minute' ELSE run_at END
+		WHERE id = $1 AND status = 'running'`, job.ID, status, lastError)
+	if uerr != nil {
+		log.Printf("chat escalation: job update failed id=%d err=%v", job.ID, uerr)
+	}
+}
+
+// runDirectorJob notifies the director unless a manager has answered or the
+// director was already told since the manager notification. It is the only
+// sender of director notifications; the audit log tells a retried job that
+// the message went out before its status was saved.
+func (s *Service) runDirectorJob(ctx context.Context, job escalationJob) (string, error) {
+	var p directorJobPayload
+	if err := json.Unmarshal(job.Payload, &p); err != nil {
+		return "failed", nil
+	}
+	directorID, ok := parseChatID(s.Cfg.DirectorChatID)
+	if !ok {
+		return "cancelled", nil
+	}
+	if s.deferIfClosed(ctx, job) {
+		return "deferred", nil
+	}
+	managerAt := parseTime(p.ManagerNotifiedAt)
+	history, err := s.fetchChatHistory(ctx, job.SessionID, 50)
+	if err != nil {
+		return "", err
+	}
+	if lastHumanAdminReply(history).After(managerAt) {
+		return "cancelled", nil
+	}
+	notified, err := s.directorNotifiedSince(ctx, job.SessionID, managerAt)
+	if err != nil {
+		return "", err
+	}
+	if notified {
+		return "cancelled", nil
+	}
+	msg := renderTemplate(p.MessageTemplate, job.SessionID, p.LastUserMessage, p.TimeoutMinutes)
+	if err := s.sendTelegramToChat(ctx, directorID, msg); err != nil {
+		return "", err
+	}
+	log.Printf("chat escalation: director notified session_id=%s job_id=%d", job.SessionID, job.ID)
+	s.auditNotification(ctx, job.ID, job.SessionID, "director", directorID, "manager_timeout", msg)
+	return "done", nil
+}
+
+func (s *Service) directorNotifiedSince(ctx context.Context, sessionID string, since time.Time) (bool, error) {
+	var notified bool
+	err := s.DB.Pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM escalation_notifications
+			WHERE session_id = $1 AND level = 'director' AND sent_at >= $2
+		)`, sessionID, since).Scan(&notified)
+	return notified, err
+}
+
+// auditNotification records a sent escalation notification.
+func (s *Service) auditNotification(ctx context.Context, jobID int64, sessionID, level string, chatID int64, reason, msg string) {
+	if s.DB == nil {
+		return
+	}
+	var job interface{}
+	if jobID != 0 {
+		job = jobID
+	}
+	_, err := s.DB.Pool.Exec(ctx, `
+		INSERT INTO escalation_notifications (job_id, session_id, level, chat_id, reason, message)
+		VALUES ($1, $2, $3, $4, nullif($5, ''), $6)`,
+		job, sessionID, level, fmt.Sprintf("%d", chatID), reason, msg)
+	if err != nil {
+		log.Printf("chat escalation: audit failed session_id=%s level=%s err=%v", sessionID, level, err)
+	}
+}
@@ -0,0 +1,435 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Escalation rules are rows of escalation_rules, managed through the
+// /v1/escalation/rules endpoints. Every turn the enabled rules that apply to
+// the session's channel and to the current time are checked by priority,
+// highest first, and the first one whose trigger fires notifies the manager.
+
+const (
+	ChannelTelegram = "telegram"
+	ChannelWhatsApp = "whatsapp"
+	ChannelWeb      = "web"
+
+	defaultRulesTimezone = "Asia/Almaty"
+)
+
+type EscalationRule struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Priority int      `json:"priority"`
+	Enabled  bool     `json:"enabled"`
+	Channels []string `json:"channels"` // empty means every channel
+	// BusinessHours limits the rule to working time, or to the time outside it
+	// when OutsideHours is set.
+	BusinessHours          *BusinessHours    `json:"business_hours,omitempty"`
+	OutsideHours           bool              `json:"outside_hours"`
+	Trigger                EscalationTrigger `json:"trigger"`
+	ManagerMessage         string            `json:"manager_message"`
+	DirectorTimeoutMinutes int               `json:"director_timeout_minutes"`
+	DirectorMessage        string            `json:"director_message"`
+}
+
+type EscalationTrigger struct {
+	MaxConsecutiveClarifyQuestions int      `json:"max_consecutive_clarify_questions,omitempty"`
+	NegativeKeywords               []string `json:"negative_keywords,omitempty"`
+	// HumanRequest fires when the customer asks for a person, e.g. "позовите
+	// человека". HumanRequestPhrases extend the built-in phrases.
+	HumanRequest        bool     `json:"human_request,omitempty"`
+	HumanRequestPhrases []string `json:"human_request_phrases,omitempty"`
+	// MinOrderValue fires on a quote whose total reaches it, in tenge.
+	MinOrderValue int64 `json:"min_order_value,omitempty"`
+	// MaxFailedSearches fires after that many product searches in a row found
+	// nothing.
+	MaxFailedSearches int `json:"max_failed_searches,omitempty"`
+	// Thresholds on the classifier scores of the turn, see TurnScores. Zero
+	// disables a threshold; MaxSentiment fires at or below its value.
+	MaxSentiment      *float64 `json:"max_sentiment,omitempty"`
+	MinFrustration    float64  `json:"min_frustration,omitempty"`
+	MinPurchaseIntent float64  `json:"min_purchase_intent,omitempty"`
+	MinHumanRequest   float64  `json:"min_human_request,omitempty"`
+}
+
+// BusinessHours is a weekly calendar. Days are ISO weekdays (1 is Monday);
+// From and To are "HH:MM" in Timezone; Holidays are "YYYY-MM-DD" dates.
+type BusinessHours struct {
+	Timezone string   `json:"timezone,omitempty"`
+	Days     []int    `json:"days"`
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Holidays []string `json:"holidays,omitempty"`
+}
+
+var humanRequestPhrases = []string{
+	"позовите человека",
+	"позовите менеджера",
+	"живой человек",
+	"живого человека",
+	"соедините с менеджером",
+	"хочу поговорить с менеджером",
+	"оператор",
+}
+
+// Open reports whether t falls into working time.
+func (b BusinessHours) Open(t time.Time) bool {
+	t = t.In(b.location())
+	day := t.Format("2006-01-02")
+	for _, h := range b.Holidays {
+		if strings.TrimSpace(h) == day {
+			return false
+		}
+	}
+	weekday := int(t.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	dayOK := false
+	for _, d := range b.Days {
+		if d == weekday {
+			dayOK = true
+			break
+		}
+	}
+	if !dayOK {
+		return false
+	}
+	from, okFrom := parseClock(b.From)
+	to, okTo := parseClock(b.To)
+	if !okFrom || !okTo {
+		return true
+	}
+	now := t.Hour()*60 + t.Minute()
+	if from <= to {
+		return now >= from && now < to
+	}
+	// Overnight shift, e.g. 20:00-08:00.
+	return now >= from || now < to
+}
+
+func (b BusinessHours) timezone() string {
+	if tz := strings.TrimSpace(b.Timezone); tz != "" {
+		return tz
+	}
+	return defaultRulesTimezone
+}
+
+func (b BusinessHours) validate() error {
+	if _, err := time.LoadLocation(b.timezone()); err != nil {
+		return fmt.Errorf("unknown timezone %q", b.Timezone)
+	}
+	if len(b.Days) == 0 {
+		return errors.New("business_hours.days is required")
+	}
+	for _, d := range b.Days {
+		if d < 1 || d > 7 {
+			return fmt.Errorf("invalid day %d, expected 1..7", d)
+		}
+	}
+	if _, ok := parseClock(b.From); !ok {
+		return fmt.Errorf("invalid business_hours.from %q", b.From)
+	}
+	if _, ok := parseClock(b.To); !ok {
+		return fmt.Errorf("invalid business_hours.to %q", b.To)
+	}
+	for _, h := range b.Holidays {
+		if _, err := time.Parse("2006-01-02", strings.TrimSpace(h)); err != nil {
+			return fmt.Errorf("invalid holiday %q", h)
+		}
+	}
+	return nil
+}
+
+// parseClock returns minutes since midnight of an "HH:MM" string.
+func parseClock(raw string) (int, bool) {
+	t, err := time.Parse("15:04", strings.TrimSpace(raw))
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+func (r EscalationRule) validate() error {
+	if strings.TrimSpace(r.Name) == "" {
+		return errors.New("name is required")
+	}
+	for _, c := range r.Channels {
+		switch c {
+		case ChannelTelegram, ChannelWhatsApp, ChannelWeb:
+		default:
+			return fmt.Errorf("unknown channel %q", c)
+		}
+	}
+	if r.BusinessHours != nil {
+		if err := r.BusinessHours.validate(); err != nil {
+			return err
+		}
+	}
+	if r.DirectorTimeoutMinutes < 0 {
+		return errors.New("director_timeout_minutes must not be negative")
+	}
+	t := r.Trigger
+	if t.MaxConsecutiveClarifyQuestions <= 0 && len(t.NegativeKeywords) == 0 && !t.HumanRequest &&
+		len(t.HumanRequestPhrases) == 0 && t.MinOrderValue <= 0 && t.MaxFailedSearches <= 0 &&
+		t.MaxSentiment == nil && t.MinFrustration <= 0 && t.MinPurchaseIntent <= 0 && t.MinHumanRequest <= 0 {
+		return errors.New("trigger has no conditions")
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule covers the channel at time now.
+func (r EscalationRule) appliesTo(channel string, now time.Time) bool {
+	if !r.Enabled {
+		return false
+	}
+	if len(r.Channels) > 0 {
+		found := false
+		for _, c := range r.Channels {
+			if c == channel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.BusinessHours != nil && r.BusinessHours.Open(now) == r.OutsideHours {
+		return false
+	}
+	return true
+}
+
+// usesScores reports whether the trigger needs the classifier scores.
+func (t EscalationTrigger) usesScores() bool {
+	return t.MaxSentiment != nil || t.MinFrustration > 0 || t.MinPurchaseIntent > 0 || t.MinHumanRequest > 0
+}
+
+// evaluate checks the trigger conditions and returns the reason that fired.
+func (t EscalationTrigger) evaluate(sig escalationSignals, clarifyCount, failedSearches int) (bool, string) {
+	lower := strings.ToLower(sig.UserMessage)
+	if t.HumanRequest || len(t.HumanRequestPhrases) > 0 {
+		phrases := t.HumanRequestPhrases
+		if t.HumanRequest {
+			phrases = append(append([]string{}, humanRequestPhrases...), phrases...)
+		}
+		for _, p := range phrases {
+			p = strings.TrimSpace(strings.ToLower(p))
+			if p != "" && strings.Contains(lower, p) {
+				return true, "human_request"
+			}
+		}
+	}
+	if sc := sig.Scores; sc != nil {
+		if t.MinHumanRequest > 0 && sc.HumanRequest >= t.MinHumanRequest {
+			return true, "human_request"
+		}
+		if t.MinFrustration > 0 && sc.Frustration >= t.MinFrustration {
+			return true, "frustration"
+		}
+		if t.MaxSentiment != nil && sc.Sentiment <= *t.MaxSentiment {
+			return true, "sentiment"
+		}
+		if t.MinPurchaseIntent > 0 && sc.PurchaseIntent >= t.MinPurchaseIntent {
+			return true, "purchase_intent"
+		}
+	}
+	if t.MinOrderValue > 0 && sig.QuoteTotal >= t.MinOrderValue {
+		return true, "order_value"
+	}
+	if t.MaxFailedSearches > 0 && failedSearches >= t.MaxFailedSearches {
+		return true, "failed_searches"
+	}
+	if t.MaxConsecutiveClarifyQuestions > 0 && clarifyCount >= t.MaxConsecutiveClarifyQuestions {
+		return true, "clarify_count"
+	}
+	for _, kw := range t.NegativeKeywords {
+		kw = strings.TrimSpace(strings.ToLower(kw))
+		if kw == "" {
+			continue
+		}
+		if strings.Contains(lower, kw) {
+			return true, "negative_keyword"
+		}
+	}
+	return false, ""
+}
+
+// applicableRules returns the rules for the session's channel at time now.
+// rules come ordered by priority.
+func applicableRules(rules []EscalationRule, sessionID string, now time.Time) []EscalationRule {
+	channel := sessionChannel(sessionID)
+	out := make([]EscalationRule, 0, len(rules))
+	for _, r := range rules {
+		if r.appliesTo(channel, now) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func sessionChannel(sessionID string) string {
+	sid := strings.ToLower(strings.TrimSpace(sessionID))
+	switch {
+	case strings.HasPrefix(sid, "tg:"):
+		return ChannelTelegram
+	case strings.HasPrefix(sid, "wa:"):
+		return ChannelWhatsApp
+	default:
+		return ChannelWeb
+	}
+}
+
+// countFailedSearches counts the current turn and the assistant turns right
+// before it whose product search came back empty.
+func countFailedSearches(history []chatMessageRow, current bool) int {
+	if !current {
+		return 0
+	}
+	count := 1
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "assistant" {
+			continue
+		}
+		if !boolMeta(history[i].MetaData, "no_products") {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+const escalationRuleColumns = `id, name, priority, enabled, channels, business_hours, outside_hours, triggers,
+	manager_message, director_timeout_minutes, director_message`
+
+func scanEscalationRule(row pgx.Row) (EscalationRule, error) {
+	var r EscalationRule
+	var hours, trigger []byte
+	err := row.Scan(&r.ID, &r.Name, &r.Priority, &r.Enabled, &r.Channels, &hours, &r.OutsideHours, &trigger,
+		&r.ManagerMessage, &r.DirectorTimeoutMinutes, &r.DirectorMessage)
+	if err != nil {
+		return r, err
+	}
+	if len(hours) > 0 && string(hours) != "null" {
+		r.BusinessHours = &BusinessHours{}
+		if err := json.Unmarshal(hours, r.BusinessHours); err != nil {
+			return r, fmt.Errorf("rule %d business_hours: %w", r.ID, err)
+		}
+	}
+	if len(trigger) > 0 {
+		if err := json.Unmarshal(trigger, &r.Trigger); err != nil {
+			return r, fmt.Errorf("rule %d triggers: %w", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+// ListEscalationRules returns every rule, highest priority first.
+func (s *Service) ListEscalationRules(ctx context.Context) ([]EscalationRule, error) {
+	return s.queryEscalationRules(ctx, false)
+}
+
+// activeEscalationRules returns the enabled rules, highest priority first.
+func (s *Service) activeEscalationRules(ctx context.Context) ([]EscalationRule, error) {
+	return s.queryEscalationRules(ctx, true)
+}
+
+func (s *Service) queryEscalationRules(ctx context.Context, enabledOnly bool) ([]EscalationRule, error) {
+	if s.DB == nil {
+		return nil, nil
+	}
+	rows, err := s.DB.Pool.Query(ctx, `
+		SELECT `+escalationRuleColumns+`
+		FROM escalation_rules
+		WHERE enabled OR NOT $1
+		ORDER BY priority DESC, id`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []EscalationRule
+	for rows.Next() {
+		r, err := scanEscalationRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// SaveEscalationRule inserts the rule when its ID is zero and replaces the
+// stored one otherwise. Invalid rules fail with a 400 *Error, unknown IDs with
+// a 404 one.
+func (s *Service) SaveEscalationRule(ctx context.Context, rule EscalationRule) (EscalationRule, error) {
+	if s.DB == nil {
+		return rule, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Channels == nil {
+		rule.Channels = []string{}
+	}
+	if err := rule.validate(); err != nil {
+		return rule, newError(http.StatusBadRequest, err.Error())
+	}
+	var hours []byte
+	if rule.BusinessHours != nil {
+		hours, _ = json.Marshal(rule.BusinessHours)
+	}
+	trigger, _ := json.Marshal(rule.Trigger)
+	args := []interface{}{rule.Name, rule.Priority, rule.Enabled, rule.Channels, hours, rule.OutsideHours, trigger,
+		rule.ManagerMessage, rule.DirectorTimeoutMinutes, rule.DirectorMessage}
+
+	var row pgx.Row
+	if rule.ID == 0 {
+		row = s.DB.Pool.QueryRow(ctx, `
+			INSERT INTO escalation_rules (name, priority, enabled, channels, business_hours, outside_hours, triggers,
+				manager_message, director_timeout_minutes, director_message)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING `+escalationRuleColumns, args...)
+	} else {
+		row = s.DB.Pool.QueryRow(ctx, `
+			UPDATE escalation_rules
+			SET name = $1, priority = $2, enabled = $3, channels = $4, business_hours = $5, outside_hours = $6,
+			    triggers = $7, manager_message = $8, director_timeout_minutes = $9, director_message = $10,
+			    updated_at = now()
+			WHERE id = $11
+			RETURNING `+escalationRuleColumns, append(args, rule.ID)...)
+	}
+	saved, err := scanEscalationRule(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rule, newError(http.StatusNotFound, "rule not found")
+	}
+	if err != nil {
+		return rule, err
+	}
+	log.Printf("chat escalation: rule saved id=%d name=%q priority=%d enabled=%t", saved.ID, saved.Name, saved.Priority, saved.Enabled)
+	return saved, nil
+}
+
+// DeleteEscalationRule removes a rule; unknown IDs fail with a 404 *Error.
+func (s *Service) DeleteEscalationRule(ctx context.Context, id int64) error {
+	if s.DB == nil {
+		return newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	tag, err := s.DB.Pool.Exec(ctx, `DELETE FROM escalation_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return newError(http.StatusNotFound, "rule not found")
+	}
+	log.Printf("chat escalation: rule deleted id=%d", id)
+	return nil
+}
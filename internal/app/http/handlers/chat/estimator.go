@@ -0,0 +1,471 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"iq-home/go_beckend/internal/domain/compat"
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+type estimatorRoom struct {
+	Name     string `json:"name"`
+	Sockets  int    `json:"sockets,omitempty"`
+	Switches int    `json:"switches,omitempty"`
+	TV       int    `json:"tv,omitempty"`
+	RJ45     int    `json:"rj45,omitempty"`
+}
+
+type estimatorState struct {
+	Active bool            `json:"active"`
+	Rooms  []estimatorRoom `json:"rooms,omitempty"`
+	Series string          `json:"series,omitempty"`
+	Color  string          `json:"color,omitempty"`
+}
+
+type estimatorResult struct {
+	Answer   string
+	PDF      []byte
+	Items    []quote.Item
+	State    *estimatorState
+	Warnings []string
+}
+
+// estimatorPoint is a point type the estimator counts; cover is the query for
+// the cover each mechanism needs.
+type estimatorPoint struct {
+	kind  string
+	query string
+	cover string
+	re    *regexp.Regexp
+}
+
+var estimatorPoints = []estimatorPoint{
+	{kind: "tv", query: "розетка TV", cover: coverQueries["tv"], re: regexp.MustCompile(`(\d+)\s*(?:шт\.?\s*)?(?:розет\S*\s+)?(?:tv|тв|телевиз)`)},
+	{kind: "rj45", query: "розетка RJ45", cover: coverQueries["rj45"], re: regexp.MustCompile(`(\d+)\s*(?:шт\.?\s*)?(?:розет\S*\s+)?(?:rj-?45|интернет|компьютер)`)},
+	{kind: "sockets", query: "розетка", cover: coverQueries["розет"], re: regexp.MustCompile(`(\d+)\s*(?:шт\.?\s*)?розет`)},
+	{kind: "switches", query: "выключатель", cover: coverQueries["выключ"], re: regexp.MustCompile(`(\d+)\s*(?:шт\.?\s*)?выключ`)},
+}
+
+// roomNumberRE matches "комната 2", "2-я комната". After "комната" the number
+// must end the phrase (punctuation, another number or the end), so in "в
+// комнате 2 розетки" it stays a quantity.
+var roomNumberRE = regexp.MustCompile(`комнат\S*\s*№?\s*(\d+)(?:\s*[:,.;)!?—–-]|\s+\d|\s*$)|(\d+)\s*-?\s*я\s+комнат`)
+
+var roomNames = []struct {
+	stem string
+	name string
+}{
+	{"кухн", "Кухня"},
+	{"спальн", "Спальня"},
+	{"гостин", "Гостиная"},
+	{"зал", "Зал"},
+	{"детск", "Детская"},
+	{"ванн", "Ванная"},
+	{"санузел", "Санузел"},
+	{"туалет", "Санузел"},
+	{"коридор", "Коридор"},
+	{"прихож", "Прихожая"},
+	{"кабинет", "Кабинет"},
+	{"балкон", "Балкон"},
+	{"лоджи", "Балкон"},
+}
+
+var (
+	estimatorTargetRE = regexp.MustCompile(`(?:^|[^\p{L}])(?:квартир|комнат|\S*комнатн|коттедж|дом(?:а|е|у)?(?:[^\p{L}]|$))`)
+	estimatorAskRE    = regexp.MustCompile(`сколько\s+(?:всего\s+)?(?:нужно|надо|понадобится|потребуется|брать)|посчита|рассчита|расч[её]т|смет`)
+)
+
+// detectEstimatorIntent needs both a dwelling and an explicit ask to count
+// ("сколько всего нужно на квартиру", "посчитай на дом"), so price and
+// delivery questions that merely mention a home do not start the mode.
+func detectEstimatorIntent(msg string) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	if m == "" || strings.Contains(m, "доставк") {
+		return false
+	}
+	return estimatorTargetRE.MatchString(m) && estimatorAskRE.MatchString(m)
+}
+
+// leavesEstimator reports whether a message sent in estimator mode is another
+// request: it adds nothing to the estimate and asks about products, a КП or
+// anything else.
+func leavesEstimator(msg string, state *estimatorState, history []chatMessageRow) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	if isEstimatorCancel(m) || isEstimatorDone(m) || detectSeries(msg) != "" {
+		return false
+	}
+	if slots := extractSlots(msg); slots != nil && slots["last_color"] != "" {
+		return false
+	}
+	if len(parseEstimatorRooms(m, state)) > 0 {
+		return false
+	}
+	return isLikelyProductQuery(m) || detectKpIntent(m, history) || strings.Contains(m, "?")
+}
+
+func latestEstimatorState(history []chatMessageRow) *estimatorState {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "assistant" || history[i].MetaData == nil {
+			continue
+		}
+		raw, ok := history[i].MetaData["estimator"]
+		if !ok {
+			return nil
+		}
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil
+		}
+		var st estimatorState
+		if err := json.Unmarshal(b, &st); err != nil || !st.Active {
+			return nil
+		}
+		return &st
+	}
+	return nil
+}
+
+func (s *Service) handleEstimator(ctx context.Context, message string, state *estimatorState, customer quote.Customer) (*estimatorResult, error) {
+	m := strings.ToLower(strings.TrimSpace(message))
+	if state == nil {
+		state = &estimatorState{Active: true}
+	}
+	if isEstimatorCancel(m) {
+		state.Active = false
+		return &estimatorResult{Answer: "Хорошо, расчёт по комнатам отменил. Чем ещё помочь?", State: state}, nil
+	}
+
+	mergeEstimatorRooms(state, parseEstimatorRooms(m, state))
+	if series := detectSeries(message); series != "" {
+		state.Series = series
+	}
+	if slots := extractSlots(message); slots != nil && slots["last_color"] != "" {
+		state.Color = slots["last_color"]
+	}
+
+	if len(state.Rooms) == 0 {
+		return &estimatorResult{
+			Answer: "Давайте посчитаем по комнатам. Напишите комнаты и количество точек, например: «кухня: 6 розеток, 2 выключателя; спальня: 4 розетки, 1 выключатель, 1 TV».",
+			State:  state,
+		}, nil
+	}
+	if state.Series == "" || state.Color == "" {
+		return &estimatorResult{
+			Answer: describeEstimatorRooms(state) + "\n\nКакую серию и цвет берём? Например: «серия FD, белый».",
+			State:  state,
+		}, nil
+	}
+	if !isEstimatorDone(m) {
+		return &estimatorResult{
+			Answer: describeEstimatorRooms(state) + "\n\nДобавьте ещё комнаты или напишите «готово» — соберу КП по комнатам.",
+			State:  state,
+		}, nil
+	}
+
+	rules, err := s.compatRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, warnings, err := s.estimateBillOfMaterials(ctx, rules, state)
+	if err != nil {
+		return nil, err
+	}
+	pdf, err := buildQuotePDF(items, warnings, customer)
+	if err != nil {
+		return nil, err
+	}
+	state.Active = false
+	return &estimatorResult{Answer: "Сформировано КП по комнатам", PDF: pdf, Items: items, State: state, Warnings: warnings}, nil
+}
+
+func (s *Service) estimateBillOfMaterials(ctx context.Context, rules compat.Rules, state *estimatorState) ([]quote.Item, []string, error) {
+	cache := map[string]*SupabaseMatch{}
+	lookup := func(query string) (*SupabaseMatch, error) {
+		if p, ok := cache[query]; ok {
+			return p, nil
+		}
+		p, err := s.findSetProduct(ctx, query, compat.KindOf("", query), state.Series, state.Color)
+		if err != nil {
+			return nil, err
+		}
+		cache[query] = p
+		return p, nil
+	}
+
+	var items []quote.Item
+	var lines []compat.Line
+	missing := map[string]struct{}{}
+	add := func(room, query string, qty int) error {
+		if qty <= 0 {
+			return nil
+		}
+		p, err := lookup(query)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			missing[query] = struct{}{}
+			return nil
+		}
+		items = append(items, quote.Item{
+			ProductID:    p.ID,
+			Name:         extractProductName(*p),
+			Qty:          qty,
+			UnitPrice:    extractProductPrice(*p),
+			Availability: productAvailabilityText(*p),
+			Group:        room,
+		})
+		lines = append(lines, compat.Line{
+			ProductID: p.ID,
+			Name:      extractProductName(*p),
+			Type:      metaString(p.Metadata, "type"),
+			Series:    metaString(p.Metadata, "series"),
+			Color:     metaString(p.Metadata, "color"),
+			Qty:       qty,
+		})
+		return nil
+	}
+
+	for _, room := range state.Rooms {
+		counts := map[string]int{"sockets": room.Sockets, "switches": room.Switches, "tv": room.TV, "rj45": room.RJ45}
+		points := 0
+		for _, pt := range estimatorPoints {
+			if err := add(room.Name, pt.query, counts[pt.kind]); err != nil {
+				return nil, nil, err
+			}
+			if err := add(room.Name, pt.cover, counts[pt.kind]); err != nil {
+				return nil, nil, err
+			}
+			points += counts[pt.kind]
+		}
+		frames := map[int]int{}
+		for _, posts := range rules.PlanFrames(state.Series, points).Frames {
+			frames[posts]++
+		}
+		sizes := make([]int, 0, len(frames))
+		for posts := range frames {
+			sizes = append(sizes, posts)
+		}
+		sort.Ints(sizes)
+		for _, posts := range sizes {
+			query := fmt.Sprintf("рамка %d %s", posts, compat.Plural(posts, "пост", "поста", "постов"))
+			if err := add(room.Name, query, frames[posts]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	warnings := rules.Validate(lines)
+	for query := range missing {
+		warnings = append(warnings, fmt.Sprintf("Не нашли в каталоге: %s (серия %s, цвет %s)", query, state.Series, state.Color))
+	}
+	sort.Strings(warnings)
+	return items, warnings, nil
+}
+
+func parseEstimatorRooms(msg string, state *estimatorState) []estimatorRoom {
+	type hit struct {
+		pos  int
+		name string
+	}
+	var hits []hit
+	for _, rn := range roomNames {
+		for _, idx := range indexWordStarts(msg, rn.stem) {
+			hits = append(hits, hit{pos: idx, name: rn.name})
+		}
+	}
+	for _, loc := range roomNumberRE.FindAllStringSubmatchIndex(msg, -1) {
+		num := ""
+		if loc[2] >= 0 {
+			num = msg[loc[2]:loc[3]]
+		} else if loc[4] >= 0 {
+			num = msg[loc[4]:loc[5]]
+		}
+		hits = append(hits, hit{pos: loc[0], name: "Комната " + num})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].pos < hits[j].pos })
+
+	if len(hits) == 0 {
+		room := estimatorRoom{Name: "Комната"}
+		if len(state.Rooms) > 0 {
+			room.Name = state.Rooms[len(state.Rooms)-1].Name
+		}
+		if parseEstimatorPoints(msg, &room) {
+			return []estimatorRoom{room}
+		}
+		return nil
+	}
+
+	// A room named twice in one message ("кухня: 2 розетки, ... кухня: 1
+	// выключатель") adds up.
+	var out []estimatorRoom
+	for i, h := range hits {
+		end := len(msg)
+		if i+1 < len(hits) {
+			end = hits[i+1].pos
+		}
+		room := estimatorRoom{Name: h.name}
+		if !parseEstimatorPoints(msg[h.pos:end], &room) {
+			continue
+		}
+		merged := false
+		for j := range out {
+			if out[j].Name == room.Name {
+				out[j].Sockets += room.Sockets
+				out[j].Switches += room.Switches
+				out[j].TV += room.TV
+				out[j].RJ45 += room.RJ45
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			out = append(out, room)
+		}
+	}
+	return out
+}
+
+func parseEstimatorPoints(segment string, room *estimatorRoom) bool {
+	found := false
+	rest := segment
+	for _, pt := range estimatorPoints {
+		for _, m := range pt.re.FindAllStringSubmatch(rest, -1) {
+			n, err := strconv.Atoi(m[1])
+			if err != nil || n <= 0 || n > 100 {
+				continue
+			}
+			switch pt.kind {
+			case "sockets":
+				room.Sockets += n
+			case "switches":
+				room.Switches += n
+			case "tv":
+				room.TV += n
+			case "rj45":
+				room.RJ45 += n
+			}
+			found = true
+		}
+		rest = pt.re.ReplaceAllString(rest, " ")
+	}
+	return found
+}
+
+// mergeEstimatorRooms adds the rooms of a new message to the estimate. A room
+// already recorded keeps its counts except those the message names again, so
+// "на кухне 3 розетки" and then "на кухне 2 выключателя" give both, and "на
+// кухне 4 розетки" corrects the sockets.
+func mergeEstimatorRooms(state *estimatorState, rooms []estimatorRoom) {
+	for _, r := range rooms {
+		merged := false
+		for i := range state.Rooms {
+			if state.Rooms[i].Name != r.Name {
+				continue
+			}
+			cur := &state.Rooms[i]
+			if r.Sockets > 0 {
+				cur.Sockets = r.Sockets
+			}
+			if r.Switches > 0 {
+				cur.Switches = r.Switches
+			}
+			if r.TV > 0 {
+				cur.TV = r.TV
+			}
+			if r.RJ45 > 0 {
+				cur.RJ45 = r.RJ45
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			state.Rooms = append(state.Rooms, r)
+		}
+	}
+}
+
+func describeEstimatorRooms(state *estimatorState) string {
+	var b strings.Builder
+	b.WriteString("Записал:")
+	for _, r := range state.Rooms {
+		parts := []string{}
+		if r.Sockets > 0 {
+			parts = append(parts, fmt.Sprintf("розетки %d", r.Sockets))
+		}
+		if r.Switches > 0 {
+			parts = append(parts, fmt.Sprintf("выключатели %d", r.Switches))
+		}
+		if r.TV > 0 {
+			parts = append(parts, fmt.Sprintf("TV %d", r.TV))
+		}
+		if r.RJ45 > 0 {
+			parts = append(parts, fmt.Sprintf("RJ45 %d", r.RJ45))
+		}
+		b.WriteString("\n- ")
+		b.WriteString(r.Name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(parts, ", "))
+	}
+	if state.Series != "" || state.Color != "" {
+		b.WriteString("\nСерия: ")
+		b.WriteString(state.Series)
+		if state.Color != "" {
+			b.WriteString(", цвет: ")
+			b.WriteString(state.Color)
+		}
+	}
+	return b.String()
+}
+
+func isEstimatorDone(m string) bool {
+	if m == "все" || m == "всё" {
+		return true
+	}
+	words := strings.FieldsFunc(m, func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, w := range words {
+		switch w {
+		case "готово", "считай", "посчитай", "рассчитай", "собери", "итог":
+			return true
+		}
+	}
+	return false
+}
+
+func isEstimatorCancel(m string) bool {
+	return strings.Contains(m, "отмена") || strings.Contains(m, "отмени") || strings.Contains(m, "стоп") || strings.Contains(m, "не надо")
+}
+
+func detectRoom(m string) string {
+	for _, rn := range roomNames {
+		if len(indexWordStarts(m, rn.stem)) > 0 {
+			return rn.name
+		}
+	}
+	return ""
+}
+
+func indexWordStarts(s, sub string) []int {
+	var out []int
+	for start := 0; start < len(s); {
+		i := strings.Index(s[start:], sub)
+		if i < 0 {
+			break
+		}
+		pos := start + i
+		prev, _ := utf8.DecodeLastRuneInString(s[:pos])
+		if pos == 0 || !unicode.IsLetter(prev) {
+			out = append(out, pos)
+		}
+		start = pos + len(sub)
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEstimatorRooms(t *testing.T) {
+	tests := []struct {
+		msg   string
+		state *estimatorState
+		want  []estimatorRoom
+	}{
+		{
+			msg:  "кухня 4 розетки и 1 выключатель, спальня 3 розетки",
+			want: []estimatorRoom{{Name: "Кухня", Sockets: 4, Switches: 1}, {Name: "Спальня", Sockets: 3}},
+		},
+		{
+			msg:  "в комнате 2 розетки",
+			want: []estimatorRoom{{Name: "Комната", Sockets: 2}},
+		},
+		{
+			msg:  "комната 2: 3 розетки, 1 выключатель",
+			want: []estimatorRoom{{Name: "Комната 2", Sockets: 3, Switches: 1}},
+		},
+		{
+			msg:  "комната 1 — 2 розетки, 2-я комната 4 розетки",
+			want: []estimatorRoom{{Name: "Комната 1", Sockets: 2}, {Name: "Комната 2", Sockets: 4}},
+		},
+		{
+			msg:  "в гостиной 2 розетки tv и 1 розетка интернет, 5 розеток",
+			want: []estimatorRoom{{Name: "Гостиная", Sockets: 5, TV: 2, RJ45: 1}},
+		},
+		{
+			msg:  "кухня 2 розетки, зал 3 розетки, кухня 1 выключатель",
+			want: []estimatorRoom{{Name: "Кухня", Sockets: 2, Switches: 1}, {Name: "Зал", Sockets: 3}},
+		},
+		{
+			msg:   "ещё 2 выключателя",
+			state: &estimatorState{Rooms: []estimatorRoom{{Name: "Спальня", Sockets: 3}}},
+			want:  []estimatorRoom{{Name: "Спальня", Switches: 2}},
+		},
+		{
+			msg: "а какая серия лучше?",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			state := tt.state
+			if state == nil {
+				state = &estimatorState{}
+			}
+			if got := parseEstimatorRooms(tt.msg, state); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEstimatorRooms(%q) = %+v, want %+v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeEstimatorRooms(t *testing.T) {
+	state := &estimatorState{Rooms: []estimatorRoom{{Name: "Кухня", Sockets: 3}, {Name: "Зал", Sockets: 2}}}
+	mergeEstimatorRooms(state, []estimatorRoom{{Name: "Кухня", Switches: 2}, {Name: "Спальня", Sockets: 4}})
+	mergeEstimatorRooms(state, []estimatorRoom{{Name: "Зал", Sockets: 5}})
+	want := []estimatorRoom{{Name: "Кухня", Sockets: 3, Switches: 2}, {Name: "Зал", Sockets: 5}, {Name: "Спальня", Sockets: 4}}
+	if !reflect.DeepEqual(state.Rooms, want) {
+		t.Errorf("rooms = %+v, want %+v", state.Rooms, want)
+	}
+}
@@ -0,0 +1,248 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"iq-home/go_beckend/internal/app/crm"
+	"iq-home/go_beckend/internal/domain/lead"
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+// Leads: once a customer leaves a phone number, the chat becomes a row in
+// leads, one per phone. Later turns fill in name, email and city from the
+// session contact (see contacts.go) and record intents (quote, kp_accept,
+// callback, manager). Every change marks the lead for the CRM sync, which
+// pushes it through the configured crm.Sink with retries.
+
+const leadsSchema = `
+CREATE TABLE IF NOT EXISTS leads (
+	id            bigserial PRIMARY KEY,
+	phone         text NOT NULL UNIQUE,
+	name          text NOT NULL DEFAULT '',
+	email         text NOT NULL DEFAULT '',
+	city          text NOT NULL DEFAULT '',
+	status        text NOT NULL DEFAULT 'new',
+	channel       text NOT NULL,
+	session_id    text NOT NULL,
+	intents       text[] NOT NULL DEFAULT '{}',
+	quote_total   bigint NOT NULL DEFAULT 0,
+	crm_id        text,
+	sync_pending  boolean NOT NULL DEFAULT true,
+	sync_attempts int NOT NULL DEFAULT 0,
+	sync_after    timestamptz NOT NULL DEFAULT now(),
+	synced_at     timestamptz,
+	sync_error    text,
+	created_at    timestamptz NOT NULL DEFAULT now(),
+	updated_at    timestamptz NOT NULL DEFAULT now()
+);
+
+ALTER TABLE leads ADD COLUMN IF NOT EXISTS email text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS leads_sync_due ON leads (sync_after) WHERE sync_pending;
+`
+
+const (
+	leadSyncInterval    = 10 * time.Second
+	leadSyncBatch       = 20
+	leadSyncMaxAttempts = 10
+)
+
+// captureLead records the session's contact as a lead. It runs when the turn
+// has an intent or changed the contact, and does nothing until a phone number
+// is known.
+func (s *Service) captureLead(ctx context.Context, reqID, sessionID string, contact quote.Customer, changed bool, intents []string, quoteTotal int64) {
+	if s.DB == nil || sessionID == "" || contact.Phone == "" {
+		return
+	}
+	if len(intents) == 0 && !changed {
+		return
+	}
+	status := lead.StatusNew
+	for _, in := range intents {
+		if in == lead.IntentQuote || in == lead.IntentKPAccept || in == lead.IntentOrder {
+			status = lead.StatusQualified
+		}
+	}
+	if intents == nil {
+		intents = []string{}
+	}
+	var id int64
+	err := s.DB.Pool.QueryRow(ctx, `
+		INSERT INTO leads (phone, name, email, city, status, channel, session_id, intents, quote_total)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (phone) DO UPDATE SET
+			name = CASE WHEN excluded.name <> '' THEN excluded.name ELSE leads.name END,
+			email = CASE WHEN excluded.email <> '' THEN excluded.email ELSE leads.email END,
+			city = CASE WHEN excluded.city <> '' THEN excluded.city ELSE leads.city END,
+			status = CASE WHEN leads.status = 'new' THEN excluded.status ELSE leads.status END,
+			channel = excluded.channel,
+			session_id = excluded.session_id,
+			intents = ARRAY(SELECT DISTINCT unnest(leads.intents || excluded.intents) ORDER BY 1),
+			quote_total = greatest(leads.quote_total, excluded.quote_total),
+			sync_pending = true, sync_attempts = 0, sync_after = now(), updated_at = now()
+		RETURNING id`,
+		contact.Phone, contact.Name, contact.Email, contact.City, string(status), sessionChannel(sessionID), sessionID, intents, quoteTotal).Scan(&id)
+	if err != nil {
+		log.Printf("chat req=%s lead capture failed: %v", reqID, err)
+		return
+	}
+	log.Printf("chat req=%s lead captured id=%d session_id=%s intents=%v", reqID, id, sessionID, intents)
+}
+
+const leadColumns = `id, name, phone, email, city, status, channel, session_id, intents, quote_total, coalesce(crm_id, ''),
+	synced_at, coalesce(sync_error, ''), created_at, updated_at`
+
+func scanLead(row pgx.Row) (lead.Lead, error) {
+	var l lead.Lead
+	var status string
+	err := row.Scan(&l.ID, &l.Name, &l.Phone, &l.Email, &l.City, &status, &l.Channel, &l.SessionID, &l.Intents, &l.QuoteTotal,
+		&l.CRMID, &l.SyncedAt, &l.SyncError, &l.CreatedAt, &l.UpdatedAt)
+	l.Status = lead.Status(status)
+	return l, err
+}
+
+func collectLeads(rows pgx.Rows) ([]lead.Lead, error) {
+	defer rows.Close()
+	var out []lead.Lead
+	for rows.Next() {
+		l, err := scanLead(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, l)
+	}
+	return out, rows.Err()
+}
+
+// ListLeads returns the newest leads, optionally with one status.
+func (s *Service) ListLeads(ctx context.Context, status lead.Status, limit int) ([]lead.Lead, error) {
+	if s.DB == nil {
+		return nil, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	if status != "" && !lead.ValidStatus(status) {
+		return nil, newError(http.StatusBadRequest, fmt.Sprintf("unknown status %q", status))
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	rows, err := s.DB.Pool.Query(ctx, `
+		SELECT `+leadColumns+`
+		FROM leads
+		WHERE $1 = '' OR status = $1
+		ORDER BY updated_at DESC
+		LIMIT $2`, string(status), limit)
+	if err != nil {
+		return nil, err
+	}
+	return collectLeads(rows)
+}
+
+// SetLeadStatus changes a lead's status and queues it for the CRM.
+func (s *Service) SetLeadStatus(ctx context.Context, id int64, status lead.Status) (lead.Lead, error) {
+	if s.DB == nil {
+		return lead.Lead{}, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	if !lead.ValidStatus(status) {
+		return lead.Lead{}, newError(http.StatusBadRequest, fmt.Sprintf("unknown status %q", status))
+	}
+	l, err := scanLead(s.DB.Pool.QueryRow(ctx, `
+		UPDATE leads
+		SET status = $2, sync_pending = true, sync_attempts = 0, sync_after = now(), updated_at = now()
+		WHERE id = $1
+		RETURNING `+leadColumns, id, string(status)))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return l, newError(http.StatusNotFound, "lead not found")
+	}
+	return l, err
+}
+
+// RunLeadSync pushes changed leads to the CRM until ctx is cancelled. Leads are
+// stored without a CRM too; the tables are created by Migrate.
+func (s *Service) RunLeadSync(ctx context.Context) {
+	if s.DB == nil {
+		return
+	}
+	if s.CRM == nil {
+		log.Printf("chat leads: CRM not configured, sync disabled")
+		return
+	}
+	log.Printf("chat leads: sync to %s started", s.CRM.Name())
+	ticker := time.NewTicker(leadSyncInterval)
+	defer ticker.Stop()
+	for {
+		leads, err := s.leaseLeads(ctx)
+		if err != nil {
+			log.Printf("chat leads: lease failed: %v", err)
+		}
+		for _, l := range leads {
+			s.syncLead(ctx, l)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leaseLeads claims due leads for a minute, so replicas do not push the same
+// lead twice.
+func (s *Service) leaseLeads(ctx context.Context) ([]lead.Lead, error) {
+	rows, err := s.DB.Pool.Query(ctx, `
+		UPDATE leads
+		SET sync_after = now() + interval '1 minute', sync_attempts = sync_attempts + 1
+		WHERE id IN (
+			SELECT id FROM leads
+			WHERE sync_pending AND sync_after <= now()
+			ORDER BY sync_after
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+leadColumns, leadSyncBatch)
+	if err != nil {
+		return nil, err
+	}
+	return collectLeads(rows)
+}
+
+func (s *Service) syncLead(ctx context.Context, l lead.Lead) {
+	pushCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	crmID, err := s.CRM.Push(pushCtx, l)
+	if err != nil {
+		log.Printf("chat leads: push failed id=%d crm=%s err=%v", l.ID, s.CRM.Name(), err)
+		var attempts int
+		uerr := s.DB.Pool.QueryRow(ctx, `
+			UPDATE leads
+			SET sync_error = $2, sync_pending = sync_attempts < $3
+			WHERE id = $1
+			RETURNING sync_attempts`, l.ID, err.Error(), leadSyncMaxAttempts).Scan(&attempts)
+		if uerr == nil {
+			_, uerr = s.DB.Pool.Exec(ctx, `
+				UPDATE leads SET sync_after = now() + $2 * interval '1 second' WHERE id = $1`,
+				l.ID, int64(crm.Backoff(attempts)/time.Second))
+		}
+		if uerr != nil {
+			log.Printf("chat leads: update failed id=%d err=%v", l.ID, uerr)
+		}
+		return
+	}
+	// A lead changed during the push stays pending for another round.
+	_, err = s.DB.Pool.Exec(ctx, `
+		UPDATE leads
+		SET crm_id = $2, synced_at = now(), sync_error = NULL, sync_attempts = 0,
+		    sync_pending = updated_at > $3
+		WHERE id = $1`, l.ID, crmID, l.UpdatedAt)
+	if err != nil {
+		log.Printf("chat leads: update failed id=%d err=%v", l.ID, err)
+		return
+	}
+	log.Printf("chat leads: pushed id=%d crm=%s crm_id=%s", l.ID, s.CRM.Name(), crmID)
+}
@@ -0,0 +1,409 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// The manager roster: escalations go to one manager on shift, picked round-robin
+// or by the fewest open sessions (MANAGER_ASSIGNMENT), and the pick is stored on
+// chat_sessions.assigned_manager_id until the dialog is released. Without a
+// roster, or when nobody is available, MANAGER_CHAT_ID gets the escalation.
+//
+// An assignment counts towards the manager's load while the session is in
+// human mode, or for two hours after the escalation while the manager has
+// not taken the dialog yet. Sessions that went back to the AI without /release,
+// e.g. switched in the admin panel, or that nobody took, stop counting.
+
+const rosterSchema = `
+CREATE TABLE IF NOT EXISTS managers (
+	id               bigserial PRIMARY KEY,
+	name             text NOT NULL,
+	telegram_chat_id bigint NOT NULL UNIQUE,
+	languages        text[] NOT NULL DEFAULT '{}',
+	working_hours    jsonb,
+	max_sessions     int NOT NULL DEFAULT 0,
+	sla_minutes      int NOT NULL DEFAULT 0,
+	active           boolean NOT NULL DEFAULT true,
+	last_assigned_at timestamptz,
+	created_at       timestamptz NOT NULL DEFAULT now(),
+	updated_at       timestamptz NOT NULL DEFAULT now()
+);
+
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS assigned_manager_id bigint REFERENCES managers (id) ON DELETE SET NULL;
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS assigned_at timestamptz;
+CREATE INDEX IF NOT EXISTS chat_sessions_assigned_manager ON chat_sessions (assigned_manager_id) WHERE assigned_manager_id IS NOT NULL;
+`
+
+const (
+	AssignRoundRobin  = "round_robin"
+	AssignLeastLoaded = "least_loaded"
+
+	rosterCacheTTL = 30 * time.Second
+)
+
+type Manager struct {
+	ID             int64    `json:"id"`
+	Name           string   `json:"name"`
+	TelegramChatID int64    `json:"telegram_chat_id"`
+	Languages      []string `json:"languages"` // empty means any language
+	// WorkingHours is the manager's shift; nil means always on call.
+	WorkingHours *BusinessHours `json:"working_hours,omitempty"`
+	MaxSessions  int            `json:"max_sessions"` // 0 means no limit
+	// SLAMinutes is how long the manager has before the director is told; 0
+	// keeps the escalation rule's timeout.
+	SLAMinutes   int  `json:"sla_minutes"`
+	Active       bool `json:"active"`
+	OpenSessions int  `json:"open_sessions"`
+
+	lastAssignedAt time.Time
+}
+
+type rosterCache struct {
+	mu     sync.Mutex
+	chats  map[int64]bool
+	loaded time.Time
+}
+
+func (m Manager) validate() error {
+	if strings.TrimSpace(m.Name) == "" {
+		return errors.New("name is required")
+	}
+	if m.TelegramChatID == 0 {
+		return errors.New("telegram_chat_id is required")
+	}
+	if m.MaxSessions < 0 || m.SLAMinutes < 0 {
+		return errors.New("max_sessions and sla_minutes must not be negative")
+	}
+	if m.WorkingHours != nil {
+		return m.WorkingHours.validate()
+	}
+	return nil
+}
+
+// available reports whether the manager can take a new session in lang now.
+func (m Manager) available(lang string, now time.Time) bool {
+	if !m.Active {
+		return false
+	}
+	if m.WorkingHours != nil && !m.WorkingHours.Open(now) {
+		return false
+	}
+	if m.MaxSessions > 0 && m.OpenSessions >= m.MaxSessions {
+		return false
+	}
+	if lang == "" || len(m.Languages) == 0 {
+		return true
+	}
+	for _, l := range m.Languages {
+		if strings.EqualFold(strings.TrimSpace(l), lang) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectLanguage guesses the language of a customer message: kk, ru or en.
+func detectLanguage(text string) string {
+	cyrillic, latin := 0, 0
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case strings.ContainsRune("әғқңөұүһі", r):
+			return "kk"
+		case r >= 'а' && r <= 'я' || r == 'ё':
+			cyrillic++
+		case r >= 'a' && r <= 'z':
+			latin++
+		}
+	}
+	switch {
+	case cyrillic == 0 && latin == 0:
+		return ""
+	case cyrillic >= latin:
+		return "ru"
+	default:
+		return "en"
+	}
+}
+
+// openAssignment is the SQL condition under which a chat_sessions row cs
+// counts as an open session of its assigned manager.
+const openAssignment = `(coalesce(cs.is_human_mode, false) OR cs.assigned_at > now() - interval '2 hours')`
+
+const managerColumns = `m.id, m.name, m.telegram_chat_id, m.languages, m.working_hours, m.max_sessions, m.sla_minutes, m.active,
+	(SELECT count(*) FROM chat_sessions cs WHERE cs.assigned_manager_id = m.id AND ` + openAssignment + `)::int, coalesce(m.last_assigned_at, 'epoch')`
+
+func scanManager(row pgx.Row) (Manager, error) {
+	var m Manager
+	var hours []byte
+	err := row.Scan(&m.ID, &m.Name, &m.TelegramChatID, &m.Languages, &hours, &m.MaxSessions, &m.SLAMinutes, &m.Active,
+		&m.OpenSessions, &m.lastAssignedAt)
+	if err != nil {
+		return m, err
+	}
+	if len(hours) > 0 && string(hours) != "null" {
+		m.WorkingHours = &BusinessHours{}
+		if err := json.Unmarshal(hours, m.WorkingHours); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func collectManagers(rows pgx.Rows) ([]Manager, error) {
+	defer rows.Close()
+	var out []Manager
+	for rows.Next() {
+		m, err := scanManager(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// assignManager returns the manager who handles the session's escalation and
+// records the assignment. The current assignee keeps the session while
+// available; nil means nobody on the roster can take it.
+func (s *Service) assignManager(ctx context.Context, sessionID, lang string) (*Manager, error) {
+	if s.DB == nil {
+		return nil, nil
+	}
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	// One assignment at a time, so load counts and the round-robin order hold
+	// across replicas.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('manager_assignment'))`); err != nil {
+		return nil, err
+	}
+	var current int64
+	err = tx.QueryRow(ctx, `
+		SELECT CASE WHEN `+openAssignment+` THEN coalesce(cs.assigned_manager_id, 0) ELSE 0 END
+		FROM chat_sessions cs WHERE cs.session_id = $1`, sessionID).Scan(&current)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `SELECT `+managerColumns+` FROM managers m WHERE m.active`)
+	if err != nil {
+		return nil, err
+	}
+	managers, err := collectManagers(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var candidates []Manager
+	for _, m := range managers {
+		if m.ID == current {
+			// The session already counts towards this manager's load.
+			m.OpenSessions--
+			if m.available(lang, now) {
+				m.OpenSessions++
+				return &m, tx.Commit(ctx)
+			}
+			continue
+		}
+		if m.available(lang, now) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	leastLoaded := s.Cfg.ManagerAssignment == AssignLeastLoaded
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if leastLoaded && a.OpenSessions != b.OpenSessions {
+			return a.OpenSessions < b.OpenSessions
+		}
+		if !a.lastAssignedAt.Equal(b.lastAssignedAt) {
+			return a.lastAssignedAt.Before(b.lastAssignedAt)
+		}
+		return a.ID < b.ID
+	})
+	picked := candidates[0]
+	if _, err := tx.Exec(ctx, `UPDATE managers SET last_assigned_at = now() WHERE id = $1`, picked.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE chat_sessions SET assigned_manager_id = $2, assigned_at = now()
+		WHERE session_id = $1`, sessionID, picked.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	picked.OpenSessions++
+	log.Printf("chat roster: assigned session_id=%s manager_id=%d name=%q load=%d", sessionID, picked.ID, picked.Name, picked.OpenSessions)
+	return &picked, nil
+}
+
+// escalationTarget picks the chat an escalation of the session goes to: the
+// assigned manager's, or MANAGER_CHAT_ID when the roster has nobody.
+func (s *Service) escalationTarget(ctx context.Context, sessionID, userMessage string) (int64, *Manager) {
+	m, err := s.assignManager(ctx, sessionID, detectLanguage(userMessage))
+	if err != nil {
+		log.Printf("chat roster: assignment failed session_id=%s err=%v", sessionID, err)
+	}
+	if m != nil {
+		return m.TelegramChatID, m
+	}
+	chatID, _ := parseChatID(s.Cfg.ManagerChatID)
+	return chatID, nil
+}
+
+// ClaimSession assigns the session to the roster manager whose Telegram
+// account pressed "Взять диалог". Managers outside the roster change nothing.
+func (s *Service) ClaimSession(ctx context.Context, sessionID, telegramUserID string) error {
+	if s.DB == nil {
+		return nil
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(telegramUserID), 10, 64)
+	if err != nil {
+		return nil
+	}
+	_, err = s.DB.Pool.Exec(ctx, `
+		UPDATE chat_sessions SET assigned_manager_id = m.id, assigned_at = now()
+		FROM managers m
+		WHERE chat_sessions.session_id = $1 AND m.telegram_chat_id = $2`, sessionID, id)
+	return err
+}
+
+// ReleaseSession ends the session's assignment, freeing the manager's slot.
+func (s *Service) ReleaseSession(ctx context.Context, sessionID string) error {
+	if s.DB == nil {
+		return nil
+	}
+	_, err := s.DB.Pool.Exec(ctx, `
+		UPDATE chat_sessions SET assigned_manager_id = NULL, assigned_at = NULL
+		WHERE session_id = $1`, sessionID)
+	return err
+}
+
+// IsRosterChat reports whether chatID is a roster manager's Telegram chat. The
+// set is cached for rosterCacheTTL since every Telegram update asks.
+func (s *Service) IsRosterChat(ctx context.Context, chatID string) bool {
+	id, err := strconv.ParseInt(strings.TrimSpace(chatID), 10, 64)
+	if err != nil || s.DB == nil {
+		return false
+	}
+	s.roster.mu.Lock()
+	defer s.roster.mu.Unlock()
+	if s.roster.chats == nil || time.Since(s.roster.loaded) > rosterCacheTTL {
+		rows, err := s.DB.Pool.Query(ctx, `SELECT telegram_chat_id FROM managers WHERE active`)
+		if err == nil {
+			var ids []int64
+			ids, err = pgx.CollectRows(rows, pgx.RowTo[int64])
+			if err == nil {
+				s.roster.chats = make(map[int64]bool, len(ids))
+				for _, c := range ids {
+					s.roster.chats[c] = true
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("chat roster: load failed: %v", err)
+		}
+		s.roster.loaded = time.Now()
+	}
+	return s.roster.chats[id]
+}
+
+func (s *Service) invalidateRoster() {
+	s.roster.mu.Lock()
+	s.roster.chats = nil
+	s.roster.mu.Unlock()
+}
+
+// ListManagers returns the roster with each manager's open sessions.
+func (s *Service) ListManagers(ctx context.Context) ([]Manager, error) {
+	if s.DB == nil {
+		return nil, nil
+	}
+	rows, err := s.DB.Pool.Query(ctx, `SELECT `+managerColumns+` FROM managers m ORDER BY m.id`)
+	if err != nil {
+		return nil, err
+	}
+	return collectManagers(rows)
+}
+
+// SaveManager inserts the manager when its ID is zero and replaces the stored
+// one otherwise. Invalid input fails with a 400 *Error, unknown IDs with 404.
+func (s *Service) SaveManager(ctx context.Context, m Manager) (Manager, error) {
+	if s.DB == nil {
+		return m, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	m.Name = strings.TrimSpace(m.Name)
+	if m.Languages == nil {
+		m.Languages = []string{}
+	}
+	if err := m.validate(); err != nil {
+		return m, newError(http.StatusBadRequest, err.Error())
+	}
+	var hours []byte
+	if m.WorkingHours != nil {
+		hours, _ = json.Marshal(m.WorkingHours)
+	}
+	args := []interface{}{m.Name, m.TelegramChatID, m.Languages, hours, m.MaxSessions, m.SLAMinutes, m.Active}
+
+	var id int64
+	var err error
+	if m.ID == 0 {
+		err = s.DB.Pool.QueryRow(ctx, `
+			INSERT INTO managers (name, telegram_chat_id, languages, working_hours, max_sessions, sla_minutes, active)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id`, args...).Scan(&id)
+	} else {
+		err = s.DB.Pool.QueryRow(ctx, `
+			UPDATE managers
+			SET name = $1, telegram_chat_id = $2, languages = $3, working_hours = $4, max_sessions = $5,
+			    sla_minutes = $6, active = $7, updated_at = now()
+			WHERE id = $8
+			RETURNING id`, append(args, m.ID)...).Scan(&id)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, newError(http.StatusNotFound, "manager not found")
+	}
+	if err != nil {
+		return m, err
+	}
+	s.invalidateRoster()
+	saved, err := scanManager(s.DB.Pool.QueryRow(ctx, `SELECT `+managerColumns+` FROM managers m WHERE m.id = $1`, id))
+	if err != nil {
+		return m, err
+	}
+	log.Printf("chat roster: manager saved id=%d name=%q active=%t", saved.ID, saved.Name, saved.Active)
+	return saved, nil
+}
+
+// DeleteManager removes a manager; their sessions lose the assignment.
+func (s *Service) DeleteManager(ctx context.Context, id int64) error {
+	if s.DB == nil {
+		return newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	tag, err := s.DB.Pool.Exec(ctx, `DELETE FROM managers WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return newError(http.StatusNotFound, "manager not found")
+	}
+	s.invalidateRoster()
+	log.Printf("chat roster: manager deleted id=%d", id)
+	return nil
+}
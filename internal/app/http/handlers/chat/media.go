@@ -60,42 +60,70 @@ func (s *Service) HandleMedia(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	contentType := fh.Header.Get("Content-Type")
+	res, err := s.ReplyMedia(r.Context(), MediaRequest{
+		MessageType: messageType,
+		SessionID:   sessionID,
+		UserID:      userID,
+		Filename:    fh.Filename,
+		ContentType: fh.Header.Get("Content-Type"),
+		Data:        data,
+		ExtraText:   extraText,
+		MatchCount:  matchCount,
+		TopicFilter: topicFilter,
+	})
+	writeResult(w, res, err)
+}
+
+// ReplyMedia transcribes, recognises or parses the file and answers it as a
+// regular chat turn.
+func (s *Service) ReplyMedia(ctx context.Context, m MediaRequest) (*Result, error) {
+	if strings.TrimSpace(m.SessionID) == "" {
+		return nil, newError(http.StatusBadRequest, "session_id is required")
+	}
+	if len(m.Data) == 0 {
+		return nil, newError(http.StatusBadRequest, "file is required")
+	}
+	filename := m.Filename
+	data := m.Data
+	contentType := m.ContentType
 	if contentType == "" {
-		contentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(fh.Filename)))
+		contentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
 	}
 	if contentType == "" {
 		contentType = http.DetectContentType(data)
 	}
+	messageType := m.MessageType
 	if messageType == "" {
-		messageType = detectMessageType(contentType, fh.Filename)
+		messageType = detectMessageType(contentType, filename)
 	}
 
 	var message string
+	var err error
 	userMeta := map[string]interface{}{}
 	switch messageType {
 	case "voice":
-		log.Printf("chat media: voice file=%s size=%d mime=%s", fh.Filename, len(data), contentType)
-		message, err = s.transcribeAudio(r.Context(), fh.Filename, contentType, data)
+		log.Printf("chat media: voice file=%s size=%d mime=%s", filename, len(data), contentType)
+		message, err = s.transcribeAudio(ctx, filename, contentType, data)
 	case "photo":
-		log.Printf("chat media: photo file=%s size=%d mime=%s", fh.Filename, len(data), contentType)
+		log.Printf("chat media: photo file=%s size=%d mime=%s", filename, len(data), contentType)
 		var signal photoProductSignal
-		signal, err = s.analyzeImageForProduct(r.Context(), contentType, data)
+		signal, err = s.analyzeImageForProduct(ctx, contentType, data)
 		if err != nil {
 			log.Printf("chat media: product signal failed, fallback OCR err=%v", err)
-			message, err = s.analyzeImage(r.Context(), contentType, data)
+			message, err = s.analyzeImage(ctx, contentType, data)
 		} else {
 			message = buildPhotoProductSearchMessage(signal)
 		}
 	case "document":
-		log.Printf("chat media: document file=%s size=%d mime=%s", fh.Filename, len(data), contentType)
-		message, err = s.extractDocumentText(r.Context(), fh.Filename, contentType, data)
+		log.Printf("chat media: document file=%s size=%d mime=%s", filename, len(data), contentType)
+		message, err = s.extractDocumentText(ctx, filename, contentType, data)
 		if err == nil {
 			articles := extractDocumentArticles(message, 200)
 			if len(articles) > 0 {
 				userMeta["document_articles"] = articles
+				userMeta["document_article_lines"] = extractArticleLines(message, articles)
 			}
-			if isLikelyQuoteDocument(fh.Filename, message) {
+			if isLikelyQuoteDocument(filename, message) {
 				userMeta["incoming_quote_pdf"] = true
 			}
 			if len(articles) > 0 || boolMeta(userMeta, "incoming_quote_pdf") {
@@ -104,14 +132,13 @@ func (s *Service) HandleMedia(w http.ResponseWriter, r *http.Request) {
 		}
 	default:
 		log.Printf("chat media: unsupported message_type=%s", messageType)
-		http.Error(w, "message_type must be voice, photo, or document", http.StatusBadRequest)
-		return
+		return nil, newError(http.StatusBadRequest, "message_type must be voice, photo, or document")
 	}
 	if err != nil {
 		log.Printf("chat media: processing failed type=%s err=%v", messageType, err)
-		http.Error(w, "media processing failed", http.StatusBadGateway)
-		return
+		return nil, newError(http.StatusBadGateway, "media processing failed")
 	}
+	extraText := strings.TrimSpace(m.ExtraText)
 	if extraText != "" {
 		if strings.TrimSpace(message) != "" {
 			message = strings.TrimSpace(message) + "\n" + extraText
@@ -127,24 +154,24 @@ func (s *Service) HandleMedia(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var topicPtr *string
-	if topicFilter != "" {
-		topicPtr = &topicFilter
+	if m.TopicFilter != "" {
+		topicPtr = &m.TopicFilter
 	}
 	var userPtr *string
-	if userID != "" {
-		userPtr = &userID
+	if m.UserID != "" {
+		userPtr = &m.UserID
 	}
 
 	req := ChatRequest{
 		Message:     message,
-		SessionID:   sessionID,
+		SessionID:   m.SessionID,
 		UserID:      userPtr,
 		UserMeta:    userMeta,
-		MatchCount:  matchCount,
+		MatchCount:  m.MatchCount,
 		TopicFilter: topicPtr,
 	}
-	log.Printf("chat media: forwarding to chat session_id=%s user_id=%v msg_len=%d", sessionID, userID != "", len(message))
-	s.handleMessage(w, r, req)
+	log.Printf("chat media: forwarding to chat session_id=%s user_id=%v msg_len=%d", m.SessionID, m.UserID != "", len(message))
+	return s.reply(ctx, req)
 }
 
 type photoProductSignal struct {
@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// chatSchemas are the tables the chat workers and handlers need. They are
+// created by Migrate before the server starts serving, not by the workers.
+var chatSchemas = []struct {
+	name string
+	sql  string
+}{
+	{"escalation", escalationSchema},
+	{"scores", scoresSchema},
+	{"roster", rosterSchema},
+	{"calendar", calendarSchema},
+	{"contacts", contactSchema},
+	{"leads", leadsSchema},
+	{"order lookup", orderLookupSchema},
+}
+
+// escalationImportSchema records one-off imports into escalation_rules, so a
+// rule set the admin emptied on purpose is not imported again.
+const escalationImportSchema = `
+CREATE TABLE IF NOT EXISTS escalation_rule_imports (
+	source      text PRIMARY KEY,
+	rule_id     bigint,
+	imported_at timestamptz NOT NULL DEFAULT now()
+);
+`
+
+const legacyRuleSource = "match_sales_knowledge"
+
+// legacyEscalationRule is the rule format that used to be stored as an
+// escalation_rule document in the sales knowledge base.
+type legacyEscalationRule struct {
+	Type    string `json:"type"`
+	Manager struct {
+		Trigger struct {
+			MaxConsecutiveClarifyQuestions int      `json:"max_consecutive_clarify_questions"`
+			NegativeKeywords               []string `json:"negative_keywords"`
+		} `json:"trigger"`
+		Message string `json:"message_template"`
+	} `json:"manager"`
+	Director struct {
+		TimeoutMinutes int    `json:"timeout_minutes"`
+		Message        string `json:"message_template"`
+	} `json:"director"`
+}
+
+// Migrate creates the chat tables and imports the escalation rule of the
+// knowledge base into escalation_rules when no rule was configured yet.
+func (s *Service) Migrate(ctx context.Context) error {
+	if s.DB == nil {
+		return nil
+	}
+	for _, schema := range chatSchemas {
+		if _, err := s.DB.Pool.Exec(ctx, schema.sql); err != nil {
+			return fmt.Errorf("%s schema: %w", schema.name, err)
+		}
+	}
+	if _, err := s.DB.Pool.Exec(ctx, escalationImportSchema); err != nil {
+		return fmt.Errorf("escalation import schema: %w", err)
+	}
+	if err := s.importLegacyEscalationRule(ctx); err != nil {
+		// The import is retried on the next start.
+		log.Printf("chat escalation: legacy rule import failed: %v", err)
+	}
+	var rules int
+	if err := s.DB.Pool.QueryRow(ctx, `SELECT count(*) FROM escalation_rules WHERE enabled`).Scan(&rules); err != nil {
+		return fmt.Errorf("count escalation rules: %w", err)
+	}
+	if rules == 0 {
+		log.Printf("chat escalation: no enabled escalation rules, managers are not notified until one is added via /v1/escalation/rules")
+	}
+	return nil
+}
+
+// importLegacyEscalationRule copies the escalation_rule document of the sales
+// knowledge base into escalation_rules, once, and only into an empty table.
+func (s *Service) importLegacyEscalationRule(ctx context.Context) error {
+	var done, empty bool
+	err := s.DB.Pool.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM escalation_rule_imports WHERE source = $1),
+		       NOT EXISTS (SELECT 1 FROM escalation_rules)`, legacyRuleSource).Scan(&done, &empty)
+	if err != nil {
+		return err
+	}
+	if done || !empty {
+		return nil
+	}
+	legacy, err := s.fetchLegacyEscalationRule(ctx)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `INSERT INTO escalation_rule_imports (source) VALUES ($1) ON CONFLICT DO NOTHING`, legacyRuleSource)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		// Another replica imported it.
+		return nil
+	}
+	if legacy == nil {
+		log.Printf("chat escalation: no legacy escalation rule to import")
+		return tx.Commit(ctx)
+	}
+	trigger, _ := json.Marshal(EscalationTrigger{
+		MaxConsecutiveClarifyQuestions: legacy.Manager.Trigger.MaxConsecutiveClarifyQuestions,
+		NegativeKeywords:               legacy.Manager.Trigger.NegativeKeywords,
+	})
+	var ruleID int64
+	err = tx.QueryRow(ctx, `
+		INSERT INTO escalation_rules (name, triggers, manager_message, director_timeout_minutes, director_message)
+		SELECT $1, $2, $3, $4, $5
+		WHERE NOT EXISTS (SELECT 1 FROM escalation_rules)
+		RETURNING id`,
+		"Импорт из базы знаний", trigger, legacy.Manager.Message, legacy.Director.TimeoutMinutes, legacy.Director.Message).Scan(&ruleID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE escalation_rule_imports SET rule_id = $2 WHERE source = $1`, legacyRuleSource, ruleID); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	log.Printf("chat escalation: legacy rule imported id=%d", ruleID)
+	return nil
+}
+
+// fetchLegacyEscalationRule looks the escalation_rule document up the way the
+// chat used to; nil means the knowledge base has none.
+func (s *Service) fetchLegacyEscalationRule(ctx context.Context) (*legacyEscalationRule, error) {
+	embedding, err := s.getEmbedding(ctx, "escalation_rule")
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{
+		"query_embedding": vectorString(embedding),
+		"match_threshold": 0,
+		"match_count":     1,
+		"filter": map[string]interface{}{
+			"topic": "escalation_rule",
+		},
+	}
+	var matches []SupabaseMatch
+	if err := s.callSupabaseRPC(ctx, legacyRuleSource, payload, &matches); err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	raw := strings.TrimSpace(matches[0].Content)
+	var rule legacyEscalationRule
+	if err := json.Unmarshal([]byte(raw), &rule); err != nil || strings.TrimSpace(rule.Type) != "escalation_rule" {
+		return nil, nil
+	}
+	if rule.Manager.Trigger.MaxConsecutiveClarifyQuestions <= 0 && len(rule.Manager.Trigger.NegativeKeywords) == 0 {
+		return nil, nil
+	}
+	return &rule, nil
+}
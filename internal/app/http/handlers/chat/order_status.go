@@ -0,0 +1,377 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"iq-home/go_beckend/internal/domain/ai/messenger"
+	"iq-home/go_beckend/internal/domain/lead"
+	"iq-home/go_beckend/internal/domain/order"
+)
+
+// Order status lookup: "где мой заказ" answers with the customer's recent
+// orders. Site users are known by user_id, messenger customers only by a phone
+// the messenger verified (see verifiedPhone); orders placed from the session
+// itself always match. Anyone else, including a customer who typed a number,
+// is asked for the order number and the phone it was placed with, and both
+// have to match. Failed checks are counted on chat_sessions, so asking again
+// does not start over.
+
+const orderLookupSchema = `
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS order_lookup_failures int NOT NULL DEFAULT 0;
+ALTER TABLE chat_sessions ADD COLUMN IF NOT EXISTS order_lookup_failed_at timestamptz;
+`
+
+const (
+	orderLookupLimit       = 3
+	orderLookupMaxAttempts = 3
+	// orderLookupLockout is how long failed checks count against a session.
+	orderLookupLockout = 24 * time.Hour
+)
+
+var (
+	// orderNumberNamedRe is a number the message calls an order number:
+	// "№ 1024", "#1024", "заказ 1024", "номер заказа: 1024".
+	orderNumberNamedRe = regexp.MustCompile(`(?:№|#|заказ\p{L}*|номер)\s*(?:№|#|номер)?\s*:?\s*(\d{1,12})(?:$|\D)`)
+	// orderNumberAloneRe is a part of the message that is nothing but a number.
+	orderNumberAloneRe = regexp.MustCompile(`^\s*(\d{1,12})\s*[.!]?\s*$`)
+)
+
+type orderLookup struct {
+	Awaiting bool   `json:"awaiting"`
+	Number   string `json:"number,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+}
+
+const orderLookupLockedAnswer = "Не получилось найти заказ по этим данным. Могу позвать менеджера — он проверит вручную."
+
+// detectOrderStatusIntent matches questions about a placed order. "когда
+// привезут" alone is as often about stock, so it needs "заказ" too.
+func detectOrderStatusIntent(msg string) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	for _, k := range []string{"где мой заказ", "где заказ", "статус заказа", "статус моего заказа", "мой заказ", "отследить заказ", "трек-номер", "трек номер"} {
+		if strings.Contains(m, k) {
+			return true
+		}
+	}
+	return strings.Contains(m, "заказ") && (strings.Contains(m, "когда доставят") || strings.Contains(m, "когда привезут"))
+}
+
+// parseOrderNumber returns the order number in a verification reply: a
+// number named as one, or one standing on its own between commas or lines.
+// Quantities ("рамку на 3 поста") and phone numbers are not order numbers.
+func parseOrderNumber(msg string) string {
+	m := strings.ToLower(lead.StripPhones(msg))
+	if sub := orderNumberNamedRe.FindStringSubmatch(m); sub != nil {
+		return sub[1]
+	}
+	for _, part := range strings.FieldsFunc(m, func(r rune) bool { return r == ',' || r == ';' || r == '\n' }) {
+		if sub := orderNumberAloneRe.FindStringSubmatch(part); sub != nil {
+			return sub[1]
+		}
+	}
+	return ""
+}
+
+// awaitedOrderLookup returns the verification state when the last bot message
+// asked for an order number and phone.
+func awaitedOrderLookup(history []chatMessageRow) *orderLookup {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "assistant" {
+			continue
+		}
+		raw, ok := history[i].MetaData["order_lookup"]
+		if !ok {
+			return nil
+		}
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil
+		}
+		var l orderLookup
+		if err := json.Unmarshal(b, &l); err != nil || !l.Awaiting {
+			return nil
+		}
+		return &l
+	}
+	return nil
+}
+
+// replyOrderStatus answers an order-status question or a verification reply.
+// ok is false when a message sent during verification carries neither an
+// order number nor a phone; it then goes through the normal pipeline.
+func (s *Service) replyOrderStatus(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, lookup *orderLookup, fromDBRelay bool) (res *Result, ok bool, err error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	if s.DB == nil {
+		return nil, true, newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	assistantMeta := map[string]interface{}{}
+	var answer string
+	var actions [][]ChatAction
+
+	if lookup == nil {
+		var userID, phone string
+		if req.UserID != nil && isUUID(*req.UserID) {
+			userID = strings.TrimSpace(*req.UserID)
+		}
+		if messenger.IsMessengerSession(sessionID) {
+			phone = verifiedPhone(sessionID, history, req.UserMeta)
+		}
+		orders, err := s.findCustomerOrders(ctx, userID, phone, sessionID)
+		if err != nil {
+			log.Printf("chat req=%s order lookup failed: %v", reqID, err)
+			return nil, true, newError(http.StatusBadGateway, "order lookup failed")
+		}
+		log.Printf("chat req=%s order lookup session_id=%s by_user=%t by_phone=%t found=%d", reqID, sessionID, userID != "", phone != "", len(orders))
+		switch {
+		case len(orders) > 0:
+			answer = describeOrders(orders)
+		case userID != "" || phone != "":
+			answer = "Не нашёл заказов на ваш аккаунт. Если заказ оформлен на другой номер, напишите номер заказа и телефон, на который он оформлен."
+			assistantMeta["order_lookup"] = orderLookup{Awaiting: true}
+		default:
+			answer = "Чтобы проверить заказ, напишите его номер и телефон, на который он оформлен."
+			assistantMeta["order_lookup"] = orderLookup{Awaiting: true}
+		}
+		s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer}}, true, nil
+	}
+
+	if phone := lead.ParsePhone(req.Message); phone != "" {
+		lookup.Phone = phone
+	}
+	if n := parseOrderNumber(req.Message); n != "" {
+		lookup.Number = n
+	}
+	if lookup.Phone == "" && lookup.Number == "" {
+		return nil, false, nil
+	}
+	switch {
+	case lookup.Number == "":
+		answer = "Напишите, пожалуйста, и номер заказа."
+		assistantMeta["order_lookup"] = lookup
+	case lookup.Phone == "":
+		answer = "Напишите, пожалуйста, и телефон, на который оформлен заказ."
+		assistantMeta["order_lookup"] = lookup
+	default:
+		failures, err := s.orderLookupFailures(ctx, sessionID)
+		if err != nil {
+			log.Printf("chat req=%s order verify failed: %v", reqID, err)
+			return nil, true, newError(http.StatusBadGateway, "order lookup failed")
+		}
+		if failures >= orderLookupMaxAttempts {
+			log.Printf("chat req=%s order verify locked session_id=%s failures=%d", reqID, sessionID, failures)
+			answer = orderLookupLockedAnswer
+			actions = [][]ChatAction{{{Label: "Позвать менеджера", Data: ActionManager}}}
+			break
+		}
+		o, err := s.findVerifiedOrder(ctx, lookup.Number, lookup.Phone)
+		if err == nil && o == nil {
+			failures, err = s.recordOrderLookupFailure(ctx, sessionID)
+		}
+		if err != nil {
+			log.Printf("chat req=%s order verify failed: %v", reqID, err)
+			return nil, true, newError(http.StatusBadGateway, "order lookup failed")
+		}
+		log.Printf("chat req=%s order verify session_id=%s number=%s found=%t failures=%d", reqID, sessionID, lookup.Number, o != nil, failures)
+		switch {
+		case o != nil:
+			answer = describeOrders([]order.Order{*o})
+		case failures >= orderLookupMaxAttempts:
+			answer = orderLookupLockedAnswer
+			actions = [][]ChatAction{{{Label: "Позвать менеджера", Data: ActionManager}}}
+		default:
+			answer = fmt.Sprintf("Не нашёл заказ №%s с телефоном %s. Проверьте номер заказа и телефон и напишите ещё раз.", lookup.Number, lookup.Phone)
+			assistantMeta["order_lookup"] = orderLookup{Awaiting: true}
+		}
+	}
+	s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+	return &Result{Response: ChatResponse{Answer: answer, Actions: actions}}, true, nil
+}
+
+// orderLookupFailures returns the failed checks of the session within
+// orderLookupLockout.
+func (s *Service) orderLookupFailures(ctx context.Context, sessionID string) (int, error) {
+	var n int
+	err := s.DB.Pool.QueryRow(ctx, `
+		SELECT CASE WHEN order_lookup_failed_at > now() - $2::interval THEN order_lookup_failures ELSE 0 END
+		FROM chat_sessions WHERE session_id = $1`, sessionID, lockoutInterval()).Scan(&n)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// recordOrderLookupFailure counts a failed check and returns the new count.
+// Without a session row the check cannot be counted, so it counts as the last
+// one allowed.
+func (s *Service) recordOrderLookupFailure(ctx context.Context, sessionID string) (int, error) {
+	var n int
+	err := s.DB.Pool.QueryRow(ctx, `
+		UPDATE chat_sessions
+		SET order_lookup_failures = CASE WHEN order_lookup_failed_at > now() - $2::interval THEN order_lookup_failures + 1 ELSE 1 END,
+		    order_lookup_failed_at = now()
+		WHERE session_id = $1
+		RETURNING order_lookup_failures`, sessionID, lockoutInterval()).Scan(&n)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return orderLookupMaxAttempts, nil
+	}
+	return n, err
+}
+
+func lockoutInterval() string {
+	return fmt.Sprintf("%d seconds", int(orderLookupLockout/time.Second))
+}
+
+const orderLookupColumns = `o.id::text, coalesce(o.status, ''), o.created_at, o.delivery_eta,
+	coalesce(o.tracking_number, ''), coalesce(o.tracking_url, ''), coalesce(o.total, 0),
+	coalesce(o.delivery_method, ''), coalesce(o.delivery_address, ''),
+	coalesce((SELECT json_agg(json_build_object('product_id', i.product_id, 'name', coalesce(i.name, ''),
+		'qty', coalesce(i.qty, 1), 'price', coalesce(i.price, 0)) ORDER BY i.id)
+		FROM order_items i WHERE i.order_id = o.id), '[]')`
+
+// findCustomerOrders returns the newest orders of the site user, the phone or
+// the session. Empty userID and phone are not matched.
+func (s *Service) findCustomerOrders(ctx context.Context, userID, phone, sessionID string) ([]order.Order, error) {
+	var uid interface{}
+	if userID != "" {
+		uid = userID
+	}
+	rows, err := s.DB.Pool.Query(ctx, `
+		SELECT `+orderLookupColumns+`
+		FROM orders o
+		WHERE ($1::uuid IS NOT NULL AND o.user_id = $1::uuid)
+		   OR ($2 <> '' AND o.customer_phone = $2)
+		   OR ($3 <> '' AND o.session_id = $3)
+		ORDER BY o.created_at DESC
+		LIMIT $4`, uid, phone, sessionID, orderLookupLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []order.Order
+	for rows.Next() {
+		o, err := scanLookupOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, s.fillOrderItemNames(ctx, out)
+}
+
+// findVerifiedOrder returns the order only when number and phone both match.
+func (s *Service) findVerifiedOrder(ctx context.Context, number, phone string) (*order.Order, error) {
+	rows, err := s.DB.Pool.Query(ctx, `
+		SELECT `+orderLookupColumns+`
+		FROM orders o
+		WHERE o.id::text = $1 AND o.customer_phone = $2`, number, phone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	o, err := scanLookupOrder(rows)
+	if err != nil {
+		return nil, err
+	}
+	out := []order.Order{o}
+	return &out[0], s.fillOrderItemNames(ctx, out)
+}
+
+func scanLookupOrder(row pgx.Row) (order.Order, error) {
+	var o order.Order
+	var items []byte
+	if err := row.Scan(&o.ID, &o.Status, &o.CreatedAt, &o.ETA, &o.TrackingNumber, &o.TrackingURL, &o.Total,
+		&o.Delivery, &o.Address, &items); err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(items, &o.Items); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// fillOrderItemNames names items of orders placed on the site, whose
+// order_items rows carry only product ids.
+func (s *Service) fillOrderItemNames(ctx context.Context, orders []order.Order) error {
+	var ids []int64
+	for _, o := range orders {
+		for _, it := range o.Items {
+			if it.Name == "" && it.ProductID > 0 {
+				ids = append(ids, it.ProductID)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	products, err := s.fetchProductsByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+	names := make(map[int64]string, len(products))
+	for _, p := range products {
+		names[p.ID] = extractProductName(p)
+	}
+	for i := range orders {
+		for j := range orders[i].Items {
+			if it := &orders[i].Items[j]; it.Name == "" {
+				it.Name = names[it.ProductID]
+			}
+		}
+	}
+	return nil
+}
+
+func describeOrders(orders []order.Order) string {
+	parts := make([]string, 0, len(orders))
+	for _, o := range orders {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Заказ №%s от %s — %s.", o.ID, o.CreatedAt.Format("02.01.2006"), order.StatusLabel(o.Status))
+		if o.ETA != nil && o.Status != order.StatusDelivered && o.Status != order.StatusCompleted && o.Status != order.StatusCancelled {
+			fmt.Fprintf(&b, "\nОжидаемая дата %s: %s.", etaLabel(o.Delivery), o.ETA.Format("02.01.2006"))
+		}
+		if o.TrackingNumber != "" {
+			b.WriteString("\nТрек-номер: " + o.TrackingNumber)
+			if o.TrackingURL != "" {
+				b.WriteString(" — " + o.TrackingURL)
+			}
+		}
+		names := make([]string, 0, len(o.Items))
+		for _, it := range o.Items {
+			if it.Name != "" {
+				names = append(names, fmt.Sprintf("%s × %d", it.Name, it.Qty))
+			}
+		}
+		if len(names) > 0 {
+			b.WriteString("\nСостав: " + strings.Join(names, ", "))
+		}
+		if o.Total > 0 {
+			b.WriteString("\nСумма: " + formatTenge(o.Total))
+		}
+		parts = append(parts, b.String())
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func etaLabel(delivery string) string {
+	if delivery == order.DeliveryPickup {
+		return "готовности к выдаче"
+	}
+	return "доставки"
+}
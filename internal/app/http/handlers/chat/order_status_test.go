@@ -0,0 +1,54 @@
+package chat
+
+import "testing"
+
+func TestParseOrderNumber(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"1024", "1024"},
+		{"1024, +7 701 123 45 67", "1024"},
+		{"+77011234567\n1024", "1024"},
+		{"заказ 1024, телефон 87011234567", "1024"},
+		{"номер заказа: 1024", "1024"},
+		{"№1024", "1024"},
+		{"мой заказ № 1024 на 87011234567", "1024"},
+		{"#1024", "1024"},
+		{"рамку на 3 поста", ""},
+		{"нужно 2 розетки и 1 выключатель", ""},
+		{"+7 701 123 45 67", ""},
+		{"телефон 87011234567", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := parseOrderNumber(tt.msg); got != tt.want {
+				t.Errorf("parseOrderNumber(%q) = %q, want %q", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectOrderStatusIntent(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{"Где мой заказ?", true},
+		{"какой статус заказа 1024", true},
+		{"когда привезут мой заказ", true},
+		{"когда доставят заказ?", true},
+		{"дайте трек-номер", true},
+		{"когда привезут рамки серии FD?", false},
+		{"когда доставят, если закажу сегодня?", false},
+		{"хочу оформить заказ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := detectOrderStatusIntent(tt.msg); got != tt.want {
+				t.Errorf("detectOrderStatusIntent(%q) = %t, want %t", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,523 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"iq-home/go_beckend/internal/app/crm"
+	"iq-home/go_beckend/internal/domain/ai/messenger"
+	"iq-home/go_beckend/internal/domain/lead"
+	"iq-home/go_beckend/internal/domain/order"
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+// Orders: "оформить заказ" after a КП walks the customer through contact,
+// delivery method and address, shows a summary and writes the confirmed order
+// into the site's orders/order_items tables. The draft lives in the assistant
+// meta under "order", like the estimator state. Status changes made on the site
+// are pushed back to the session by RunOrderUpdates. The columns the chat needs
+// on those tables come from migrations/0001_chat_orders.sql.
+
+// orderColumns are the columns migrations/0001_chat_orders.sql adds to the
+// site's tables; RunOrderUpdates checks for them instead of altering the site
+// schema itself.
+var orderColumns = []string{
+	"orders.session_id", "orders.status_notified", "orders.status_notify_attempts", "orders.status_notify_after",
+	"orders.customer_phone", "orders.tracking_number", "order_items.name", "order_items.price",
+}
+
+const (
+	ActionOrder         = "order"
+	ActionOrderPickup   = "order:pickup"
+	ActionOrderDelivery = "order:delivery"
+	ActionOrderConfirm  = "order:confirm"
+	ActionOrderCancel   = "order:cancel"
+)
+
+const (
+	orderStepContact  = "contact"
+	orderStepDelivery = "delivery"
+	orderStepAddress  = "address"
+	orderStepConfirm  = "confirm"
+
+	orderUpdatesInterval    = 15 * time.Second
+	orderUpdatesBatch       = 50
+	orderUpdatesMaxAttempts = 5
+)
+
+// kpLine is a КП position remembered in the assistant meta under "kp_items",
+// so an order can be placed from the last КП.
+type kpLine struct {
+	ProductID int64 `json:"product_id"`
+	Qty       int   `json:"qty"`
+}
+
+type orderDraft struct {
+	Active   bool     `json:"active"`
+	Step     string   `json:"step,omitempty"`
+	Items    []kpLine `json:"items"`
+	Delivery string   `json:"delivery,omitempty"`
+	Address  string   `json:"address,omitempty"`
+}
+
+func kpLinesFromProducts(products []SupabaseMatch) []kpLine {
+	out := make([]kpLine, 0, len(products))
+	for _, p := range products {
+		if extractProductPrice(p) > 0 {
+			out = append(out, kpLine{ProductID: p.ID, Qty: 1})
+		}
+	}
+	return out
+}
+
+func kpLinesFromItems(items []quote.Item) []kpLine {
+	out := make([]kpLine, 0, len(items))
+	for _, it := range items {
+		if it.ProductID > 0 && it.Qty > 0 {
+			out = append(out, kpLine{ProductID: it.ProductID, Qty: it.Qty})
+		}
+	}
+	return out
+}
+
+// latestKPLines returns the positions of the newest КП in history.
+func latestKPLines(history []chatMessageRow) []kpLine {
+	for i := len(history) - 1; i >= 0; i-- {
+		raw, ok := history[i].MetaData["kp_items"]
+		if history[i].Role != "assistant" || !ok {
+			continue
+		}
+		var lines []kpLine
+		if b, err := json.Marshal(raw); err == nil && json.Unmarshal(b, &lines) == nil {
+			return lines
+		}
+		return nil
+	}
+	return nil
+}
+
+func latestOrderDraft(history []chatMessageRow) *orderDraft {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role != "assistant" || history[i].MetaData == nil {
+			continue
+		}
+		raw, ok := history[i].MetaData["order"]
+		if !ok {
+			return nil
+		}
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil
+		}
+		var d orderDraft
+		if err := json.Unmarshal(b, &d); err != nil || !d.Active {
+			return nil
+		}
+		return &d
+	}
+	return nil
+}
+
+func detectOrderIntent(msg string) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	for _, k := range []string{"оформить заказ", "оформи заказ", "оформляем заказ", "оформим заказ", "сделать заказ", "хочу заказать", "заказываю", "готов заказать"} {
+		if strings.Contains(m, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOrderCancel(msg string) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	return m == "отмена" || strings.Contains(m, "отменить заказ") || strings.Contains(m, "передумал")
+}
+
+// orderAddressRE matches the parts of a street address: a house number or a
+// street, district or flat marker.
+var orderAddressRE = regexp.MustCompile(`\d|(?:^|[^\p{L}])(?:ул|улица|пр|просп|проспект|пр-т|мкр|микрорайон|пер|переулок|бульвар|б-р|шоссе|дом|д|кв|квартира|район|р-н)(?:$|[^\p{L}])`)
+
+// looksLikeAddress reports whether a message sent at the address step can be
+// the delivery address: it names a street or a house number and is not a
+// question or a product request.
+func looksLikeAddress(msg string) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	if utf8.RuneCountInString(m) < 5 || strings.Contains(m, "?") || isLikelyProductQuery(m) {
+		return false
+	}
+	return orderAddressRE.MatchString(m)
+}
+
+// leavesOrder reports whether a message sent while an order is being placed
+// does not answer the current step, so it is handled as a new request and the
+// draft is dropped, like leavesEstimator does for the estimator.
+func leavesOrder(msg string, draft *orderDraft, history []chatMessageRow) bool {
+	m := strings.ToLower(strings.TrimSpace(msg))
+	if isOrderCancel(m) || detectOrderIntent(m) {
+		return false
+	}
+	switch draft.Step {
+	case orderStepContact:
+		if lead.ParsePhone(msg) != "" {
+			return false
+		}
+		return isLikelyProductQuery(m) || detectKpIntent(m, history) || strings.Contains(m, "?")
+	case orderStepDelivery:
+		return !strings.Contains(m, "самовывоз") && (!strings.Contains(m, "доставк") || strings.Contains(m, "?"))
+	case orderStepAddress:
+		return !strings.Contains(m, "самовывоз") && !looksLikeAddress(msg)
+	case orderStepConfirm:
+		return !isAffirmative(m)
+	}
+	return false
+}
+
+func orderQuoteActions() [][]ChatAction {
+	return [][]ChatAction{{{Label: "Оформить заказ", Data: ActionOrder}}}
+}
+
+// replyOrder advances the order draft by one step.
+func (s *Service) replyOrder(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, draft *orderDraft, fromDBRelay bool) (*Result, error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	msg := strings.ToLower(strings.TrimSpace(req.Message))
+	assistantMeta := map[string]interface{}{}
+	var answer string
+	var actions [][]ChatAction
+	requestContact := false
+
+	if draft == nil {
+		lines := latestKPLines(history)
+		if len(lines) == 0 {
+			answer = "Чтобы оформить заказ, сначала соберём КП — напишите, какие товары нужны."
+			s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+			return &Result{Response: ChatResponse{Answer: answer}}, nil
+		}
+		draft = &orderDraft{Active: true, Items: lines}
+		log.Printf("chat req=%s order draft started session_id=%s items=%d", reqID, sessionID, len(lines))
+	}
+	if req.Action == ActionOrderCancel || isOrderCancel(msg) {
+		draft.Active = false
+		answer = "Оформление заказа отменил. КП остаётся в силе — если передумаете, нажмите «Оформить заказ»."
+		assistantMeta["order"] = draft
+		s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer}}, nil
+	}
+
+	contact, changed := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+	switch {
+	case req.Action == ActionOrderPickup || strings.Contains(msg, "самовывоз"):
+		draft.Delivery = order.DeliveryPickup
+		draft.Address = ""
+	case draft.Step == orderStepAddress && req.Action == "" && looksLikeAddress(req.Message):
+		draft.Address = strings.TrimSpace(req.Message)
+	case req.Action == ActionOrderDelivery || strings.Contains(msg, "доставк"):
+		draft.Delivery = order.DeliveryCourier
+	}
+
+	products, err := s.fetchProductsByIDs(ctx, kpLineIDs(draft.Items))
+	if err != nil {
+		log.Printf("chat req=%s order products load failed: %v", reqID, err)
+		return nil, newError(http.StatusBadGateway, "products lookup failed")
+	}
+	o := buildOrder(draft, products, contact)
+	o.SessionID = sessionID
+	if req.UserID != nil && isUUID(*req.UserID) {
+		o.UserID = strings.TrimSpace(*req.UserID)
+	}
+	if len(o.Items) == 0 {
+		draft.Active = false
+		answer = "Не нашёл товары из КП в каталоге — соберите, пожалуйста, КП заново."
+		assistantMeta["order"] = draft
+		s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+		return &Result{Response: ChatResponse{Answer: answer}}, nil
+	}
+
+	confirmed := draft.Step == orderStepConfirm && (req.Action == ActionOrderConfirm || (req.Action == "" && isAffirmative(msg)))
+	switch {
+	case contact.Phone == "":
+		draft.Step = orderStepContact
+		answer = "Для заказа нужен номер телефона и имя — напишите их, пожалуйста."
+		requestContact = true
+	case draft.Delivery == "":
+		draft.Step = orderStepDelivery
+		answer = "Как удобнее получить заказ: доставка или самовывоз?"
+		actions = [][]ChatAction{{{Label: "Доставка", Data: ActionOrderDelivery}, {Label: "Самовывоз", Data: ActionOrderPickup}}}
+	case draft.Delivery == order.DeliveryCourier && draft.Address == "":
+		draft.Step = orderStepAddress
+		answer = "Напишите адрес доставки: город, улица, дом, квартира."
+		if contact.City != "" {
+			answer = "Напишите адрес доставки в городе " + contact.City + ": улица, дом, квартира."
+		}
+	case confirmed:
+		if err := s.createOrder(ctx, &o); err != nil {
+			log.Printf("chat req=%s order create failed: %v", reqID, err)
+			return nil, newError(http.StatusBadGateway, "order create failed")
+		}
+		log.Printf("chat req=%s order created id=%s session_id=%s total=%d", reqID, o.ID, sessionID, o.Total)
+		draft.Active = false
+		answer = fmt.Sprintf("Заказ №%s оформлен!\n\n%s\n\nМенеджер свяжется с вами для подтверждения. Сообщу здесь, когда статус заказа изменится.", o.ID, orderSummary(o))
+		assistantMeta["order_id"] = o.ID
+		s.captureLead(ctx, reqID, sessionID, contact, changed, []string{lead.IntentOrder}, o.Total)
+	default:
+		draft.Step = orderStepConfirm
+		answer = "Проверьте заказ:\n\n" + orderSummary(o) + "\n\nВсё верно?"
+		actions = [][]ChatAction{{{Label: "Подтвердить", Data: ActionOrderConfirm}, {Label: "Отменить", Data: ActionOrderCancel}}}
+	}
+	assistantMeta["order"] = draft
+	s.persistOrderTurn(ctx, reqID, req, answer, assistantMeta, fromDBRelay)
+	return &Result{Response: ChatResponse{Answer: answer, Actions: actions, RequestContact: requestContact}}, nil
+}
+
+func (s *Service) persistOrderTurn(ctx context.Context, reqID string, req ChatRequest, answer string, assistantMeta map[string]interface{}, fromDBRelay bool) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	if sessionID == "" {
+		return
+	}
+	userMeta := mergeMeta(nil, req.UserMeta)
+	if req.Action != "" {
+		userMeta = mergeMeta(map[string]interface{}{"action": req.Action}, req.UserMeta)
+	}
+	rows := make([]chatMessageInsert, 0, 2)
+	if !fromDBRelay {
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
+	}
+	rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
+	if err := s.insertChatMessages(ctx, rows); err != nil {
+		log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+	}
+}
+
+func kpLineIDs(lines []kpLine) []int64 {
+	ids := make([]int64, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+	return ids
+}
+
+// buildOrder prices the draft with current catalog prices; products that are
+// gone or have no price are left out.
+func buildOrder(draft *orderDraft, products []SupabaseMatch, contact quote.Customer) order.Order {
+	byID := make(map[int64]SupabaseMatch, len(products))
+	for _, p := range products {
+		byID[p.ID] = p
+	}
+	o := order.Order{Status: order.StatusNew, Customer: contact, Delivery: draft.Delivery, Address: draft.Address}
+	for _, l := range draft.Items {
+		p, ok := byID[l.ProductID]
+		price := extractProductPrice(p)
+		if !ok || price <= 0 || l.Qty <= 0 {
+			continue
+		}
+		o.Items = append(o.Items, order.Item{ProductID: p.ID, Name: extractProductName(p), Qty: l.Qty, UnitPrice: price})
+		o.Total += price * int64(l.Qty)
+	}
+	return o
+}
+
+func orderSummary(o order.Order) string {
+	var b strings.Builder
+	for i, it := range o.Items {
+		fmt.Fprintf(&b, "%d. %s × %d — %s\n", i+1, it.Name, it.Qty, formatTenge(it.UnitPrice*int64(it.Qty)))
+	}
+	b.WriteString("Итого: " + formatTenge(o.Total) + "\n")
+	b.WriteString("Получение: " + order.DeliveryLabel(o.Delivery))
+	if o.Address != "" {
+		b.WriteString(", " + o.Address)
+	}
+	if o.Customer.Phone != "" {
+		b.WriteString("\nКонтакт: " + strings.TrimSpace(o.Customer.Name+" "+o.Customer.Phone))
+	}
+	return b.String()
+}
+
+// createOrder writes the order and its items in one statement and fills in
+// ID and CreatedAt. The chat never announces the initial status, so
+// status_notified starts equal to status.
+func (s *Service) createOrder(ctx context.Context, o *order.Order) error {
+	if s.DB == nil {
+		return newError(http.StatusServiceUnavailable, "database not configured")
+	}
+	var ids, prices []int64
+	var names []string
+	var qtys []int32
+	for _, it := range o.Items {
+		ids = append(ids, it.ProductID)
+		names = append(names, it.Name)
+		qtys = append(qtys, int32(it.Qty))
+		prices = append(prices, it.UnitPrice)
+	}
+	var userID interface{}
+	if o.UserID != "" {
+		userID = o.UserID
+	}
+	return s.DB.Pool.QueryRow(ctx, `
+		WITH o AS (
+			INSERT INTO orders (user_id, session_id, source, status, status_notified, total,
+				customer_name, customer_phone, customer_email, customer_city, delivery_method, delivery_address)
+			VALUES ($1, $2, 'chat', $3, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id, created_at
+		), items AS (
+			INSERT INTO order_items (order_id, product_id, name, qty, price)
+			SELECT o.id, i.product_id, i.name, i.qty, i.price
+			FROM o, unnest($11::bigint[], $12::text[], $13::int[], $14::bigint[]) AS i(product_id, name, qty, price)
+		)
+		SELECT id::text, created_at FROM o`,
+		userID, o.SessionID, o.Status, o.Total,
+		o.Customer.Name, o.Customer.Phone, o.Customer.Email, o.Customer.City, o.Delivery, o.Address,
+		ids, names, qtys, prices).Scan(&o.ID, &o.CreatedAt)
+}
+
+// RunOrderUpdates tells chat customers when the site changes the status of
+// their order: the message is stored in the session history, and send delivers
+// it to messenger sessions. Each change is leased before it is sent, so
+// replicas do not send it twice, and marked notified only once delivered; a
+// failed delivery is retried with a backoff.
+func (s *Service) RunOrderUpdates(ctx context.Context, send func(ctx context.Context, sessionID, text string) error) {
+	if s.DB == nil {
+		return
+	}
+	if missing, err := s.missingOrderColumns(ctx); err != nil {
+		log.Printf("chat orders: schema check failed: %v", err)
+	} else if len(missing) > 0 {
+		log.Printf("chat orders: status updates disabled, apply migrations/0001_chat_orders.sql (missing %s)", strings.Join(missing, ", "))
+		return
+	}
+	ticker := time.NewTicker(orderUpdatesInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.pushOrderUpdates(ctx, send); err != nil {
+			log.Printf("chat orders: status updates failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Service) missingOrderColumns(ctx context.Context) ([]string, error) {
+	rows, err := s.DB.Pool.Query(ctx, `
+		SELECT table_name || '.' || column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name IN ('orders', 'order_items')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	have := map[string]bool{}
+	for rows.Next() {
+		var col string
+		if err := rows.Scan(&col); err != nil {
+			return nil, err
+		}
+		have[col] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, col := range orderColumns {
+		if !have[col] {
+			missing = append(missing, col)
+		}
+	}
+	return missing, nil
+}
+
+type orderChange struct {
+	id        int64
+	sessionID string
+	status    string
+	attempts  int
+}
+
+func (s *Service) pushOrderUpdates(ctx context.Context, send func(ctx context.Context, sessionID, text string) error) error {
+	rows, err := s.DB.Pool.Query(ctx, `
+		WITH due AS (
+			SELECT id FROM orders
+			WHERE session_id IS NOT NULL AND status IS DISTINCT FROM status_notified
+			  AND (status_notify_after IS NULL OR status_notify_after <= now())
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE orders o
+		SET status_notify_after = now() + interval '1 minute', status_notify_attempts = o.status_notify_attempts + 1
+		FROM due
+		WHERE o.id = due.id
+		RETURNING o.id, o.session_id, coalesce(o.status, ''), o.status_notify_attempts`, orderUpdatesBatch)
+	if err != nil {
+		return err
+	}
+	var changes []orderChange
+	for rows.Next() {
+		var c orderChange
+		if err := rows.Scan(&c.id, &c.sessionID, &c.status, &c.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		s.pushOrderUpdate(ctx, c, send)
+	}
+	return nil
+}
+
+// pushOrderUpdate delivers one status change. Messenger sessions get the
+// message first and the history entry after, so a failed send is retried
+// without leaving a duplicate in the history; web sessions read the history,
+// so there the insert is the delivery.
+func (s *Service) pushOrderUpdate(ctx context.Context, c orderChange, send func(ctx context.Context, sessionID, text string) error) {
+	text := fmt.Sprintf("Статус заказа №%d: %s.", c.id, order.StatusLabel(c.status))
+	orderID := fmt.Sprintf("%d", c.id)
+	meta := map[string]interface{}{"order_status": map[string]string{"order_id": orderID, "status": c.status}}
+	insert := func() error {
+		return s.insertChatMessages(ctx, []chatMessageInsert{{SessionID: c.sessionID, Role: "assistant", Content: text, MetaData: meta}})
+	}
+
+	var err error
+	if messenger.IsMessengerSession(c.sessionID) {
+		if err = send(ctx, c.sessionID, text); err == nil {
+			if ierr := insert(); ierr != nil {
+				log.Printf("chat orders: insert message failed id=%d err=%v", c.id, ierr)
+			}
+		}
+	} else {
+		err = insert()
+	}
+
+	if err != nil {
+		log.Printf("chat orders: status update failed id=%d session_id=%s attempt=%d err=%v", c.id, c.sessionID, c.attempts, err)
+		if c.attempts < orderUpdatesMaxAttempts {
+			_, uerr := s.DB.Pool.Exec(ctx, `UPDATE orders SET status_notify_after = now() + $2 * interval '1 second' WHERE id = $1`,
+				c.id, int64(crm.Backoff(c.attempts)/time.Second))
+			if uerr != nil {
+				log.Printf("chat orders: retry schedule failed id=%d err=%v", c.id, uerr)
+			}
+			return
+		}
+		log.Printf("chat orders: giving up on status update id=%d status=%s", c.id, c.status)
+	} else {
+		log.Printf("chat orders: status update id=%d session_id=%s status=%s", c.id, c.sessionID, c.status)
+	}
+	// The status sent, or given up on, is what the customer was told about; a
+	// later change on the site makes the row due again.
+	_, err = s.DB.Pool.Exec(ctx, `
+		UPDATE orders SET status_notified = $2, status_notify_attempts = 0, status_notify_after = NULL
+		WHERE id = $1`, c.id, c.status)
+	if err != nil {
+		log.Printf("chat orders: mark notified failed id=%d err=%v", c.id, err)
+	}
+}
@@ -11,28 +11,58 @@ import (
 	pdfgen "iq-home/go_beckend/internal/domain/quote/pdf/gofpdf"
 )
 
-func (s *Service) generateQuotePDF(products []SupabaseMatch) ([]byte, error) {
-	q := quote.Quote{
-		Number:    "NF-1",
-		CreatedAt: time.Now(),
-		Customer:  quote.Customer{Name: "Клиент"},
-	}
-	var subtotal int64
+func (s *Service) generateQuotePDF(products []SupabaseMatch, warnings []string, customer quote.Customer) ([]byte, error) {
+	items := make([]quote.Item, 0, len(products))
 	for _, p := range products {
-		name := extractProductName(p)
 		price := extractProductPrice(p)
 		if price <= 0 {
 			continue
 		}
-		line := price
-		q.Items = append(q.Items, quote.Item{
+		items = append(items, quote.Item{
 			ProductID: p.ID,
-			Name:      name,
+			Name:      extractProductName(p),
 			Qty:       1,
 			UnitPrice: price,
-			LineTotal: line,
+			LineTotal: price,
+
+			Availability: productAvailabilityText(p),
+			AnalogueFor:  analogueLabel(p),
 		})
-		subtotal += line
+	}
+	return buildQuotePDF(items, warnings, customer)
+}
+
+// quoteTotal is the sum generateQuotePDF puts on the quote.
+func quoteTotal(products []SupabaseMatch) int64 {
+	var total int64
+	for _, p := range products {
+		if price := extractProductPrice(p); price > 0 {
+			total += price
+		}
+	}
+	return total
+}
+
+// buildQuotePDF renders the КП for customer; an unknown customer is printed as
+// "Клиент".
+func buildQuotePDF(items []quote.Item, warnings []string, customer quote.Customer) ([]byte, error) {
+	if customer.Name == "" && customer.Phone == "" {
+		customer.Name = "Клиент"
+	}
+	q := quote.Quote{
+		Number:    "NF-1",
+		CreatedAt: time.Now(),
+		Customer:  customer,
+		Warnings:  warnings,
+	}
+	var subtotal int64
+	for _, it := range items {
+		if it.UnitPrice <= 0 || it.Qty <= 0 {
+			continue
+		}
+		it.LineTotal = it.UnitPrice * int64(it.Qty)
+		q.Items = append(q.Items, it)
+		subtotal += it.LineTotal
 	}
 	if len(q.Items) == 0 {
 		return nil, errors.New("no products for quote")
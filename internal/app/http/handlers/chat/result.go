@@ -0,0 +1,74 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Result is one assistant turn. When PDF is set the turn produced a document
+// (КП) instead of, or in addition to, the text answer. Cards are filled for
+// messenger sessions, where they replace the product links in the answer.
+type Result struct {
+	Response ChatResponse
+	PDF      []byte
+	PDFName  string
+	Cards    []ProductCard
+}
+
+// MediaRequest is the in-process counterpart of the /v1/chat/media form.
+type MediaRequest struct {
+	MessageType string
+	SessionID   string
+	UserID      string
+	Filename    string
+	ContentType string
+	Data        []byte
+	ExtraText   string
+	MatchCount  int
+	TopicFilter string
+}
+
+// Error is returned by Reply and ReplyMedia; Status is the HTTP code the web
+// handlers answer with.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func newError(status int, msg string) *Error {
+	return &Error{Status: status, Message: msg}
+}
+
+// Reply runs the chat pipeline for a text message without going through HTTP.
+func (s *Service) Reply(ctx context.Context, req ChatRequest) (*Result, error) {
+	return s.reply(ctx, req)
+}
+
+func writeResult(w http.ResponseWriter, res *Result, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		var chatErr *Error
+		if errors.As(err, &chatErr) {
+			status = chatErr.Status
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if res.PDF != nil {
+		name := res.PDFName
+		if name == "" {
+			name = "KP.pdf"
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(res.PDF)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res.Response)
+}
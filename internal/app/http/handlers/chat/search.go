@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -184,7 +185,10 @@ func (s *Service) searchProductsFallback(ctx context.Context, queryText string,
 }
 
 func (s *Service) loadProductsFromHistory(ctx context.Context, history []chatMessageRow) ([]SupabaseMatch, error) {
-	ids := extractProductIDsFromHistory(history)
+	return s.fetchProductsByIDs(ctx, extractProductIDsFromHistory(history))
+}
+
+func (s *Service) fetchProductsByIDs(ctx context.Context, ids []int64) ([]SupabaseMatch, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
@@ -259,7 +263,7 @@ func joinIDs(ids []int64) string {
 	return strings.Join(parts, ",")
 }
 
-func (s *Service) searchProductsByArticles(ctx context.Context, articles []string, limit int) ([]SupabaseMatch, error) {
+func (s *Service) searchProductsByArticles(ctx context.Context, articles []string, lines map[string]string, limit int) ([]SupabaseMatch, error) {
 	if limit <= 0 {
 		limit = 5
 	}
@@ -269,6 +273,7 @@ func (s *Service) searchProductsByArticles(ctx context.Context, articles []strin
 	}
 	seen := map[int64]struct{}{}
 	out := make([]SupabaseMatch, 0, limit)
+	var missing []string
 	// 1) Diversify: first pass returns at most one item per article.
 	for _, article := range normalized {
 		if len(out) >= limit {
@@ -278,6 +283,9 @@ func (s *Service) searchProductsByArticles(ctx context.Context, articles []strin
 		if err != nil {
 			return nil, err
 		}
+		if len(rows) == 0 {
+			missing = append(missing, article)
+		}
 		for _, row := range rows {
 			if _, ok := seen[row.ID]; ok {
 				continue
@@ -308,6 +316,20 @@ func (s *Service) searchProductsByArticles(ctx context.Context, articles []strin
 			}
 		}
 	}
+	// 3) Competitor articles: cross-reference table, then semantic analogue.
+	if len(out) < limit && len(missing) > 0 {
+		analogues, err := s.findAnalogues(ctx, missing, lines, limit-len(out))
+		if err != nil {
+			log.Printf("chat analogues failed articles=%d: %v", len(missing), err)
+		}
+		for _, p := range analogues {
+			if _, ok := seen[p.ID]; ok {
+				continue
+			}
+			seen[p.ID] = struct{}{}
+			out = append(out, p)
+		}
+	}
 	return out, nil
 }
 
@@ -10,18 +10,31 @@ import (
 	"time"
 
 	"iq-home/go_beckend/internal/app/config"
+	"iq-home/go_beckend/internal/app/crm"
+	"iq-home/go_beckend/internal/domain/ai/messenger"
+	"iq-home/go_beckend/internal/domain/lead"
+	"iq-home/go_beckend/internal/infra/db/postgres"
 )
 
 type Service struct {
 	Cfg  config.Config
 	HTTP *http.Client
+	DB   *postgres.DB
+	CRM  crm.Sink
+
+	roster rosterCache
+	compat compatCache
 }
 
-func New(cfg config.Config, httpClient *http.Client) *Service {
+func New(cfg config.Config, httpClient *http.Client, db *postgres.DB) *Service {
 	if httpClient == nil {
 		httpClient = &http.Client{Timeout: 15 * time.Second}
 	}
-	return &Service{Cfg: cfg, HTTP: httpClient}
+	sink, err := crm.New(cfg, httpClient)
+	if err != nil {
+		log.Printf("chat: crm disabled: %v", err)
+	}
+	return &Service{Cfg: cfg, HTTP: httpClient, DB: db, CRM: sink}
 }
 
 func (s *Service) Handle(w http.ResponseWriter, r *http.Request) {
@@ -31,15 +44,19 @@ func (s *Service) Handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	s.handleMessage(w, r, req)
+	res, err := s.reply(r.Context(), req)
+	writeResult(w, res, err)
 }
 
-func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req ChatRequest) {
+func (s *Service) reply(ctx context.Context, req ChatRequest) (*Result, error) {
 	reqID := fmt.Sprintf("chat-%d", time.Now().UnixNano())
+	req.Action = strings.TrimSpace(req.Action)
+	if strings.TrimSpace(req.Message) == "" && req.Action != "" {
+		req.Message = actionLabel(req.Action)
+	}
 	if strings.TrimSpace(req.Message) == "" {
 		log.Printf("chat req=%s empty message", reqID)
-		http.Error(w, "message is required", http.StatusBadRequest)
-		return
+		return nil, newError(http.StatusBadRequest, "message is required")
 	}
 	matchCount := req.MatchCount
 	if matchCount <= 0 {
@@ -58,29 +75,27 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 	var history []chatMessageRow
 	var behavior *userBehaviorContext
 	if sessionID != "" {
-		if err := s.ensureChatSession(r.Context(), sessionID, userID); err != nil {
+		if err := s.ensureChatSession(ctx, sessionID, userID); err != nil {
 			log.Printf("chat req=%s ensure session failed: %v", reqID, err)
 		} else {
-			humanMode, err := s.fetchHumanMode(r.Context(), sessionID)
+			humanMode, err := s.fetchHumanMode(ctx, sessionID)
 			if err != nil {
 				log.Printf("chat req=%s human mode check failed: %v", reqID, err)
 			}
 			if humanMode {
 				log.Printf("chat req=%s human mode=true skip ai", reqID)
+				s.forwardToManager(ctx, sessionID, req.Message)
 				if !fromDBRelay {
-					if err := s.insertChatMessages(r.Context(), []chatMessageInsert{
+					if err := s.insertChatMessages(ctx, []chatMessageInsert{
 						{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: map[string]interface{}{}},
 					}); err != nil {
 						log.Printf("chat req=%s insert messages failed: %v", reqID, err)
 					}
 				}
-				resp := ChatResponse{Answer: "", Products: nil, Knowledge: nil}
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(resp)
-				return
+				return &Result{Response: ChatResponse{Answer: "", Products: nil, Knowledge: nil}}, nil
 			}
 			historyStart := time.Now()
-			history, err = s.fetchChatHistory(r.Context(), sessionID, 30)
+			history, err = s.fetchChatHistory(ctx, sessionID, 30)
 			if err != nil {
 				log.Printf("chat req=%s history load failed: %v", reqID, err)
 			} else {
@@ -91,7 +106,7 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 	}
 	if userID != "" && shouldUseSitePersonalization(sessionID) {
 		profileStart := time.Now()
-		profile, profileErr := s.fetchUserBehavior(r.Context(), userID)
+		profile, profileErr := s.fetchUserBehavior(ctx, userID)
 		if profileErr != nil {
 			log.Printf("chat req=%s personalization failed: %v", reqID, profileErr)
 		} else if profile != nil {
@@ -100,6 +115,33 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 		}
 	}
 
+	if req.Action != "" {
+		return s.handleAction(ctx, reqID, req, history, fromDBRelay)
+	}
+
+	if phone := awaitedCallbackPhone(history, req.Message); phone != "" {
+		return s.replyCallbackPhone(ctx, reqID, req, history, phone, fromDBRelay)
+	}
+
+	draft := latestOrderDraft(history)
+	if draft != nil && leavesOrder(req.Message, draft, history) {
+		log.Printf("chat req=%s order draft left for another request step=%s", reqID, draft.Step)
+		draft = nil
+	}
+	if draft != nil || detectOrderIntent(req.Message) {
+		return s.replyOrder(ctx, reqID, req, history, draft, fromDBRelay)
+	}
+
+	if lookup := awaitedOrderLookup(history); lookup != nil || detectOrderStatusIntent(req.Message) {
+		if res, ok, err := s.replyOrderStatus(ctx, reqID, req, history, lookup, fromDBRelay); ok {
+			return res, err
+		}
+	}
+
+	if res, ok, err := s.replyContact(ctx, reqID, req, history, fromDBRelay); ok {
+		return res, err
+	}
+
 	if detectPingMessage(req.Message) {
 		answer := "Да, я здесь. Чем могу помочь?"
 		if sessionID != "" {
@@ -110,22 +152,18 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 				rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
 			}
 			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
-			if err := s.insertChatMessages(r.Context(), rows); err != nil {
+			if err := s.insertChatMessages(ctx, rows); err != nil {
 				log.Printf("chat req=%s insert messages failed: %v", reqID, err)
 			}
 		}
-		resp := ChatResponse{Answer: answer, Products: nil, Knowledge: nil}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
-		return
+		return &Result{Response: ChatResponse{Answer: answer, Products: nil, Knowledge: nil}}, nil
 	}
 
 	if kind := detectAssortmentQuery(req.Message); kind != "" {
-		answer, err := s.handleAssortmentQuery(r.Context(), kind)
+		answer, err := s.handleAssortmentQuery(ctx, kind)
 		if err != nil {
 			log.Printf("chat req=%s assortment failed: %v", reqID, err)
-			http.Error(w, "assortment lookup failed", http.StatusBadGateway)
-			return
+			return nil, newError(http.StatusBadGateway, "assortment lookup failed")
 		}
 		if sessionID != "" {
 			userMeta := mergeMeta(nil, req.UserMeta)
@@ -134,14 +172,78 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 				rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
 			}
 			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: map[string]interface{}{}})
-			if err := s.insertChatMessages(r.Context(), rows); err != nil {
+			if err := s.insertChatMessages(ctx, rows); err != nil {
 				log.Printf("chat req=%s insert messages failed: %v", reqID, err)
 			}
 		}
-		resp := ChatResponse{Answer: answer, Products: nil, Knowledge: nil}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
-		return
+		return &Result{Response: ChatResponse{Answer: answer, Products: nil, Knowledge: nil}}, nil
+	}
+
+	est := latestEstimatorState(history)
+	if est != nil && leavesEstimator(req.Message, est, history) {
+		log.Printf("chat req=%s estimator left for another request", reqID)
+		est = nil
+	}
+	if est != nil || detectEstimatorIntent(req.Message) {
+		contact, _ := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+		result, err := s.handleEstimator(ctx, req.Message, est, contact)
+		if err != nil {
+			log.Printf("chat req=%s estimator failed: %v", reqID, err)
+			return nil, newError(http.StatusBadGateway, "estimate failed")
+		}
+		log.Printf("chat req=%s estimator rooms=%d active=%t pdf=%t", reqID, len(result.State.Rooms), result.State.Active, result.PDF != nil)
+		if sessionID != "" {
+			userMeta := mergeMeta(nil, req.UserMeta)
+			assistantMeta := map[string]interface{}{
+				"estimator": result.State,
+				"slots":     mergeSlots(latestSlots(history), extractSlots(req.Message)),
+			}
+			if result.PDF != nil {
+				assistantMeta["kp_pdf"] = true
+				assistantMeta["kp_items"] = kpLinesFromItems(result.Items)
+			}
+			if len(result.Warnings) > 0 {
+				assistantMeta["kp_warnings"] = result.Warnings
+			}
+			rows := make([]chatMessageInsert, 0, 2)
+			if !fromDBRelay {
+				rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
+			}
+			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: result.Answer, MetaData: assistantMeta})
+			if err := s.insertChatMessages(ctx, rows); err != nil {
+				log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+			}
+		}
+		if result.PDF != nil {
+			return &Result{PDF: result.PDF, PDFName: "KP.pdf", Response: ChatResponse{Answer: result.Answer, Actions: orderQuoteActions()}}, nil
+		}
+		return &Result{Response: ChatResponse{Answer: result.Answer, Products: nil, Knowledge: nil}}, nil
+	}
+
+	if cmp := detectComparisonRequest(req.Message); cmp != nil {
+		compareStart := time.Now()
+		answer, table, err := s.handleComparison(ctx, cmp)
+		if err != nil {
+			log.Printf("chat req=%s comparison failed kind=%s left=%s right=%s: %v", reqID, cmp.Kind, cmp.Left, cmp.Right, err)
+		} else if answer != "" {
+			log.Printf("chat req=%s comparison ok kind=%s left=%s right=%s took=%s", reqID, cmp.Kind, cmp.Left, cmp.Right, time.Since(compareStart))
+			if sessionID != "" {
+				userMeta := mergeMeta(nil, req.UserMeta)
+				assistantMeta := map[string]interface{}{}
+				if table != nil {
+					assistantMeta["comparison"] = table
+				}
+				rows := make([]chatMessageInsert, 0, 2)
+				if !fromDBRelay {
+					rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
+				}
+				rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
+				if err := s.insertChatMessages(ctx, rows); err != nil {
+					log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+				}
+			}
+			return &Result{Response: ChatResponse{Answer: answer, Products: nil, Knowledge: nil, Comparison: table}}, nil
+		}
 	}
 
 	userWantsQuote := detectKpIntent(req.Message, history)
@@ -152,8 +254,22 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 		log.Printf("chat req=%s quote intent=true", reqID)
 	}
 
+	var escRules []EscalationRule
+	if sessionID != "" {
+		if rules, err := s.activeEscalationRules(ctx); err != nil {
+			log.Printf("chat req=%s escalation rules fetch failed: %v", reqID, err)
+		} else {
+			escRules = rules
+		}
+	}
+
+	waitScores := func() *TurnScores { return nil }
+	if sessionID != "" && s.turnScoringNeeded(escRules, sessionID) {
+		waitScores = s.startTurnClassifier(ctx, reqID, req.Message, history)
+	}
+
 	decisionStart := time.Now()
-	needProducts, err := s.decideProductSearch(r.Context(), req.Message)
+	needProducts, err := s.decideProductSearch(ctx, req.Message)
 	if err != nil {
 		log.Printf("chat req=%s product decision failed: %v", reqID, err)
 		needProducts = true
@@ -169,11 +285,10 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 	}
 
 	embedStart := time.Now()
-	embedding, err := s.getEmbedding(r.Context(), req.Message)
+	embedding, err := s.getEmbedding(ctx, req.Message)
 	if err != nil {
 		log.Printf("chat req=%s embedding failed: %v", reqID, err)
-		http.Error(w, "embedding failed", http.StatusBadGateway)
-		return
+		return nil, newError(http.StatusBadGateway, "embedding failed")
 	}
 	log.Printf("chat req=%s embedding ok dims=%d took=%s", reqID, len(embedding), time.Since(embedStart))
 
@@ -196,7 +311,7 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 		productsStart := time.Now()
 		docArticles := stringSliceMeta(req.UserMeta, "document_articles")
 		if len(docArticles) > 0 {
-			products, err = s.searchProductsByArticles(r.Context(), docArticles, matchCount)
+			products, err = s.searchProductsByArticles(ctx, docArticles, stringMapMeta(req.UserMeta, "document_article_lines"), matchCount)
 			if err != nil {
 				log.Printf("chat req=%s document articles search failed: %v", reqID, err)
 			}
@@ -205,18 +320,17 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 			}
 		}
 		if len(products) == 0 {
-			products, err = s.searchProductsHybrid(r.Context(), req.Message, vector, matchCount)
+			products, err = s.searchProductsHybrid(ctx, req.Message, vector, matchCount)
 			if err != nil {
 				log.Printf("chat req=%s supabase products failed: %v", reqID, err)
-				http.Error(w, "supabase products search failed", http.StatusBadGateway)
-				return
+				return nil, newError(http.StatusBadGateway, "supabase products search failed")
 			}
 			log.Printf("chat req=%s products ok count=%d ids=%s names=%s took=%s",
 				reqID, len(products), joinProductIDs(products, 5), joinProductNames(products, 3), time.Since(productsStart))
 		}
 	}
 	if len(products) == 0 && isFollowUpMessage(req.Message) {
-		reused, err := s.loadProductsFromHistory(r.Context(), history)
+		reused, err := s.loadProductsFromHistory(ctx, history)
 		if err != nil {
 			log.Printf("chat req=%s reuse products failed: %v", reqID, err)
 		} else if len(reused) > 0 {
@@ -233,70 +347,63 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 			log.Printf("chat req=%s personalization fallback products count=%d ids=%s", reqID, len(products), joinProductIDs(products, 5))
 		}
 	}
+	if len(products) > 0 {
+		stockStart := time.Now()
+		if err := s.attachAvailability(ctx, products); err != nil {
+			log.Printf("chat req=%s stock lookup failed: %v", reqID, err)
+		} else {
+			products = rankProductsByAvailability(products)
+			log.Printf("chat req=%s stock ok ids=%s took=%s", reqID, joinProductIDs(products, 5), time.Since(stockStart))
+		}
+	}
 
-	if userWantsQuote && len(products) > 0 {
-		pdfStart := time.Now()
-		pdfBytes, err := s.generateQuotePDF(products)
-		if err != nil {
-			log.Printf("chat req=%s quote pdf failed: %v", reqID, err)
-			http.Error(w, "quote generation failed", http.StatusBadGateway)
-			return
+	var notes []string
+	if len(products) > 0 && countRequestedPoints(req.Message) > 0 {
+		if rules, err := s.compatRules(ctx); err != nil {
+			log.Printf("chat req=%s compat rules failed: %v", reqID, err)
+		} else {
+			products = s.completeSet(ctx, reqID, rules, req.Message, products)
+			notes = append(notes, compatNotes(rules, req.Message, products)...)
 		}
-		if sessionID != "" {
-			userMeta := map[string]interface{}{}
-			if hasKPOffered(history) {
-				userMeta["kp_accept"] = true
-			}
-			assistantMeta := map[string]interface{}{"kp_pdf": true}
-			rows := make([]chatMessageInsert, 0, 2)
-			if !fromDBRelay {
-				rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
-			}
-			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: "Сформировано КП", MetaData: assistantMeta})
-			if err := s.insertChatMessages(r.Context(), rows); err != nil {
-				log.Printf("chat req=%s insert messages failed: %v", reqID, err)
-			}
+	}
+
+	if userWantsQuote && len(products) > 0 {
+		return s.replyQuote(ctx, reqID, req, history, products, waitScores(), fromDBRelay)
+	}
+
+	if len(products) > 0 {
+		if err := s.attachProductImages(ctx, products); err != nil {
+			log.Printf("chat req=%s product images failed: %v", reqID, err)
 		}
-		w.Header().Set("Content-Type", "application/pdf")
-		w.Header().Set("Content-Disposition", `attachment; filename="KP.pdf"`)
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(pdfBytes)
-		log.Printf("chat req=%s quote pdf ok bytes=%d took=%s", reqID, len(pdfBytes), time.Since(pdfStart))
-		return
 	}
 
 	knowledgeStart := time.Now()
 	var knowledge []SupabaseMatch
-	if err := s.callSupabaseRPC(r.Context(), "match_sales_knowledge", knowledgePayload, &knowledge); err != nil {
+	if err := s.callSupabaseRPC(ctx, "match_sales_knowledge", knowledgePayload, &knowledge); err != nil {
 		log.Printf("chat req=%s supabase knowledge failed: %v", reqID, err)
-		http.Error(w, "supabase knowledge search failed", http.StatusBadGateway)
-		return
+		return nil, newError(http.StatusBadGateway, "supabase knowledge search failed")
 	}
 	log.Printf("chat req=%s knowledge ok count=%d took=%s", reqID, len(knowledge), time.Since(knowledgeStart))
 
-	var escRule *escalationRule
-	if sessionID != "" {
-		if rule, err := s.fetchEscalationRule(r.Context(), vector); err != nil {
-			log.Printf("chat req=%s escalation rule fetch failed: %v", reqID, err)
-		} else {
-			escRule = rule
-		}
-	}
-
 	openAIStart := time.Now()
-	answer, err := s.callOpenAI(r.Context(), req.Message, history, products, knowledge, behavior)
+	answer, err := s.callOpenAI(ctx, req.Message, history, products, knowledge, behavior, notes)
 	if err != nil {
 		log.Printf("chat req=%s openai failed: %v", reqID, err)
-		http.Error(w, "openai generation failed", http.StatusBadGateway)
-		return
+		return nil, newError(http.StatusBadGateway, "openai generation failed")
 	}
 	if strings.TrimSpace(answer) == "" {
 		answer = "Нашёл несколько вариантов. Уточните, пожалуйста, что именно нужно (тип/серия/цвет)."
 	}
 	log.Printf("chat req=%s openai ok answer_len=%d took=%s", reqID, len(answer), time.Since(openAIStart))
+	showCards := false
 	if needProducts && len(products) > 0 && isLikelyProductQuery(req.Message) {
-		answer = appendProductLinks(answer, products)
+		if messenger.IsMessengerSession(sessionID) {
+			showCards = true
+		} else {
+			answer = appendProductLinks(answer, products)
+		}
 	}
+	answer = appendAnalogueNote(answer, products)
 
 	offerKp := false
 	if needProducts && len(products) > 0 && !userWantsQuote && !incomingQuotePDF && !hasKPOffered(history) {
@@ -309,6 +416,10 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 		if userWantsQuote && hasKPOffered(history) {
 			userMeta["kp_accept"] = true
 		}
+		scores := waitScores()
+		if scores != nil {
+			userMeta["scores"] = scores
+		}
 		userMeta = mergeMeta(userMeta, req.UserMeta)
 
 		assistantMeta := map[string]interface{}{}
@@ -318,18 +429,25 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 		if len(products) > 0 {
 			assistantMeta["product_ids"] = collectProductIDs(products)
 		}
+		noProducts := needProducts && len(products) == 0
+		if noProducts {
+			assistantMeta["no_products"] = true
+		}
 		assistantMeta["slots"] = mergeSlots(latestSlots(history), extractSlots(req.Message))
 		if shouldUpdateSummary(history, 6) {
-			if summary, err := s.summarizeHistory(r.Context(), history, answer); err == nil && strings.TrimSpace(summary) != "" {
+			if summary, err := s.summarizeHistory(ctx, history, answer); err == nil && strings.TrimSpace(summary) != "" {
 				assistantMeta["summary"] = summary
 			} else if err != nil {
 				log.Printf("chat req=%s summary update failed: %v", reqID, err)
 			}
 		}
 		assistantMeta["slots"] = mergeSlots(latestSlots(history), extractSlots(req.Message))
-		if escRule != nil {
-			if state := s.maybeEscalate(r.Context(), sessionID, req.Message, answer, history, escRule); state != nil {
-				assistantMeta["escalation"] = state
+		sig := escalationSignals{UserMessage: req.Message, Answer: answer, NoProducts: noProducts, Scores: scores}
+		if state := s.maybeEscalate(ctx, sessionID, history, escRules, sig); state != nil {
+			assistantMeta["escalation"] = state
+			if state.notice != "" {
+				answer = strings.TrimSpace(answer) + "\n\n" + state.notice
+				assistantMeta["awaiting_callback_phone"] = true
 			}
 		}
 
@@ -339,19 +457,97 @@ func (s *Service) handleMessage(w http.ResponseWriter, r *http.Request, req Chat
 			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
 		}
 		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
-		if err := s.insertChatMessages(r.Context(), rows); err != nil {
+		if err := s.insertChatMessages(ctx, rows); err != nil {
 			log.Printf("chat req=%s insert messages failed: %v", reqID, err)
 		} else {
 			log.Printf("chat req=%s insert messages ok", reqID)
 		}
+		var intents []string
+		if boolMeta(userMeta, "kp_accept") {
+			intents = append(intents, lead.IntentKPAccept)
+		}
+		contact, changed := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+		s.captureLead(ctx, reqID, sessionID, contact, changed, intents, 0)
 	} else {
 		log.Printf("chat req=%s session_id missing, skipping persistence", reqID)
 	}
 
-	resp := ChatResponse{Answer: answer, Products: products, Knowledge: knowledge}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
 	log.Printf("chat req=%s done products=%d knowledge=%d", reqID, len(products), len(knowledge))
+	res := &Result{Response: ChatResponse{Answer: answer, Products: products, Knowledge: knowledge}}
+	if needProducts && len(products) > 0 && !incomingQuotePDF {
+		res.Response.Actions = productActions(products, offerKp)
+	}
+	if showCards {
+		res.Cards = ProductCards(products)
+	}
+	return res, nil
+}
+
+// replyQuote builds the КП PDF for products and records the turn.
+func (s *Service) replyQuote(ctx context.Context, reqID string, req ChatRequest, history []chatMessageRow, products []SupabaseMatch, scores *TurnScores, fromDBRelay bool) (*Result, error) {
+	sessionID := strings.TrimSpace(req.SessionID)
+	contact, contactChanged := s.updateSessionContact(ctx, reqID, sessionID, history, req)
+	if sessionID != "" && contact.Phone == "" && !contactAsked(history) {
+		return s.askContact(ctx, reqID, req, history, products, fromDBRelay), nil
+	}
+	pdfStart := time.Now()
+	var quoteWarnings []string
+	if rules, err := s.compatRules(ctx); err != nil {
+		log.Printf("chat req=%s compat rules failed: %v", reqID, err)
+	} else {
+		quoteWarnings = rules.Validate(compatLinesFromProducts(products))
+		if len(quoteWarnings) > 0 {
+			log.Printf("chat req=%s quote compat warnings=%d", reqID, len(quoteWarnings))
+		}
+	}
+	pdfBytes, err := s.generateQuotePDF(products, quoteWarnings, contact)
+	if err != nil {
+		log.Printf("chat req=%s quote pdf failed: %v", reqID, err)
+		return nil, newError(http.StatusBadGateway, "quote generation failed")
+	}
+	answer := "Сформировано КП"
+	if sessionID != "" {
+		userMeta := map[string]interface{}{}
+		if hasKPOffered(history) {
+			userMeta["kp_accept"] = true
+		}
+		if scores != nil {
+			userMeta["scores"] = scores
+		}
+		total := quoteTotal(products)
+		assistantMeta := map[string]interface{}{"kp_pdf": true, "quote_ids": []int64{}, "kp_total": total}
+		if len(quoteWarnings) > 0 {
+			assistantMeta["kp_warnings"] = quoteWarnings
+		}
+		if !lead.EmptyContact(contact) {
+			assistantMeta["kp_customer"] = contactMeta(contact)
+		}
+		assistantMeta["kp_items"] = kpLinesFromProducts(products)
+		if rules, err := s.activeEscalationRules(ctx); err != nil {
+			log.Printf("chat req=%s escalation rules fetch failed: %v", reqID, err)
+		} else if state := s.maybeEscalate(ctx, sessionID, history, rules, escalationSignals{UserMessage: req.Message, QuoteTotal: total, Scores: scores}); state != nil {
+			assistantMeta["escalation"] = state
+			if state.notice != "" {
+				answer += "\n\n" + state.notice
+				assistantMeta["awaiting_callback_phone"] = true
+			}
+		}
+		rows := make([]chatMessageInsert, 0, 2)
+		if !fromDBRelay {
+			rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "user", Content: req.Message, MetaData: userMeta})
+		}
+		rows = append(rows, chatMessageInsert{SessionID: sessionID, Role: "assistant", Content: answer, MetaData: assistantMeta})
+		if err := s.insertChatMessages(ctx, rows); err != nil {
+			log.Printf("chat req=%s insert messages failed: %v", reqID, err)
+		}
+		intents := []string{lead.IntentQuote}
+		if boolMeta(userMeta, "kp_accept") {
+			intents = append(intents, lead.IntentKPAccept)
+		}
+		s.captureLead(ctx, reqID, sessionID, contact, contactChanged, intents, total)
+	}
+	log.Printf("chat req=%s quote pdf ok bytes=%d took=%s", reqID, len(pdfBytes), time.Since(pdfStart))
+	return &Result{PDF: pdfBytes, PDFName: "KP.pdf", Response: ChatResponse{Answer: answer, Actions: orderQuoteActions()}}, nil
 }
 
 func boolMeta(meta map[string]interface{}, key string) bool {
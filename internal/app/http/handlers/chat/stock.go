@@ -0,0 +1,222 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// productStockRow is a row of product_stock, one per product and warehouse;
+// the table comes from migrations/0002_product_stock.sql.
+type productStockRow struct {
+	ProductID  int64   `json:"product_id"`
+	Warehouse  string  `json:"warehouse"`
+	Quantity   float64 `json:"quantity"`
+	ExpectedAt *string `json:"expected_at"`
+}
+
+type productAvailability struct {
+	Quantity   float64
+	Warehouses []map[string]interface{}
+	// ExpectedAt is the earliest arrival date still ahead; Overdue is set when
+	// a warehouse only has arrival dates that have passed.
+	ExpectedAt time.Time
+	Overdue    bool
+}
+
+func (s *Service) fetchProductStock(ctx context.Context, ids []int64) (map[int64]*productAvailability, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	values := url.Values{}
+	values.Set("select", "product_id,warehouse,quantity,expected_at")
+	values.Set("product_id", "in.("+joinIDs(ids)+")")
+
+	urlStr := strings.TrimRight(s.Cfg.SupabaseURL, "/") + "/rest/v1/product_stock?" + values.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("apikey", s.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+s.Cfg.SupabaseServiceRoleKey)
+
+	resp, err := s.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var rows []productStockRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := make(map[int64]*productAvailability, len(rows))
+	for _, r := range rows {
+		a := out[r.ProductID]
+		if a == nil {
+			a = &productAvailability{}
+			out[r.ProductID] = a
+		}
+		qty := r.Quantity
+		if qty < 0 {
+			qty = 0
+		}
+		a.Quantity += qty
+		wh := map[string]interface{}{
+			"warehouse": strings.TrimSpace(r.Warehouse),
+			"quantity":  qty,
+		}
+		if r.ExpectedAt != nil {
+			if t := parseStockDate(*r.ExpectedAt); !t.IsZero() {
+				if leadDays(now, t) == 0 {
+					// The delivery is late; its date says nothing anymore.
+					a.Overdue = true
+				} else {
+					wh["expected_at"] = t.Format("2006-01-02")
+					if a.ExpectedAt.IsZero() || t.Before(a.ExpectedAt) {
+						a.ExpectedAt = t
+					}
+				}
+			}
+		}
+		a.Warehouses = append(a.Warehouses, wh)
+	}
+	return out, nil
+}
+
+func (s *Service) attachAvailability(ctx context.Context, products []SupabaseMatch) error {
+	if len(products) == 0 {
+		return nil
+	}
+	stock, err := s.fetchProductStock(ctx, collectProductIDs(products))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range products {
+		a, ok := stock[products[i].ID]
+		if !ok {
+			continue
+		}
+		if products[i].Metadata == nil {
+			products[i].Metadata = map[string]interface{}{}
+		}
+		meta := products[i].Metadata
+		meta["stock_qty"] = a.Quantity
+		meta["in_stock"] = a.Quantity > 0
+		meta["warehouses"] = a.Warehouses
+		if !a.ExpectedAt.IsZero() {
+			meta["expected_at"] = a.ExpectedAt.Format("2006-01-02")
+			if a.Quantity <= 0 {
+				meta["lead_days"] = leadDays(now, a.ExpectedAt)
+			}
+		}
+		meta["availability"] = formatAvailability(a, now)
+	}
+	return nil
+}
+
+// rankProductsByAvailability keeps the original order inside each group: in
+// stock, on order with an arrival date, not tracked in product_stock, and last
+// out of stock with no date or an overdue one.
+func rankProductsByAvailability(products []SupabaseMatch) []SupabaseMatch {
+	if len(products) == 0 {
+		return products
+	}
+	out := make([]SupabaseMatch, len(products))
+	copy(out, products)
+	sort.SliceStable(out, func(i, j int) bool {
+		return availabilityRank(out[i]) < availabilityRank(out[j])
+	})
+	return out
+}
+
+func availabilityRank(p SupabaseMatch) int {
+	if p.Metadata == nil {
+		return 2
+	}
+	inStock, known := p.Metadata["in_stock"].(bool)
+	switch {
+	case !known:
+		return 2
+	case inStock:
+		return 0
+	}
+	if _, ok := p.Metadata["expected_at"]; ok {
+		return 1
+	}
+	return 3
+}
+
+func formatAvailability(a *productAvailability, now time.Time) string {
+	if a == nil {
+		return ""
+	}
+	if a.Quantity > 0 {
+		return fmt.Sprintf("в наличии, %s шт", formatQty(a.Quantity))
+	}
+	if !a.ExpectedAt.IsZero() {
+		return fmt.Sprintf("под заказ, %d дн.", leadDays(now, a.ExpectedAt))
+	}
+	if a.Overdue {
+		return "под заказ, срок уточняется"
+	}
+	return "нет в наличии"
+}
+
+func productAvailabilityText(p SupabaseMatch) string {
+	if p.Metadata == nil {
+		return ""
+	}
+	v, ok := p.Metadata["availability"]
+	if !ok || v == nil {
+		return ""
+	}
+	return strings.TrimSpace(toString(v))
+}
+
+// leadDays is the number of days until the expected arrival, at least 1 for
+// a delivery due today, and 0 for a date that has passed.
+func leadDays(now, expected time.Time) int {
+	n := now.In(expected.Location())
+	today := time.Date(n.Year(), n.Month(), n.Day(), 0, 0, 0, 0, expected.Location())
+	if expected.Before(today) {
+		return 0
+	}
+	days := int(math.Ceil(expected.Sub(now).Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+func formatQty(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%d", int64(v))
+	}
+	return fmt.Sprintf("%.1f", v)
+}
+
+func parseStockDate(raw string) time.Time {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}
+	}
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t
+	}
+	return parseTime(raw)
+}
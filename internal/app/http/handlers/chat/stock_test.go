@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLeadDays(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expected string
+		want     int
+	}{
+		{"2026-03-13", 3},
+		{"2026-03-11", 1},
+		{"2026-03-10", 1},
+		{"2026-03-09", 0},
+		{"2025-12-01", 0},
+	}
+	for _, tt := range tests {
+		if got := leadDays(now, parseStockDate(tt.expected)); got != tt.want {
+			t.Errorf("leadDays(%s) = %d, want %d", tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAvailability(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		a    productAvailability
+		want string
+	}{
+		{"in stock", productAvailability{Quantity: 12}, "в наличии, 12 шт"},
+		{"on order", productAvailability{ExpectedAt: parseStockDate("2026-03-13")}, "под заказ, 3 дн."},
+		{"overdue", productAvailability{Overdue: true}, "под заказ, срок уточняется"},
+		{"out of stock", productAvailability{}, "нет в наличии"},
+	}
+	for _, tt := range tests {
+		if got := formatAvailability(&tt.a, now); got != tt.want {
+			t.Errorf("%s: formatAvailability = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRankProductsByAvailability(t *testing.T) {
+	products := []SupabaseMatch{
+		{ID: 1, Metadata: map[string]interface{}{"in_stock": false}},
+		{ID: 2},
+		{ID: 3, Metadata: map[string]interface{}{"in_stock": false, "expected_at": "2026-03-13"}},
+		{ID: 4, Metadata: map[string]interface{}{"in_stock": true}},
+		{ID: 5, Metadata: map[string]interface{}{"in_stock": true}},
+	}
+	want := []int64{4, 5, 3, 2, 1}
+	if got := collectProductIDs(rankProductsByAvailability(products)); !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
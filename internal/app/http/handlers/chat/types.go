@@ -7,12 +7,23 @@ type ChatRequest struct {
 	UserMeta    map[string]interface{} `json:"user_meta,omitempty"`
 	MatchCount  int                    `json:"match_count"`
 	TopicFilter *string                `json:"topic_filter"`
+	Action      string                 `json:"action,omitempty"`
 }
 
 type ChatResponse struct {
-	Answer    string          `json:"answer"`
-	Products  []SupabaseMatch `json:"products"`
-	Knowledge []SupabaseMatch `json:"knowledge"`
+	Answer     string           `json:"answer"`
+	Products   []SupabaseMatch  `json:"products"`
+	Knowledge  []SupabaseMatch  `json:"knowledge"`
+	Comparison *ComparisonTable `json:"comparison,omitempty"`
+	Actions    [][]ChatAction   `json:"actions,omitempty"`
+	// RequestContact asks the channel to offer its share-contact button.
+	RequestContact bool `json:"request_contact,omitempty"`
+}
+
+// ChatAction is a quick-reply button; Data is sent back as ChatRequest.Action.
+type ChatAction struct {
+	Label string `json:"label"`
+	Data  string `json:"data"`
 }
 
 type userBehaviorContext struct {
@@ -102,8 +113,9 @@ type chatMessageRow struct {
 }
 
 type chatMessageInsert struct {
-	SessionID string                 `json:"session_id"`
-	Role      string                 `json:"role"`
-	Content   string                 `json:"content"`
-	MetaData  map[string]interface{} `json:"meta_data"`
+	SessionID  string                 `json:"session_id"`
+	Role       string                 `json:"role"`
+	Content    string                 `json:"content"`
+	SenderType string                 `json:"sender_type,omitempty"`
+	MetaData   map[string]interface{} `json:"meta_data"`
 }
@@ -12,8 +12,7 @@ func appendProductLinks(answer string, products []SupabaseMatch) string {
 	b.WriteString(strings.TrimSpace(answer))
 	b.WriteString("\n\nСсылки на товары:\n")
 	for _, p := range products {
-		b.WriteString("https://apache.iq-home.kz/products/")
-		b.WriteString(strconv.FormatInt(p.ID, 10))
+		b.WriteString(ProductURL(p.ID))
 		b.WriteString("\n")
 	}
 	return strings.TrimSpace(b.String())
@@ -258,6 +257,9 @@ func extractSlots(msg string) map[string]string {
 			break
 		}
 	}
+	if room := detectRoom(m); room != "" {
+		slots["last_room"] = room
+	}
 	if len(slots) == 0 {
 		return nil
 	}
@@ -1,15 +1,36 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http"
-
-	"iq-home/go_beckend/internal/app/http/handlers/chat"
+	"strings"
 )
 
 func (h *Handlers) Chat(w http.ResponseWriter, r *http.Request) {
-	chat.New(h.Cfg, h.HTTP).Handle(w, r)
+	h.chat.Handle(w, r)
 }
 
 func (h *Handlers) ChatMedia(w http.ResponseWriter, r *http.Request) {
-	chat.New(h.Cfg, h.HTTP).HandleMedia(w, r)
+	h.chat.HandleMedia(w, r)
+}
+
+// ChatScores returns the sentiment aggregate of the session given by the
+// session_id query parameter.
+func (h *Handlers) ChatScores(w http.ResponseWriter, r *http.Request) {
+	sessionID := strings.TrimSpace(r.URL.Query().Get("session_id"))
+	if sessionID == "" {
+		http.Error(w, "session_id is required", http.StatusBadRequest)
+		return
+	}
+	scores, err := h.chat.GetSessionScores(r.Context(), sessionID)
+	if err != nil {
+		writeChatError(w, err, "scores lookup failed")
+		return
+	}
+	if scores == nil {
+		http.Error(w, "no scores for session", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scores)
 }
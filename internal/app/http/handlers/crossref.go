@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type crossrefImportItem struct {
+	CompetitorBrand   string `json:"competitor_brand"`
+	CompetitorArticle string `json:"competitor_article"`
+	ProductID         int64  `json:"product_id,omitempty"`
+	Article           string `json:"article,omitempty"`
+}
+
+type crossrefImportResult struct {
+	CompetitorBrand   string `json:"competitor_brand"`
+	CompetitorArticle string `json:"competitor_article"`
+	ProductID         int64  `json:"product_id,omitempty"`
+	Reason            string `json:"reason,omitempty"`
+}
+
+type crossrefImportResponse struct {
+	Imported []crossrefImportResult `json:"imported"`
+	Skipped  []crossrefImportResult `json:"skipped"`
+	Errors   []crossrefImportResult `json:"errors"`
+}
+
+var crossrefArticleRE = regexp.MustCompile(`[^A-Z0-9\-]`)
+
+// ImportCrossref accepts either JSON {"items":[...]} or a multipart CSV file with
+// columns competitor_brand, competitor_article and product_id or article.
+func (h *Handlers) ImportCrossref(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var items []crossrefImportItem
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "invalid multipart form", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "file is required", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		items, err = parseCrossrefCSV(file)
+		if err != nil {
+			http.Error(w, "invalid csv: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var payload struct {
+			Items []crossrefImportItem `json:"items"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		items = payload.Items
+	}
+	if len(items) == 0 {
+		http.Error(w, "no items", http.StatusBadRequest)
+		return
+	}
+
+	var resp crossrefImportResponse
+	rows := make([]map[string]interface{}, 0, len(items))
+	for _, it := range items {
+		res := crossrefImportResult{
+			CompetitorBrand:   strings.TrimSpace(it.CompetitorBrand),
+			CompetitorArticle: normalizeCrossrefArticle(it.CompetitorArticle),
+			ProductID:         it.ProductID,
+		}
+		if res.CompetitorArticle == "" {
+			res.Reason = "competitor_article is required"
+			resp.Skipped = append(resp.Skipped, res)
+			continue
+		}
+		if res.ProductID <= 0 && strings.TrimSpace(it.Article) != "" {
+			id, err := h.lookupProductID(r.Context(), strings.TrimSpace(it.Article))
+			if err != nil {
+				res.Reason = "product lookup failed"
+				resp.Errors = append(resp.Errors, res)
+				continue
+			}
+			res.ProductID = id
+		}
+		if res.ProductID <= 0 {
+			res.Reason = "product not found"
+			resp.Skipped = append(resp.Skipped, res)
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"competitor_brand":   res.CompetitorBrand,
+			"competitor_article": res.CompetitorArticle,
+			"product_id":         res.ProductID,
+		})
+		resp.Imported = append(resp.Imported, res)
+	}
+
+	if len(rows) > 0 {
+		if err := h.upsertCrossref(r.Context(), rows); err != nil {
+			for i := range resp.Imported {
+				resp.Imported[i].Reason = "db upsert failed"
+			}
+			resp.Errors = append(resp.Errors, resp.Imported...)
+			resp.Imported = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func parseCrossrefCSV(r io.Reader) ([]crossrefImportItem, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("header and at least one row are required")
+	}
+	cols := map[string]int{}
+	for i, name := range records[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	get := func(rec []string, names ...string) string {
+		for _, n := range names {
+			if i, ok := cols[n]; ok && i < len(rec) {
+				return strings.TrimSpace(rec[i])
+			}
+		}
+		return ""
+	}
+	out := make([]crossrefImportItem, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		it := crossrefImportItem{
+			CompetitorBrand:   get(rec, "competitor_brand", "brand"),
+			CompetitorArticle: get(rec, "competitor_article", "competitor"),
+			Article:           get(rec, "article", "our_article"),
+		}
+		if raw := get(rec, "product_id"); raw != "" {
+			it.ProductID, _ = strconv.ParseInt(raw, 10, 64)
+		}
+		out = append(out, it)
+	}
+	return out, nil
+}
+
+func normalizeCrossrefArticle(raw string) string {
+	return crossrefArticleRE.ReplaceAllString(strings.ToUpper(strings.TrimSpace(raw)), "")
+}
+
+func (h *Handlers) upsertCrossref(ctx context.Context, rows []map[string]interface{}) error {
+	body, err := json.Marshal(rows)
+	if err != nil {
+		return err
+	}
+
+	urlStr := strings.TrimRight(h.Cfg.SupabaseURL, "/") + "/rest/v1/competitor_crossref?on_conflict=competitor_brand,competitor_article"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apikey", h.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Authorization", "Bearer "+h.Cfg.SupabaseServiceRoleKey)
+	req.Header.Set("Prefer", "resolution=merge-duplicates,return=minimal")
+
+	resp, err := h.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("supabase status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
+)
+
+// ListEscalationRules returns every escalation rule, highest priority first.
+func (h *Handlers) ListEscalationRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.chat.ListEscalationRules(r.Context())
+	if err != nil {
+		writeChatError(w, err, "rules lookup failed")
+		return
+	}
+	if rules == nil {
+		rules = []chat.EscalationRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules})
+}
+
+// CreateEscalationRule stores a new rule. Rules are enabled unless the body
+// says otherwise.
+func (h *Handlers) CreateEscalationRule(w http.ResponseWriter, r *http.Request) {
+	rule := chat.EscalationRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	rule.ID = 0
+	saved, err := h.chat.SaveEscalationRule(r.Context(), rule)
+	if err != nil {
+		writeChatError(w, err, "rule save failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// UpdateEscalationRule replaces the rule given by the id query parameter.
+func (h *Handlers) UpdateEscalationRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	rule := chat.EscalationRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	rule.ID = id
+	saved, err := h.chat.SaveEscalationRule(r.Context(), rule)
+	if err != nil {
+		writeChatError(w, err, "rule save failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+func (h *Handlers) DeleteEscalationRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := h.chat.DeleteEscalationRule(r.Context(), id); err != nil {
+		writeChatError(w, err, "rule delete failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok": true,
+		"id": id,
+	})
+}
+
+// writeChatError reports a *chat.Error with its own status and message and
+// anything else as a 502 with fallback.
+func writeChatError(w http.ResponseWriter, err error, fallback string) {
+	var chatErr *chat.Error
+	if errors.As(err, &chatErr) {
+		http.Error(w, chatErr.Message, chatErr.Status)
+		return
+	}
+	http.Error(w, fallback, http.StatusBadGateway)
+}
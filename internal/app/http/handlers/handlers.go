@@ -1,29 +1,63 @@
 package handlers
 
 import (
+	"context"
+	"log"
 	"net/http"
 	"time"
 
+	"iq-home/go_beckend/internal/app/channel"
 	"iq-home/go_beckend/internal/app/config"
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
 	"iq-home/go_beckend/internal/infra/db/postgres"
 )
 
 type Handlers struct {
-	DB       *postgres.DB
-	Cfg      config.Config
-	HTTP     *http.Client
-	tgBuffer *telegramBuffer
+	DB         *postgres.DB
+	Cfg        config.Config
+	HTTP       *http.Client
+	telegram   *channel.Telegram
+	whatsapp   *channel.WhatsApp
+	chat       *chat.Service
+	dispatcher *channel.Dispatcher
+	dedup      *channel.Dedup
 }
 
-func New(db *postgres.DB, cfg config.Config) *Handlers {
+// New wires the handlers, creates the chat tables and starts the background
+// workers; they run until ctx is cancelled. It returns before the router
+// serves, so no request reaches a missing table.
+func New(ctx context.Context, db *postgres.DB, cfg config.Config) *Handlers {
 	h := &Handlers{
 		DB:  db,
 		Cfg: cfg,
 		HTTP: &http.Client{
 			Timeout: 15 * time.Second,
 		},
-		tgBuffer: newTelegramBuffer(),
 	}
-	h.startManagerRelay()
+	h.telegram = channel.NewTelegram(cfg, h.HTTP)
+	h.whatsapp = channel.NewWhatsApp(cfg, h.HTTP)
+	h.chat = chat.New(cfg, h.HTTP, db)
+	h.dispatcher = channel.NewDispatcher(h.chat)
+	h.dedup = channel.NewDedup(cfg, h.HTTP)
+	if err := h.chat.Migrate(ctx); err != nil {
+		log.Printf("chat: schema setup failed: %v", err)
+	}
+	go h.dedup.RunPrune(ctx)
+	go h.chat.RunEscalationJobs(ctx)
+	go h.chat.RunLeadSync(ctx)
+	go h.chat.RunOrderUpdates(ctx, h.sendMessengerText)
+	if cfg.TelegramBotToken != "" && cfg.TelegramWebhookSecret == "" && cfg.TelegramMode != "polling" {
+		log.Printf("telegram: TELEGRAM_WEBHOOK_SECRET is not set, webhook updates will be rejected")
+	}
+	if cfg.WhatsAppToken != "" && cfg.WhatsAppAppSecret == "" {
+		log.Printf("whatsapp: WHATSAPP_APP_SECRET is not set, the channel is disabled")
+	}
+	h.startManagerRelay(ctx)
+	h.startTelegramPolling(ctx)
 	return h
 }
+
+// Close waits for queued messenger updates to be answered.
+func (h *Handlers) Close(ctx context.Context) error {
+	return h.dispatcher.Close(ctx)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"iq-home/go_beckend/internal/domain/lead"
+)
+
+// ListLeads returns captured leads, newest first. Optional query parameters:
+// status and limit.
+func (h *Handlers) ListLeads(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(strings.TrimSpace(q.Get("limit")))
+	leads, err := h.chat.ListLeads(r.Context(), lead.Status(strings.TrimSpace(q.Get("status"))), limit)
+	if err != nil {
+		writeChatError(w, err, "leads lookup failed")
+		return
+	}
+	if leads == nil {
+		leads = []lead.Lead{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"leads": leads})
+}
+
+// UpdateLead sets the status of the lead given by the id query parameter; the
+// change is pushed to the CRM on the next sync.
+func (h *Handlers) UpdateLead(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Status lead.Status `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	saved, err := h.chat.SetLeadStatus(r.Context(), id, body.Status)
+	if err != nil {
+		writeChatError(w, err, "lead update failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"iq-home/go_beckend/internal/app/channel"
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
+)
+
+// isManagerChat reports whether the update comes from MANAGER_CHAT_ID or from a
+// roster manager's chat. Those updates drive the manager console instead of the
+// AI.
+func (h *Handlers) isManagerChat(ctx context.Context, u channel.Update) bool {
+	if !h.telegram.Owns(u.SessionID) {
+		return false
+	}
+	chatID := channel.TelegramChat(u.SessionID)
+	managerChat := strings.TrimPrefix(strings.TrimSpace(h.Cfg.ManagerChatID), "tg:")
+	if managerChat != "" && chatID == managerChat {
+		return true
+	}
+	return h.chat.IsRosterChat(ctx, chatID)
+}
+
+// handleManagerUpdate runs the manager console:
+//   - "Взять диалог" under an escalation turns human mode on for the session;
+//   - a reply to a console message is sent to that session's customer;
+//   - /release, as a reply or followed by the session id, gives it back to the AI.
+func (h *Handlers) handleManagerUpdate(u channel.Update) {
+	ctx := context.Background()
+	if u.Action != "" {
+		if err := h.telegram.AckAction(ctx, u); err != nil {
+			log.Printf("manager console: ack failed err=%v", err)
+		}
+		if sessionID, ok := chat.TakeDialogSession(u.Action); ok {
+			h.takeDialog(ctx, u, sessionID)
+		}
+		return
+	}
+	text := strings.TrimSpace(u.Text)
+	if cmd, arg, _ := strings.Cut(text, " "); cmd == "/release" {
+		sessionID := strings.TrimSpace(arg)
+		if sessionID == "" {
+			sessionID = chat.ConsoleSession(u.ReplyText)
+		}
+		if sessionID == "" {
+			h.consoleReply(ctx, u, "Ответьте /release на сообщение клиента или укажите чат: /release <чат>.")
+			return
+		}
+		h.releaseDialog(ctx, u, sessionID)
+		return
+	}
+	sessionID := chat.ConsoleSession(u.ReplyText)
+	if sessionID == "" || text == "" {
+		if u.Media != nil && sessionID != "" {
+			h.consoleReply(ctx, u, "Файлы клиенту из консоли пока не пересылаются, только текст.")
+		}
+		return
+	}
+	if err := h.chat.SetHumanMode(ctx, sessionID, true); err != nil {
+		log.Printf("manager console: human mode failed session_id=%s err=%v", sessionID, err)
+	}
+	if err := h.chat.MirrorManagerReply(ctx, sessionID, u.UserName, text); err != nil {
+		log.Printf("manager console: mirror failed session_id=%s err=%v", sessionID, err)
+		h.consoleReply(ctx, u, chat.ConsoleText(sessionID, "Не удалось отправить ответ, попробуйте ещё раз."))
+		return
+	}
+	log.Printf("manager console: reply session_id=%s manager=%s", sessionID, u.UserName)
+}
+
+func (h *Handlers) takeDialog(ctx context.Context, u channel.Update, sessionID string) {
+	if err := h.chat.SetHumanMode(ctx, sessionID, true); err != nil {
+		log.Printf("manager console: take failed session_id=%s err=%v", sessionID, err)
+		h.consoleReply(ctx, u, chat.ConsoleText(sessionID, "Не удалось взять диалог, попробуйте ещё раз."))
+		return
+	}
+	log.Printf("manager console: taken session_id=%s manager=%s", sessionID, u.UserName)
+	if err := h.chat.ClaimSession(ctx, sessionID, u.UserID); err != nil {
+		log.Printf("manager console: claim failed session_id=%s err=%v", sessionID, err)
+	}
+	if err := h.chat.MirrorManagerReply(ctx, sessionID, u.UserName, "К диалогу подключился менеджер, отвечу здесь."); err != nil {
+		log.Printf("manager console: mirror failed session_id=%s err=%v", sessionID, err)
+	}
+	transcript, err := h.chat.Transcript(ctx, sessionID, 10)
+	if err != nil {
+		log.Printf("manager console: transcript failed session_id=%s err=%v", sessionID, err)
+	}
+	msg := "Диалог взял " + u.UserName + ". Отвечайте reply на сообщения этого чата, /release — вернуть ИИ."
+	if transcript != "" {
+		msg += "\n\n" + transcript
+	}
+	h.consoleReply(ctx, u, chat.ConsoleText(sessionID, msg))
+}
+
+func (h *Handlers) releaseDialog(ctx context.Context, u channel.Update, sessionID string) {
+	if err := h.chat.SetHumanMode(ctx, sessionID, false); err != nil {
+		log.Printf("manager console: release failed session_id=%s err=%v", sessionID, err)
+		h.consoleReply(ctx, u, chat.ConsoleText(sessionID, "Не удалось вернуть диалог ИИ, попробуйте ещё раз."))
+		return
+	}
+	log.Printf("manager console: released session_id=%s manager=%s", sessionID, u.UserName)
+	if err := h.chat.ReleaseSession(ctx, sessionID); err != nil {
+		log.Printf("manager console: unassign failed session_id=%s err=%v", sessionID, err)
+	}
+	if err := h.sendMessengerText(ctx, sessionID, "Менеджер завершил диалог. Дальше вам снова помогает ассистент."); err != nil {
+		log.Printf("manager console: release notice failed session_id=%s err=%v", sessionID, err)
+	}
+	h.consoleReply(ctx, u, chat.ConsoleText(sessionID, "Диалог возвращён ИИ."))
+}
+
+func (h *Handlers) consoleReply(ctx context.Context, u channel.Update, text string) {
+	if err := h.telegram.SendText(ctx, u.SessionID, text); err != nil {
+		log.Printf("manager console: send failed err=%v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"iq-home/go_beckend/internal/domain/ai/messenger"
+)
+
+// The manager relay forwards replies written by managers (admin panel or the
+// Telegram console) to messenger customers. A trigger on chat_messages NOTIFYs
+// relayChannel with the new id; the relay then reads everything past its
+// persisted cursor. Polling covers lost notifications and a broken LISTEN
+// connection.
+//
+// Ids are taken at insert but become visible at commit, so a message can show
+// up after rows with higher ids. Every pass therefore rescans the messages
+// below the cursor created within relayLateWindow; messages already sent are
+// dropped by the dedup store, which remembers them far longer than that.
+//
+// A message is recorded as sent only once the messenger accepted it. A failed
+// send keeps the cursor below the message, so the next pass retries it, up to
+// relayMaxAttempts times.
+const (
+	relayChannel      = "manager_messages"
+	relayCursorName   = "manager_relay"
+	relayBatch        = 100
+	relayLateWindow   = 10 * time.Minute
+	relayMaxAttempts  = 5
+	relayPollInterval = 3 * time.Second
+	relaySafetyPoll   = 30 * time.Second
+	relayReconnect    = 10 * time.Second
+)
+
+const relaySchema = `
+CREATE TABLE IF NOT EXISTS relay_cursors (
+	name       text PRIMARY KEY,
+	last_id    bigint NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE OR REPLACE FUNCTION notify_manager_message() RETURNS trigger AS $$
+BEGIN
+	IF NEW.sender_type IN ('manager', 'human_admin') OR NEW.role = 'manager' THEN
+		PERFORM pg_notify('manager_messages', NEW.id::text);
+	END IF;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER chat_messages_notify_manager
+	AFTER INSERT ON chat_messages
+	FOR EACH ROW EXECUTE FUNCTION notify_manager_message();
+`
+
+type managerMessage struct {
+	ID          int64
+	SessionID   string
+	Content     string
+	IsHumanMode bool
+}
+
+func (h *Handlers) startManagerRelay(ctx context.Context) {
+	if h.DB == nil || h.DB.Pool == nil {
+		log.Printf("manager relay: database not configured, skipping")
+		return
+	}
+	if h.Cfg.TelegramBotToken == "" && h.Cfg.WhatsAppToken == "" {
+		log.Printf("manager relay: messengers not configured, skipping")
+		return
+	}
+	go h.runManagerRelay(ctx)
+}
+
+func (h *Handlers) runManagerRelay(ctx context.Context) {
+	if _, err := h.DB.Pool.Exec(ctx, relaySchema); err != nil {
+		log.Printf("manager relay: schema setup failed: %v", err)
+	}
+	// Starting without a cursor would either skip or replay messages, so wait
+	// for the database instead.
+	var lastID int64
+	for {
+		var err error
+		lastID, err = h.loadRelayCursor(ctx)
+		if err == nil {
+			break
+		}
+		log.Printf("manager relay: cursor load failed: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(relayReconnect):
+		}
+	}
+	log.Printf("manager relay: started last_id=%d", lastID)
+
+	var listening atomic.Bool
+	wake := make(chan struct{}, 1)
+	go h.listenManagerMessages(ctx, wake, &listening)
+
+	ticker := time.NewTicker(relayPollInterval)
+	defer ticker.Stop()
+	lastPoll := time.Time{}
+	st := &relayState{lastID: lastID, handled: map[int64]bool{}, failures: map[int64]int{}}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+			if listening.Load() && time.Since(lastPoll) < relaySafetyPoll {
+				continue
+			}
+		}
+		lastPoll = time.Now()
+		h.relayPending(ctx, st)
+	}
+}
+
+// listenManagerMessages keeps a LISTEN connection open and wakes the relay on
+// every notification. While it is down the relay polls every few seconds.
+func (h *Handlers) listenManagerMessages(ctx context.Context, wake chan<- struct{}, listening *atomic.Bool) {
+	for ctx.Err() == nil {
+		err := h.waitManagerNotifications(ctx, wake, listening)
+		listening.Store(false)
+		log.Printf("manager relay: listen stopped, polling: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(relayReconnect):
+		}
+	}
+}
+
+func (h *Handlers) waitManagerNotifications(ctx context.Context, wake chan<- struct{}, listening *atomic.Bool) error {
+	pooled, err := h.DB.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection stays in LISTEN mode, so it is taken out of the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+relayChannel); err != nil {
+		return err
+	}
+	listening.Store(true)
+	notify(wake)
+	for {
+		if _, err := conn.WaitForNotification(ctx); err != nil {
+			return err
+		}
+		notify(wake)
+	}
+}
+
+func notify(wake chan<- struct{}) {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// relayState is what the relay loop carries between passes. lastID is the
+// persisted cursor: every message up to it was sent, skipped or given up on.
+// handled holds the ids above the cursor, or in the late window below it,
+// that this process already passed on; failures counts failed sends.
+type relayState struct {
+	lastID   int64
+	handled  map[int64]bool
+	failures map[int64]int
+}
+
+// relayPending delivers every manager message after the cursor, and the late
+// commits within relayLateWindow below it, and moves the cursor up to the
+// first message still waiting for a retry.
+func (h *Handlers) relayPending(ctx context.Context, st *relayState) {
+	from := int64(0)
+	cursor := st.lastID
+	blocked := false
+	for {
+		msgs, err := h.fetchManagerMessagesSince(ctx, from, st.lastID)
+		if err != nil {
+			log.Printf("manager relay: fetch failed: %v", err)
+			break
+		}
+		for _, m := range msgs {
+			from = m.ID
+			if !st.handled[m.ID] {
+				if err := h.relayManagerMessage(ctx, m); err != nil {
+					st.failures[m.ID]++
+					log.Printf("manager relay: send failed session_id=%s msg_id=%d attempt=%d err=%v", m.SessionID, m.ID, st.failures[m.ID], err)
+					if st.failures[m.ID] < relayMaxAttempts {
+						blocked = blocked || m.ID > st.lastID
+						continue
+					}
+					log.Printf("manager relay: giving up session_id=%s msg_id=%d", m.SessionID, m.ID)
+				}
+				delete(st.failures, m.ID)
+				st.handled[m.ID] = true
+			}
+			if !blocked && m.ID > cursor {
+				cursor = m.ID
+			}
+		}
+		if len(msgs) < relayBatch {
+			break
+		}
+	}
+	if cursor > st.lastID {
+		if err := h.saveRelayCursor(ctx, cursor); err != nil {
+			log.Printf("manager relay: cursor save failed last_id=%d err=%v", cursor, err)
+		} else {
+			st.lastID = cursor
+		}
+	}
+	// Ids at or below the cursor are only seen again through the late window,
+	// where the dedup store covers a restart anyway; keep the set small.
+	if len(st.handled) > 10*relayBatch {
+		for id := range st.handled {
+			if id <= st.lastID-10*relayBatch {
+				delete(st.handled, id)
+			}
+		}
+	}
+}
+
+// relayManagerMessage forwards one message. The dedup entry claims it before
+// the send, so replicas do not both send it, and is dropped again when the send
+// fails, so the retry is not taken for a duplicate.
+func (h *Handlers) relayManagerMessage(ctx context.Context, m managerMessage) error {
+	id := strconv.FormatInt(m.ID, 10)
+	switch {
+	case !messenger.IsMessengerSession(m.SessionID) || strings.TrimSpace(m.Content) == "":
+		log.Printf("manager relay: skip session_id=%s msg_id=%d", m.SessionID, m.ID)
+	case !m.IsHumanMode:
+		log.Printf("manager relay: skip session_id=%s msg_id=%d human_mode=false", m.SessionID, m.ID)
+	case h.dedup.Seen(ctx, "relay", id):
+		log.Printf("manager relay: already sent session_id=%s msg_id=%d", m.SessionID, m.ID)
+	default:
+		log.Printf("manager relay: forward session_id=%s msg_id=%d", m.SessionID, m.ID)
+		if err := h.sendMessengerText(ctx, m.SessionID, m.Content); err != nil {
+			if ferr := h.dedup.Forget(ctx, "relay", id); ferr != nil {
+				log.Printf("manager relay: dedup forget failed msg_id=%d err=%v", m.ID, ferr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchManagerMessagesSince returns the manager messages after id from that are
+// either past the cursor or recent enough to be a late commit.
+func (h *Handlers) fetchManagerMessagesSince(ctx context.Context, from, cursor int64) ([]managerMessage, error) {
+	rows, err := h.DB.Pool.Query(ctx, `
+		SELECT m.id, m.session_id, coalesce(m.content, ''), coalesce(s.is_human_mode, false)
+		FROM chat_messages m
+		LEFT JOIN chat_sessions s ON s.session_id = m.session_id
+		WHERE m.id > $1
+		  AND (m.id > $2 OR m.created_at > now() - $4::interval)
+		  AND (m.sender_type IN ('manager', 'human_admin') OR m.role = 'manager')
+		ORDER BY m.id
+		LIMIT $3`, from, cursor, relayBatch, fmt.Sprintf("%d seconds", int(relayLateWindow/time.Second)))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[managerMessage])
+}
+
+// loadRelayCursor returns the saved cursor. Without one the relay starts at the
+// newest message instead of replaying the whole table.
+func (h *Handlers) loadRelayCursor(ctx context.Context) (int64, error) {
+	var lastID int64
+	err := h.DB.Pool.QueryRow(ctx, `SELECT last_id FROM relay_cursors WHERE name = $1`, relayCursorName).Scan(&lastID)
+	if err == nil {
+		return lastID, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+	if err := h.DB.Pool.QueryRow(ctx, `SELECT coalesce(max(id), 0) FROM chat_messages`).Scan(&lastID); err != nil {
+		return 0, err
+	}
+	return lastID, h.saveRelayCursor(ctx, lastID)
+}
+
+func (h *Handlers) saveRelayCursor(ctx context.Context, lastID int64) error {
+	_, err := h.DB.Pool.Exec(ctx, `
+		INSERT INTO relay_cursors (name, last_id, updated_at) VALUES ($1, $2, now())
+		ON CONFLICT (name) DO UPDATE SET last_id = excluded.last_id, updated_at = excluded.updated_at`,
+		relayCursorName, lastID)
+	return err
+}
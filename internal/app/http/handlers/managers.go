@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"iq-home/go_beckend/internal/app/http/handlers/chat"
+)
+
+// ListManagers returns the manager roster with open session counts.
+func (h *Handlers) ListManagers(w http.ResponseWriter, r *http.Request) {
+	managers, err := h.chat.ListManagers(r.Context())
+	if err != nil {
+		writeChatError(w, err, "managers lookup failed")
+		return
+	}
+	if managers == nil {
+		managers = []chat.Manager{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"managers": managers})
+}
+
+// CreateManager adds a manager to the roster, active unless the body says
+// otherwise.
+func (h *Handlers) CreateManager(w http.ResponseWriter, r *http.Request) {
+	m := chat.Manager{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	m.ID = 0
+	saved, err := h.chat.SaveManager(r.Context(), m)
+	if err != nil {
+		writeChatError(w, err, "manager save failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// UpdateManager replaces the manager given by the id query parameter.
+func (h *Handlers) UpdateManager(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	m := chat.Manager{Active: true}
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	m.ID = id
+	saved, err := h.chat.SaveManager(r.Context(), m)
+	if err != nil {
+		writeChatError(w, err, "manager save failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+func (h *Handlers) DeleteManager(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimSpace(r.URL.Query().Get("id")), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := h.chat.DeleteManager(r.Context(), id); err != nil {
+		writeChatError(w, err, "manager delete failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok": true,
+		"id": id,
+	})
+}
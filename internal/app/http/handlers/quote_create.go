@@ -13,6 +13,7 @@ type CreateQuoteRequest struct {
 	Customer struct {
 		Name  string `json:"name"`
 		Phone string `json:"phone"`
+		Email string `json:"email"`
 		City  string `json:"city"`
 	} `json:"customer"`
 	Items []struct {
@@ -20,6 +21,8 @@ type CreateQuoteRequest struct {
 		Qty       int   `json:"qty"`
 		Name      string `json:"name"`       // временно: можно передавать с фронта/n8n
 		UnitPrice int64  `json:"unit_price"` // временно: потом будем тянуть из БД
+
+		Availability string `json:"availability"`
 	} `json:"items"`
 	DiscountPercent int    `json:"discount_percent"`
 	Comment         string `json:"comment"`
@@ -38,6 +41,7 @@ func (h *Handlers) CreateQuote(w http.ResponseWriter, r *http.Request) {
 		Customer: quote.Customer{
 			Name:  req.Customer.Name,
 			Phone: req.Customer.Phone,
+			Email: req.Customer.Email,
 			City:  req.Customer.City,
 		},
 		DiscountPercent: req.DiscountPercent,
@@ -57,6 +61,8 @@ func (h *Handlers) CreateQuote(w http.ResponseWriter, r *http.Request) {
 			Qty:       it.Qty,
 			UnitPrice: it.UnitPrice,
 			LineTotal: line,
+
+			Availability: it.Availability,
 		})
 		subtotal += line
 	}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// WhatsAppWebhook serves the Cloud API subscription handshake (GET) and inbound
+// message notifications (POST). The channel stays off until the app secret is
+// set, since unsigned notifications cannot be told from forged ones.
+func (h *Handlers) WhatsAppWebhook(w http.ResponseWriter, r *http.Request) {
+	if h.Cfg.WhatsAppToken == "" || h.Cfg.WhatsAppPhoneNumberID == "" || h.Cfg.WhatsAppAppSecret == "" {
+		http.Error(w, "whatsapp not configured", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		challenge, ok := h.whatsapp.Verify(r)
+		if !ok {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(challenge))
+		return
+	}
+	h.receiveUpdates(w, r, h.whatsapp)
+}
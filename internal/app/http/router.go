@@ -1,6 +1,7 @@
 package http
 
 import (
+	"expvar"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -8,22 +9,21 @@ import (
 	"iq-home/go_beckend/internal/app/config"
 	"iq-home/go_beckend/internal/app/http/handlers"
 	"iq-home/go_beckend/internal/app/http/middleware"
-	"iq-home/go_beckend/internal/infra/db/postgres"
 )
 
-func NewRouter(cfg config.Config, db *postgres.DB) http.Handler {
+func NewRouter(cfg config.Config, h *handlers.Handlers) http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logging)
 	r.Use(middleware.CORS(cfg.CORSAllowOrigin))
 
-	h := handlers.New(db, cfg)
-
 	r.Get("/health", h.Health)
 
 	r.Route("/v1", func(r chi.Router) {
 
 		r.Post("/telegram/webhook", h.TelegramWebhook)
+		r.Get("/whatsapp/webhook", h.WhatsAppWebhook)
+		r.Post("/whatsapp/webhook", h.WhatsAppWebhook)
 
 		r.Group(func(r chi.Router) {
 			r.Use(middleware.InternalAuth(cfg.InternalToken))
@@ -31,10 +31,25 @@ func NewRouter(cfg config.Config, db *postgres.DB) http.Handler {
 			r.Post("/quotes", h.CreateQuote)
 			r.Post("/chat", h.Chat)
 			r.Post("/chat/media", h.ChatMedia)
+			r.Get("/chat/scores", h.ChatScores)
 			r.Post("/products/images", h.UploadProductImages)
 			r.Post("/products/images/item", h.AddProductImage)
 			r.Put("/products/images/item", h.UpdateProductImage)
 			r.Delete("/products/images/item", h.DeleteProductImage)
+			r.Post("/crossref/import", h.ImportCrossref)
+			r.Get("/escalation/rules", h.ListEscalationRules)
+			r.Post("/escalation/rules", h.CreateEscalationRule)
+			r.Put("/escalation/rules", h.UpdateEscalationRule)
+			r.Delete("/escalation/rules", h.DeleteEscalationRule)
+			r.Get("/managers", h.ListManagers)
+			r.Post("/managers", h.CreateManager)
+			r.Put("/managers", h.UpdateManager)
+			r.Delete("/managers", h.DeleteManager)
+			r.Get("/business-hours", h.BusinessHours)
+			r.Put("/business-hours", h.UpdateBusinessHours)
+			r.Get("/leads", h.ListLeads)
+			r.Put("/leads", h.UpdateLead)
+			r.Method(http.MethodGet, "/debug/vars", expvar.Handler())
 		})
 	})
 
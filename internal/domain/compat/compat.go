@@ -0,0 +1,299 @@
+package compat
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Kind string
+
+const (
+	KindUnknown   Kind = ""
+	KindFrame     Kind = "frame"
+	KindMechanism Kind = "mechanism"
+	KindCover     Kind = "cover"
+)
+
+type SeriesRule struct {
+	Series        string
+	FramePosts    []int               // допустимое число постов рамки, напр. [1,2,3,4,5]
+	FrameSeries   []string            // серии рамок, подходящие к механизмам серии (кроме своей)
+	ColorFamilies map[string][]string // семейство -> подстроки цветов
+}
+
+type Rules struct {
+	Series map[string]SeriesRule
+}
+
+type Line struct {
+	ProductID int64
+	Name      string
+	Type      string
+	Series    string
+	Color     string
+	Qty       int
+}
+
+type FramePlan struct {
+	Series string
+	Points int
+	Frames []int
+}
+
+var postsRE = regexp.MustCompile(`(?i)(\d+)\s*-?\s*(пост|мест|gang)`)
+
+func NewRules(rules []SeriesRule) Rules {
+	out := Rules{Series: make(map[string]SeriesRule, len(rules))}
+	for _, r := range rules {
+		key := normalize(r.Series)
+		if key == "" {
+			continue
+		}
+		out.Series[key] = r
+	}
+	return out
+}
+
+func (r Rules) Lookup(series string) (SeriesRule, bool) {
+	if r.Series == nil {
+		return SeriesRule{}, false
+	}
+	rule, ok := r.Series[normalize(series)]
+	return rule, ok
+}
+
+// kindPatterns match the head nouns of product names at word starts, so
+// "Выключатель одноклавишный" stays a mechanism and "Розетка с рамкой" is not
+// a frame. The earliest match in the text decides the kind.
+var kindPatterns = []struct {
+	kind Kind
+	re   *regexp.Regexp
+}{
+	{KindFrame, regexp.MustCompile(`(?:^|[^\p{L}])(?:рамк[аиуео]|frame)`)},
+	{KindCover, regexp.MustCompile(`(?:^|[^\p{L}])(?:накладк|лицев\S*\s+панел|клавиш(?:а|и|у|ей|ами)?(?:[^\p{L}]|$)|cover)`)},
+	{KindMechanism, regexp.MustCompile(`(?:^|[^\p{L}])(?:механизм|розет|выключ|диммер|светорегулятор|переключ|rj-?45|tv(?:[^\p{L}]|$))`)},
+}
+
+// KindOf classifies a catalog line. The product type is trusted over the name;
+// within each, the first matching term wins.
+func KindOf(productType, name string) Kind {
+	if k := kindOfText(productType); k != KindUnknown {
+		return k
+	}
+	return kindOfText(name)
+}
+
+func kindOfText(text string) Kind {
+	src := strings.ToLower(text)
+	kind, first := KindUnknown, -1
+	for _, p := range kindPatterns {
+		loc := p.re.FindStringIndex(src)
+		if loc != nil && (first < 0 || loc[0] < first) {
+			kind, first = p.kind, loc[0]
+		}
+	}
+	return kind
+}
+
+func FramePostsFromName(name string) int {
+	m := postsRE.FindStringSubmatch(name)
+	if len(m) < 2 {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 || n > 10 {
+		return 0
+	}
+	return n
+}
+
+// PlanFrames splits the number of points into frames allowed by the series rule,
+// preferring the largest frames. Without a rule a single frame per point is assumed.
+func (r Rules) PlanFrames(series string, points int) FramePlan {
+	plan := FramePlan{Series: series, Points: points}
+	if points <= 0 {
+		return plan
+	}
+	sizes := []int{1}
+	if rule, ok := r.Lookup(series); ok && len(rule.FramePosts) > 0 {
+		sizes = append([]int(nil), rule.FramePosts...)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+	left := points
+	for left > 0 {
+		picked := 0
+		for _, size := range sizes {
+			if size > 0 && size <= left {
+				picked = size
+				break
+			}
+		}
+		if picked == 0 {
+			picked = sizes[len(sizes)-1]
+			if picked <= 0 {
+				picked = 1
+			}
+		}
+		plan.Frames = append(plan.Frames, picked)
+		left -= picked
+	}
+	return plan
+}
+
+func (p FramePlan) Text() string {
+	if p.Points <= 0 || len(p.Frames) == 0 {
+		return ""
+	}
+	series := ""
+	if strings.TrimSpace(p.Series) != "" {
+		series = " серии " + strings.TrimSpace(p.Series)
+	}
+	parts := make([]string, 0, len(p.Frames))
+	for _, f := range p.Frames {
+		parts = append(parts, fmt.Sprintf("рамка на %d %s", f, Plural(f, "пост", "поста", "постов")))
+	}
+	return fmt.Sprintf("для %d %s%s нужна %s", p.Points, Plural(p.Points, "механизма", "механизмов", "механизмов"), series, strings.Join(parts, " + "))
+}
+
+func (r Rules) FrameFits(mechanismSeries, frameSeries string) bool {
+	ms, fs := normalize(mechanismSeries), normalize(frameSeries)
+	if ms == "" || fs == "" || ms == fs {
+		return true
+	}
+	rule, ok := r.Lookup(mechanismSeries)
+	if !ok {
+		return false
+	}
+	for _, s := range rule.FrameSeries {
+		if normalize(s) == fs {
+			return true
+		}
+	}
+	return false
+}
+
+// ColorFamily returns the color family of a series color, comparable across
+// series: the family of the series rule the color belongs to, or else the
+// base color itself, so "белый" and "Белая матовая" are one family.
+func (r Rules) ColorFamily(series, color string) string {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color == "" {
+		return ""
+	}
+	if rule, ok := r.Lookup(series); ok {
+		for family, shades := range rule.ColorFamilies {
+			for _, shade := range shades {
+				if shade = strings.ToLower(strings.TrimSpace(shade)); shade != "" && strings.Contains(color, shade) {
+					return baseColor(family)
+				}
+			}
+		}
+	}
+	return baseColor(color)
+}
+
+// finishWords describe the surface, not the color.
+var finishWords = []string{"матов", "глянц", "металлик", "перламутр", "soft", "touch", "софт", "тач"}
+
+var colorEndingRE = regexp.MustCompile(`(?:ый|ий|ой|ая|яя|ое|ее|ые|ие)$`)
+
+// baseColor reduces a color name to its stem without finish words and
+// adjective endings: "Белый матовый" and "белая" both give "бел".
+func baseColor(color string) string {
+	words := strings.FieldsFunc(strings.ReplaceAll(strings.ToLower(color), "ё", "е"), func(r rune) bool {
+		return r == ' ' || r == ',' || r == '/' || r == '(' || r == ')'
+	})
+	for _, w := range words {
+		finish := false
+		for _, f := range finishWords {
+			if strings.HasPrefix(w, f) {
+				finish = true
+				break
+			}
+		}
+		if !finish {
+			return colorEndingRE.ReplaceAllString(w, "")
+		}
+	}
+	return strings.TrimSpace(strings.ToLower(color))
+}
+
+// Validate returns human readable warnings about mismatched series, colors and
+// frame capacity. An empty result means the set looks consistent.
+func (r Rules) Validate(lines []Line) []string {
+	var frames, mechanisms, covers []Line
+	points := 0
+	posts := 0
+	for _, l := range lines {
+		qty := l.Qty
+		if qty <= 0 {
+			qty = 1
+		}
+		switch KindOf(l.Type, l.Name) {
+		case KindFrame:
+			frames = append(frames, l)
+			posts += FramePostsFromName(l.Name) * qty
+		case KindMechanism:
+			mechanisms = append(mechanisms, l)
+			points += qty
+		case KindCover:
+			covers = append(covers, l)
+		}
+	}
+
+	var warnings []string
+	seen := map[string]struct{}{}
+	add := func(w string) {
+		if _, ok := seen[w]; ok {
+			return
+		}
+		seen[w] = struct{}{}
+		warnings = append(warnings, w)
+	}
+
+	for _, m := range mechanisms {
+		for _, c := range covers {
+			if ms, cs := normalize(m.Series), normalize(c.Series); ms != "" && cs != "" && ms != cs {
+				add(fmt.Sprintf("Серии не совпадают: механизм «%s» (%s) и накладка «%s» (%s)", m.Name, m.Series, c.Name, c.Series))
+			}
+		}
+	}
+	fitted := append(append([]Line(nil), mechanisms...), covers...)
+	for _, o := range fitted {
+		for _, f := range frames {
+			if !r.FrameFits(o.Series, f.Series) {
+				add(fmt.Sprintf("Серии не совпадают: «%s» (%s) и рамка «%s» (%s)", o.Name, o.Series, f.Name, f.Series))
+				continue
+			}
+			oc := r.ColorFamily(o.Series, o.Color)
+			fc := r.ColorFamily(f.Series, f.Color)
+			if oc != "" && fc != "" && oc != fc {
+				add(fmt.Sprintf("Цвета не сочетаются: «%s» (%s) и рамка «%s» (%s)", o.Name, o.Color, f.Name, f.Color))
+			}
+		}
+	}
+	if len(frames) > 0 && posts > 0 && points > posts {
+		add(fmt.Sprintf("Механизмов %d, а мест в рамках %d", points, posts))
+	}
+	return warnings
+}
+
+func Plural(n int, one, few, many string) string {
+	if n < 0 {
+		n = -n
+	}
+	if n%10 == 1 && n%100 != 11 {
+		return one
+	}
+	if n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20) {
+		return few
+	}
+	return many
+}
+
+func normalize(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
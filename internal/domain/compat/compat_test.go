@@ -0,0 +1,149 @@
+package compat
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRules() Rules {
+	return NewRules([]SeriesRule{
+		{
+			Series:        "FD",
+			FramePosts:    []int{1, 2, 3, 4, 5},
+			FrameSeries:   []string{"FS"},
+			ColorFamilies: map[string][]string{"белый": {"бел", "white"}, "черный": {"черн", "black"}},
+		},
+		{Series: "G", FramePosts: []int{1, 2, 3}},
+	})
+}
+
+func TestKindOf(t *testing.T) {
+	tests := []struct {
+		productType string
+		name        string
+		want        Kind
+	}{
+		{"", "Рамка 2-постовая FD белая", KindFrame},
+		{"", "Розетка с рамкой, белая", KindMechanism},
+		{"", "Выключатель одноклавишный", KindMechanism},
+		{"", "Клавиша для выключателя", KindCover},
+		{"", "Накладка для розетки TV", KindCover},
+		{"", "Розетка RJ45", KindMechanism},
+		{"рамка", "Розетка двойная", KindFrame},
+		{"", "Кабель ВВГ 3х2,5", KindUnknown},
+		{"", "Клавишный выключатель", KindMechanism},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := KindOf(tt.productType, tt.name); got != tt.want {
+				t.Errorf("KindOf(%q, %q) = %q, want %q", tt.productType, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanFrames(t *testing.T) {
+	r := testRules()
+	tests := []struct {
+		series string
+		points int
+		want   []int
+	}{
+		{"FD", 7, []int{5, 2}},
+		{"fd", 5, []int{5}},
+		{"G", 7, []int{3, 3, 1}},
+		{"unknown", 3, []int{1, 1, 1}},
+		{"FD", 0, nil},
+	}
+	for _, tt := range tests {
+		if got := r.PlanFrames(tt.series, tt.points).Frames; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PlanFrames(%q, %d) = %v, want %v", tt.series, tt.points, got, tt.want)
+		}
+	}
+}
+
+func TestColorFamily(t *testing.T) {
+	r := testRules()
+	tests := []struct {
+		series string
+		color  string
+		want   string
+	}{
+		{"FD", "White", "бел"},
+		{"FD", "Белый матовый", "бел"},
+		{"G", "белая", "бел"},
+		{"G", "матовый белый", "бел"},
+		{"G", "Чёрный", "черн"},
+		{"G", "антрацит", "антрацит"},
+		{"G", "", ""},
+	}
+	for _, tt := range tests {
+		if got := r.ColorFamily(tt.series, tt.color); got != tt.want {
+			t.Errorf("ColorFamily(%q, %q) = %q, want %q", tt.series, tt.color, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	r := testRules()
+	tests := []struct {
+		name  string
+		lines []Line
+		want  []string // substrings, one per expected warning
+	}{
+		{
+			name: "consistent set",
+			lines: []Line{
+				{Name: "Рамка 2 поста", Series: "FD", Color: "белый"},
+				{Name: "Розетка", Series: "FD", Color: "белый матовый", Qty: 2},
+				{Name: "Накладка для розетки", Series: "FD", Color: "white", Qty: 2},
+			},
+		},
+		{
+			name: "frame of a fitting series",
+			lines: []Line{
+				{Name: "Рамка 1 пост", Series: "FS", Color: "белая"},
+				{Name: "Выключатель", Series: "FD", Color: "белый"},
+			},
+		},
+		{
+			name: "series mismatch",
+			lines: []Line{
+				{Name: "Розетка", Series: "FD"},
+				{Name: "Накладка для розетки", Series: "G"},
+				{Name: "Рамка 1 пост", Series: "G"},
+			},
+			want: []string{"механизм «Розетка» (FD) и накладка", "«Розетка» (FD) и рамка"},
+		},
+		{
+			name: "color mismatch",
+			lines: []Line{
+				{Name: "Рамка 1 пост", Series: "FD", Color: "черный"},
+				{Name: "Розетка", Series: "FD", Color: "белый"},
+			},
+			want: []string{"Цвета не сочетаются"},
+		},
+		{
+			name: "too few posts",
+			lines: []Line{
+				{Name: "Рамка 2 поста", Series: "FD"},
+				{Name: "Розетка", Series: "FD", Qty: 3},
+			},
+			want: []string{"Механизмов 3, а мест в рамках 2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Validate(tt.lines)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Validate = %q, want %d warnings", got, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !strings.Contains(got[i], w) {
+					t.Errorf("warning %d = %q, want it to mention %q", i, got[i], w)
+				}
+			}
+		})
+	}
+}
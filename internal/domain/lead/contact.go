@@ -0,0 +1,132 @@
+package lead
+
+import (
+	"regexp"
+	"strings"
+
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+var (
+	// phoneRe matches +7/8 numbers written with spaces, dashes or brackets:
+	// "+7 (701) 123-45-67", "8 701 123 45 67", "87011234567". The surrounding
+	// groups keep it from matching inside longer digit runs such as order ids.
+	phoneRe = regexp.MustCompile(`(?:^|[^\d+])((?:\+7|8|7)[\s\-(]*\d{3}[\s\-)]*\d{3}[\s\-]*\d{2}[\s\-]*\d{2})(?:$|\D)`)
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	// nameRe takes the word after "меня зовут", "моё имя" or "имя:"; a bare
+	// "имя" only at the start of the message, so "на имя компании" is no name.
+	nameRe = regexp.MustCompile(`(?i)(?:меня зовут|мо[её] имя|(?:^|[^\p{L}])имя\s*:|^\s*имя)\s*([а-яёa-z][а-яёa-z\-]{1,30})`)
+
+	// nameStopWords follow "имя" without being a name.
+	nameStopWords = map[string]bool{"компании": true, "фирмы": true, "организации": true, "тоо": true, "ип": true, "заказчика": true, "получателя": true}
+
+	// cities maps a lowercase city name with its case endings to the city, so
+	// "в Алмате" or "из Караганды" match but "семейный" is not Семей.
+	cities = []struct {
+		re   *regexp.Regexp
+		name string
+	}{
+		{cityRe(`алмат(?:ы|е|у|ой)|almaty`), "Алматы"},
+		{cityRe(`астан(?:а|ы|е|у|ой)|astana|нур-султан(?:а|е|у|ом)?`), "Астана"},
+		{cityRe(`шымкент(?:а|е|у|ом)?|shymkent`), "Шымкент"},
+		{cityRe(`караганд(?:а|ы|е|у|ой)`), "Караганда"},
+		{cityRe(`актобе`), "Актобе"},
+		{cityRe(`тараз(?:а|е|у|ом)?`), "Тараз"},
+		{cityRe(`павлодар(?:а|е|у|ом)?`), "Павлодар"},
+		{cityRe(`усть-каменогорск(?:а|е|у|ом)?`), "Усть-Каменогорск"},
+		{cityRe(`семе(?:й|я|е|ю|ем)`), "Семей"},
+		{cityRe(`атырау`), "Атырау"},
+		{cityRe(`костана(?:й|я|е|ю|ем)`), "Костанай"},
+		{cityRe(`кызылорд(?:а|ы|е|у|ой)`), "Кызылорда"},
+		{cityRe(`уральск(?:а|е|у|ом)?`), "Уральск"},
+		{cityRe(`петропавловск(?:а|е|у|ом)?`), "Петропавловск"},
+		{cityRe(`актау`), "Актау"},
+		{cityRe(`туркестан(?:а|е|у|ом)?`), "Туркестан"},
+		{cityRe(`кокшетау`), "Кокшетау"},
+		{cityRe(`талдыкорган(?:а|е|у|ом)?`), "Талдыкорган"},
+		{cityRe(`экибастуз(?:а|е|у|ом)?`), "Экибастуз"},
+		{cityRe(`москв(?:а|ы|е|у|ой)`), "Москва"},
+		{cityRe(`санкт-петербург(?:а|е|у|ом)?`), "Санкт-Петербург"},
+		{cityRe(`новосибирск(?:а|е|у|ом)?`), "Новосибирск"},
+		{cityRe(`екатеринбург(?:а|е|у|ом)?`), "Екатеринбург"},
+	}
+)
+
+// cityRe matches the city forms as whole words.
+func cityRe(forms string) *regexp.Regexp {
+	return regexp.MustCompile(`(?:^|[^\p{L}\-])(?:` + forms + `)(?:$|[^\p{L}\-])`)
+}
+
+// ParseContact returns the contact details a customer message contains.
+func ParseContact(text string) quote.Customer {
+	return quote.Customer{
+		Name:  ParseName(text),
+		Phone: ParsePhone(text),
+		Email: ParseEmail(text),
+		City:  ParseCity(text),
+	}
+}
+
+// ParsePhone returns the first valid Kazakhstan/Russia number in text as
+// +7XXXXXXXXXX.
+func ParsePhone(text string) string {
+	for _, m := range phoneRe.FindAllStringSubmatch(text, -1) {
+		if phone := NormalizePhone(m[1]); phone != "" {
+			return phone
+		}
+	}
+	return ""
+}
+
+// StripPhones blanks out every phone number in text, so the digits left can be
+// read as something else, such as an order number.
+func StripPhones(text string) string {
+	return phoneRe.ReplaceAllString(text, " ")
+}
+
+func ParseEmail(text string) string {
+	return strings.ToLower(emailRe.FindString(text))
+}
+
+// ParseName returns the name from phrases like "меня зовут Айгерим".
+func ParseName(text string) string {
+	m := nameRe.FindStringSubmatch(text)
+	if m == nil || nameStopWords[strings.ToLower(m[1])] {
+		return ""
+	}
+	r := []rune(strings.ToLower(m[1]))
+	return strings.ToUpper(string(r[:1])) + string(r[1:])
+}
+
+// ParseCity returns the first known city text names, in any case form.
+func ParseCity(text string) string {
+	lower := strings.ReplaceAll(strings.ToLower(text), "ё", "е")
+	for _, c := range cities {
+		if c.re.MatchString(lower) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// MergeContact returns base with every non-empty field of update applied.
+func MergeContact(base, update quote.Customer) quote.Customer {
+	if update.Name != "" {
+		base.Name = update.Name
+	}
+	if update.Phone != "" {
+		base.Phone = update.Phone
+	}
+	if update.Email != "" {
+		base.Email = update.Email
+	}
+	if update.City != "" {
+		base.City = update.City
+	}
+	return base
+}
+
+// EmptyContact reports whether c carries no details at all.
+func EmptyContact(c quote.Customer) bool {
+	return c.Name == "" && c.Phone == "" && c.Email == "" && c.City == ""
+}
@@ -0,0 +1,92 @@
+package lead
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"+7 (701) 123-45-67", "+77011234567"},
+		{"87011234567", "+77011234567"},
+		{"77011234567", "+77011234567"},
+		{"7011234567", "+77011234567"},
+		{"+7 495 123 45 67", "+74951234567"},
+		{"+7 111 123 45 67", ""},
+		{"8 777 777 77 77", ""},
+		{"12345", ""},
+		{"+1 202 555 0100", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizePhone(tt.raw); got != tt.want {
+			t.Errorf("NormalizePhone(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestParsePhone(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"мой номер +7 (701) 123-45-67, звоните", "+77011234567"},
+		{"8 701 123 45 67", "+77011234567"},
+		{"Айгерим 87011234567 Алматы", "+77011234567"},
+		{"заказ 1024", ""},
+		{"заказ 870112345678901", ""},
+		{"артикул 7011234567", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ParsePhone(tt.text); got != tt.want {
+			t.Errorf("ParsePhone(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseCity(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Я из Алматы", "Алматы"},
+		{"доставка в Алмате?", "Алматы"},
+		{"живу в Караганде", "Караганда"},
+		{"в Семее", "Семей"},
+		{"город Семей", "Семей"},
+		{"семейный бюджет", ""},
+		{"Нур-Султан", "Астана"},
+		{"в Костанае", "Костанай"},
+		{"ёмкость в москве", "Москва"},
+		{"костанайская область", ""},
+		{"алматинский", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseCity(tt.text); got != tt.want {
+			t.Errorf("ParseCity(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Меня зовут айгерим", "Айгерим"},
+		{"моё имя Олег, телефон 87011234567", "Олег"},
+		{"Имя: Данияр", "Данияр"},
+		{"имя Асель", "Асель"},
+		{"счёт на имя компании ТОО Ромашка", ""},
+		{"выставьте на имя ИП Иванов", ""},
+		{"имя: компании", ""},
+		{"просто вопрос", ""},
+	}
+	for _, tt := range tests {
+		if got := ParseName(tt.text); got != tt.want {
+			t.Errorf("ParseName(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
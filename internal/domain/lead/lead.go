@@ -0,0 +1,93 @@
+package lead
+
+import (
+	"strings"
+	"time"
+
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+type Status string
+
+const (
+	StatusNew       Status = "new"
+	StatusQualified Status = "qualified" // просил КП или принял предложение
+	StatusWon       Status = "won"
+	StatusLost      Status = "lost"
+)
+
+// Intents recorded on a lead.
+const (
+	IntentQuote    = "quote_requested"
+	IntentKPAccept = "kp_accept"
+	IntentCallback = "callback"
+	IntentManager  = "manager"
+	IntentOrder    = "order_placed"
+)
+
+// Lead is a customer contact captured from a chat. Leads are deduplicated by
+// Phone in its normalized +7XXXXXXXXXX form.
+type Lead struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	Phone      string     `json:"phone"`
+	Email      string     `json:"email,omitempty"`
+	City       string     `json:"city,omitempty"`
+	Status     Status     `json:"status"`
+	Channel    string     `json:"channel"` // telegram, whatsapp, web
+	SessionID  string     `json:"session_id"`
+	Intents    []string   `json:"intents"`
+	QuoteTotal int64      `json:"quote_total,omitempty"`
+	CRMID      string     `json:"crm_id,omitempty"`
+	SyncedAt   *time.Time `json:"synced_at,omitempty"`
+	SyncError  string     `json:"sync_error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Customer returns the contact in the shape quotes use.
+func (l Lead) Customer() quote.Customer {
+	return quote.Customer{Name: l.Name, Phone: l.Phone, Email: l.Email, City: l.City}
+}
+
+func ValidStatus(s Status) bool {
+	switch s {
+	case StatusNew, StatusQualified, StatusWon, StatusLost:
+		return true
+	}
+	return false
+}
+
+// NormalizePhone returns a Kazakhstan/Russia number as +7XXXXXXXXXX, or "" when
+// raw is not one. Kazakhstan numbers start with 6 or 7 after the country code,
+// Russian ones with 3, 4, 8 or 9.
+func NormalizePhone(raw string) string {
+	digits := make([]byte, 0, 11)
+	for i := 0; i < len(raw); i++ {
+		if raw[i] >= '0' && raw[i] <= '9' {
+			digits = append(digits, raw[i])
+		}
+	}
+	var national string
+	switch {
+	case len(digits) == 11 && (digits[0] == '7' || digits[0] == '8'):
+		national = string(digits[1:])
+	case len(digits) == 10 && digits[0] == '7':
+		national = string(digits)
+	default:
+		return ""
+	}
+	if !strings.ContainsRune("346789", rune(national[0])) || strings.Count(national, national[:1]) == len(national) {
+		return ""
+	}
+	return "+7" + national
+}
+
+// Title is the lead name CRMs show in their lists.
+func (l Lead) Title() string {
+	name := strings.TrimSpace(l.Name)
+	if name == "" {
+		name = l.Phone
+	}
+	return "Чат-бот: " + name
+}
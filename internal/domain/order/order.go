@@ -0,0 +1,77 @@
+package order
+
+import (
+	"strings"
+	"time"
+
+	"iq-home/go_beckend/internal/domain/quote"
+)
+
+// Statuses of the site's orders table. Orders placed from the chat start as
+// StatusNew; the site moves them on.
+const (
+	StatusNew       = "new"
+	StatusConfirmed = "confirmed"
+	StatusPaid      = "paid"
+	StatusShipped   = "shipped"
+	StatusDelivered = "delivered"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+)
+
+const (
+	DeliveryPickup  = "pickup"
+	DeliveryCourier = "delivery"
+)
+
+type Item struct {
+	ProductID int64  `json:"product_id"`
+	Name      string `json:"name"`
+	Qty       int    `json:"qty"`
+	UnitPrice int64  `json:"price"`
+}
+
+type Order struct {
+	ID        string         `json:"id"`
+	SessionID string         `json:"session_id,omitempty"`
+	UserID    string         `json:"user_id,omitempty"`
+	Status    string         `json:"status"`
+	Customer  quote.Customer `json:"customer"`
+	Delivery  string         `json:"delivery_method"`
+	Address   string         `json:"delivery_address,omitempty"`
+	Items     []Item         `json:"items"`
+	Total     int64          `json:"total"`
+	CreatedAt time.Time      `json:"created_at"`
+
+	ETA            *time.Time `json:"eta,omitempty"`
+	TrackingNumber string     `json:"tracking_number,omitempty"`
+	TrackingURL    string     `json:"tracking_url,omitempty"`
+}
+
+// StatusLabel is the status as customers read it.
+func StatusLabel(status string) string {
+	switch strings.ToLower(strings.TrimSpace(status)) {
+	case StatusNew, "pending", "created":
+		return "принят"
+	case StatusConfirmed, "processing":
+		return "подтверждён, собираем"
+	case StatusPaid:
+		return "оплачен"
+	case StatusShipped, "sent", "in_delivery":
+		return "передан в доставку"
+	case StatusDelivered:
+		return "доставлен"
+	case StatusCompleted, "done":
+		return "выполнен"
+	case StatusCancelled, "canceled":
+		return "отменён"
+	}
+	return status
+}
+
+func DeliveryLabel(method string) string {
+	if method == DeliveryPickup {
+		return "самовывоз"
+	}
+	return "доставка"
+}
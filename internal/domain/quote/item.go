@@ -6,4 +6,8 @@ type Item struct {
 	Qty       int
 	UnitPrice int64 // целое
 	LineTotal int64
+
+	Availability string // "в наличии, 12 шт" / "под заказ, 5 дн."
+	Group        string // раздел КП, напр. комната
+	AnalogueFor  string // "аналог для ABB 2CLA..." — позиция подобрана взамен чужого артикула
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/jung-kurt/gofpdf"
@@ -36,7 +37,11 @@ func (g *Generator) Generate(q quote.Quote) ([]byte, error) {
 	pdf.Ln(6)
 
 	if q.Customer.Name != "" || q.Customer.Phone != "" {
-		pdf.Cell(0, 6, fmt.Sprintf("Клиент: %s %s", q.Customer.Name, q.Customer.Phone))
+		pdf.Cell(0, 6, strings.TrimSpace(fmt.Sprintf("Клиент: %s %s", q.Customer.Name, q.Customer.Phone)))
+		pdf.Ln(6)
+	}
+	if q.Customer.Email != "" || q.Customer.City != "" {
+		pdf.Cell(0, 6, strings.Trim(q.Customer.Email+", "+q.Customer.City, ", "))
 		pdf.Ln(6)
 	}
 
@@ -49,12 +54,26 @@ func (g *Generator) Generate(q quote.Quote) ([]byte, error) {
 	pdf.Ln(8)
 
 	pdf.SetFont("DejaVu", "", 10)
+	group := ""
 	for _, it := range q.Items {
+		if it.Group != "" && it.Group != group {
+			group = it.Group
+			pdf.SetFont("DejaVu", "B", 10)
+			pdf.Cell(0, 7, group)
+			pdf.Ln(7)
+			pdf.SetFont("DejaVu", "", 10)
+		}
 		pdf.Cell(120, 6, trim(it.Name, 65))
 		pdf.Cell(20, 6, fmt.Sprintf("%d", it.Qty))
 		pdf.Cell(25, 6, fmt.Sprintf("%d", it.UnitPrice))
 		pdf.Cell(25, 6, fmt.Sprintf("%d", it.LineTotal))
 		pdf.Ln(6)
+		if note := itemNote(it); note != "" {
+			pdf.SetFont("DejaVu", "", 8)
+			pdf.Cell(120, 4, "  "+trim(note, 80))
+			pdf.Ln(5)
+			pdf.SetFont("DejaVu", "", 10)
+		}
 	}
 
 	pdf.Ln(4)
@@ -62,6 +81,18 @@ func (g *Generator) Generate(q quote.Quote) ([]byte, error) {
 	pdf.Cell(0, 7, fmt.Sprintf("Итого: %d", q.Total))
 	pdf.Ln(6)
 
+	if len(q.Warnings) > 0 {
+		pdf.Ln(2)
+		pdf.SetFont("DejaVu", "B", 10)
+		pdf.Cell(0, 6, "Внимание:")
+		pdf.Ln(6)
+		pdf.SetFont("DejaVu", "", 9)
+		for _, w := range q.Warnings {
+			pdf.MultiCell(0, 5, "• "+w, "", "L", false)
+		}
+		pdf.Ln(2)
+	}
+
 	pdf.SetFont("DejaVu", "", 9)
 	pdf.Cell(0, 5, "L-Xor • Электрика")
 	pdf.Ln(5)
@@ -75,6 +106,17 @@ func (g *Generator) Generate(q quote.Quote) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func itemNote(it quote.Item) string {
+	switch {
+	case it.AnalogueFor != "" && it.Availability != "":
+		return it.AnalogueFor + "; " + it.Availability
+	case it.AnalogueFor != "":
+		return it.AnalogueFor
+	default:
+		return it.Availability
+	}
+}
+
 func trim(s string, max int) string {
 	r := []rune(s)
 	if len(r) <= max {
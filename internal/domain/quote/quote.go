@@ -13,10 +13,12 @@ type Quote struct {
 	DiscountAmount  int64
 	Total           int64
 	Comment         string
+	Warnings        []string
 }
 
 type Customer struct {
 	Name  string
 	Phone string
+	Email string
 	City  string
 }
@@ -0,0 +1,42 @@
+-- Chat orders: the columns the chat needs on the site's orders and
+-- order_items tables. Apply once, before deploying the backend that writes
+-- chat orders, e.g.:
+--
+--   psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f migrations/0001_chat_orders.sql
+--
+-- Every statement is idempotent. The site tables are not created here; the
+-- migration fails if they are missing.
+
+BEGIN;
+
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'new';
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS total bigint NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS source text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS session_id text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_name text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_phone text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_email text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_city text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_method text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_address text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS delivery_eta date;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tracking_number text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS tracking_url text;
+
+-- Status change notifications: status_notified is the last status the
+-- customer was told about; failed deliveries are retried after
+-- status_notify_after.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status_notified text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status_notify_attempts int NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status_notify_after timestamptz;
+
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS name text;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS qty int NOT NULL DEFAULT 1;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS price bigint NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS orders_status_unnotified ON orders (session_id)
+	WHERE session_id IS NOT NULL AND status IS DISTINCT FROM status_notified;
+CREATE INDEX IF NOT EXISTS orders_session ON orders (session_id) WHERE session_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS orders_customer_phone ON orders (customer_phone) WHERE customer_phone IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,22 @@
+-- Product stock: per-warehouse quantities and the expected arrival of goods
+-- that are out of stock, read by the chat to rank and annotate products.
+-- Filled by the 1C/warehouse export; the backend only reads it. Apply with:
+--
+--   psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f migrations/0002_product_stock.sql
+--
+-- Every statement is idempotent.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS product_stock (
+	product_id  bigint NOT NULL,
+	warehouse   text NOT NULL,
+	quantity    numeric NOT NULL DEFAULT 0,
+	-- expected_at is when the next delivery arrives at this warehouse; NULL
+	-- when nothing is on the way.
+	expected_at date,
+	updated_at  timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (product_id, warehouse)
+);
+
+COMMIT;
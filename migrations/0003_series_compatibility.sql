@@ -0,0 +1,24 @@
+-- Series compatibility: per series, the frame sizes it is sold in, the other
+-- series whose frames fit its mechanisms, and the color families used to tell
+-- whether a frame and a mechanism go together. Maintained by the catalog team;
+-- the chat only reads it. Apply with:
+--
+--   psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f migrations/0003_series_compatibility.sql
+--
+-- Every statement is idempotent.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS series_compatibility (
+	series         text PRIMARY KEY,
+	-- frame_posts lists the frame sizes of the series, e.g. {1,2,3,4,5}.
+	frame_posts    int[] NOT NULL DEFAULT '{}',
+	-- frame_series lists the other series whose frames fit these mechanisms.
+	frame_series   text[] NOT NULL DEFAULT '{}',
+	-- color_families maps a family to the color name parts that belong to it,
+	-- e.g. {"белый": ["бел", "white"], "чёрный": ["черн", "чёрн", "black"]}.
+	color_families jsonb NOT NULL DEFAULT '{}',
+	updated_at     timestamptz NOT NULL DEFAULT now()
+);
+
+COMMIT;
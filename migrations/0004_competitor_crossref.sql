@@ -0,0 +1,26 @@
+-- Competitor cross-reference: which own product replaces a competitor's
+-- article. Filled by POST /v1/crossref/import and read by the chat when a
+-- document lists competitor articles. Apply with:
+--
+--   psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f migrations/0004_competitor_crossref.sql
+--
+-- Every statement is idempotent.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS competitor_crossref (
+	id                 bigserial PRIMARY KEY,
+	competitor_brand   text NOT NULL DEFAULT '',
+	-- competitor_article is stored normalized: upper case, letters, digits
+	-- and dashes only.
+	competitor_article text NOT NULL,
+	product_id         bigint NOT NULL,
+	created_at         timestamptz NOT NULL DEFAULT now(),
+	-- The import upserts on (competitor_brand, competitor_article); brands
+	-- reuse article numbers, so the article alone is not unique.
+	UNIQUE (competitor_brand, competitor_article)
+);
+
+CREATE INDEX IF NOT EXISTS competitor_crossref_article ON competitor_crossref (competitor_article);
+
+COMMIT;
@@ -0,0 +1,21 @@
+-- Messenger updates: ids of processed webhook updates and relayed manager
+-- messages, so a redelivery is not answered twice, also across restarts and
+-- replicas. Rows older than 24 hours are deleted by the backend. Apply with:
+--
+--   psql "$DATABASE_URL" -v ON_ERROR_STOP=1 -f migrations/0005_messenger_updates.sql
+--
+-- Every statement is idempotent.
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS messenger_updates (
+	channel     text NOT NULL,
+	update_id   text NOT NULL,
+	received_at timestamptz NOT NULL DEFAULT now(),
+	-- Dedup inserts with on_conflict=channel,update_id.
+	PRIMARY KEY (channel, update_id)
+);
+
+CREATE INDEX IF NOT EXISTS messenger_updates_received_at ON messenger_updates (received_at);
+
+COMMIT;